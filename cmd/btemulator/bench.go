@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/theotheradamsmith/btemulator/internal/bench"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+)
+
+func runBench(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	fixedTime := clockFlag(fs)
+	var cfg bench.Config
+	fs.IntVar(&cfg.PoolSize, "pool", 100000, "The number of registration pool rows to seed.")
+	fs.StringVar(&cfg.Keys, "keys", bench.KeysSequential, "How seeded AIDs are spread over the key space (sequential, random).")
+	fs.Float64Var(&cfg.ClaimedRate, "claimed", 0.5, "The fraction of pool rows seeded with an AppK.")
+	fs.StringVar(&cfg.Access, "access", bench.AccessUniform, "How AIDs are picked for each call (uniform, zipf).")
+	mix := fs.String("mix", "read-aid-row=1,get-appk=1,paired-unregistered=1", "The weighted mix of access calls to run.")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 16, "The number of concurrent callers.")
+	fs.DurationVar(&cfg.Duration, "duration", 30*time.Second, "How long to run the load for.")
+	fs.Int64Var(&cfg.Seed, "seed", 1, "The random seed for seeding and picking AIDs.")
+	skipSeed := fs.Bool("skip-seed", false, "Reuse the pool seeded by an earlier run with the same --pool, --keys and --seed.")
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	var err error
+	if cfg.Mix, err = bench.ParseMix(*mix); err != nil {
+		log.Fatalf("Bad --mix: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(fs.Output(), "Bad flags: %v\n", err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	pool := bench.Layout(cfg)
+	if !*skipSeed {
+		log.Printf("Seeding %d pool rows with %s keys", cfg.PoolSize, cfg.Keys)
+		if err := pool.Write(ctx, client.Table, newClock(*fixedTime)); err != nil {
+			log.Fatalf("Could not seed pool: %v", err)
+		}
+	}
+
+	log.Printf("Running %s of load from %d callers", cfg.Duration, cfg.Concurrency)
+	stats, err := bench.Run(ctx, client.Table, pool, cfg)
+	if err != nil {
+		log.Fatalf("Load run failed: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "operation\tcalls\terrors\tcalls/s\tp50\tp95\tp99\t")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.0f\t%s\t%s\t%s\t\n", s.Op, s.Count, s.Errors, s.Throughput,
+			s.P50.Round(time.Microsecond), s.P95.Round(time.Microsecond), s.P99.Round(time.Microsecond))
+	}
+	w.Flush()
+}
@@ -2,39 +2,180 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"flag"
 	"log"
+	"os"
+	"time"
 
 	"github.com/theotheradamsmith/btemulator/internal/access"
 	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
 	"github.com/theotheradamsmith/btemulator/internal/schema"
 )
 
-func main() {
-	project := flag.String("project", schema.Project, "The Google Cloud Platform project ID. Required.")
-	instance := flag.String("instance", schema.Instance, "The Google Cloud Bigtable instance ID. Required.")
+type command func(ctx context.Context, args []string)
 
-	flag.Parse()
+var commands = map[string]command{
+	"bench":     runBench,
+	"check":     runCheck,
+	"compare":   runCompare,
+	"copy":      runCopy,
+	"export":    runExport,
+	"gateway":   runGateway,
+	"import":    runImport,
+	"kms":       runKMS,
+	"recover":   runRecover,
+	"reencrypt": runReencrypt,
+	"registry":  runRegistry,
+	"rekey":     runRekey,
+	"seed":      runSeed,
+	"shell":     runShell,
+	"simulate":  runSimulate,
+	"ui":        runUI,
+}
+
+func connectionFlags(fs *flag.FlagSet) (project, instance *string) {
+	project = fs.String("project", schema.Project, "The Google Cloud Platform project ID. Required.")
+	instance = fs.String("instance", schema.Instance, "The Google Cloud Bigtable instance ID. Required.")
+	return project, instance
+}
+
+func clockFlag(fs *flag.FlagSet) *string {
+	return fs.String("fixed-time", "", "Use this RFC 3339 time for every timestamp written, so the results are reproducible.")
+}
+
+func newClock(fixedTime string) clock.Clock {
+	if fixedTime == "" {
+		return clock.Real{}
+	}
+	t, err := time.Parse(time.RFC3339, fixedTime)
+	if err != nil {
+		log.Fatalf("Bad --fixed-time: %v", err)
+	}
+	return clock.NewFake(t)
+}
+
+func attestationRootsFlag(fs *flag.FlagSet) *string {
+	return fs.String("attestation-roots", "", "A PEM file of the CAs whose attestations earn devices hardware trust. Without it no device can register as hardware.")
+}
+
+func loadAttestationRoots(path string) *x509.CertPool {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Could not read attestation roots: %v", err)
+	}
+	certs, err := access.ParseCertificates(data)
+	if err != nil {
+		log.Fatalf("Bad --attestation-roots: %v", err)
+	}
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool
+}
+
+// keyFlags choose the key provider AppKs are sealed with. At most one of
+// --key-file, --key-env and --kms may be given; with none, AppKs are stored
+// in plaintext.
+type keyFlags struct {
+	file, env, kms, kmsKey *string
+}
 
-	for _, f := range []string{"project", "instance"} {
-		if flag.Lookup(f).Value.String() == "" {
+func sealerFlags(fs *flag.FlagSet) keyFlags {
+	return keyFlags{
+		file:   fs.String("key-file", "", "A file of id=base64 AES-256 keys, current first, to seal AppKs with."),
+		env:    fs.String("key-env", "", "An environment variable holding keys as for --key-file, separated by commas."),
+		kms:    fs.String("kms", "", "The state file of a local KMS to seal AppKs with; see the kms command."),
+		kmsKey: fs.String("kms-key", "appk", "The local KMS key to seal AppKs with."),
+	}
+}
+
+func (f keyFlags) sealer(ctx context.Context) *envelope.Sealer {
+	var (
+		provider envelope.KeyProvider
+		given    int
+	)
+	if *f.file != "" {
+		keys, err := envelope.LoadKeyFile(*f.file)
+		if err != nil {
+			log.Fatalf("Bad --key-file: %v", err)
+		}
+		provider = keys
+		given++
+	}
+	if *f.env != "" {
+		keys, err := envelope.KeysFromEnv(*f.env)
+		if err != nil {
+			log.Fatalf("Bad --key-env: %v", err)
+		}
+		provider = keys
+		given++
+	}
+	if *f.kms != "" {
+		kms, err := envelope.OpenLocalKMS(*f.kms)
+		if err != nil {
+			log.Fatalf("Bad --kms: %v", err)
+		}
+		provider = kms.Key(*f.kmsKey)
+		given++
+	}
+	switch given {
+	case 0:
+		return nil
+	case 1:
+	default:
+		log.Fatalf("Only one of --key-file, --key-env and --kms may be given.")
+	}
+	keyID, err := provider.KeyID(ctx)
+	if err != nil {
+		log.Fatalf("Could not get the current key: %v", err)
+	}
+	log.Printf("Sealing AppKs with key %s", keyID)
+	return &envelope.Sealer{Provider: provider}
+}
+
+func requireFlags(fs *flag.FlagSet, names ...string) {
+	for _, f := range names {
+		if fs.Lookup(f).Value.String() == "" {
 			log.Fatalf("The %s flag is required.", f)
 		}
 	}
+}
 
+func main() {
 	ctx := context.Background()
 
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(ctx, os.Args[2:])
+			return
+		}
+	}
+
+	project, instance := connectionFlags(flag.CommandLine)
+	fixedTime := clockFlag(flag.CommandLine)
+
+	flag.Parse()
+
+	requireFlags(flag.CommandLine, "project", "instance")
+
 	admin := build.DoAdmin(ctx, *project, *instance)
 
-	client, tbl := build.DoClient(ctx, *project, *instance)
+	client, tbl := build.DoClient(ctx, *project, *instance, newClock(*fixedTime))
 
 	access.ReadAllRows(ctx, tbl, schema.ColumnDID, schema.ColumnFamilyDeviceProperties)
 	access.ReadAllRows(ctx, tbl, schema.ColumnMainKey, schema.ColumnFamilyDeviceProperties)
 	access.ReadAllRows(ctx, tbl, schema.ColumnAID, schema.ColumnFamilyDeviceProperties)
 
-	access.ReadAidRow(ctx, tbl, "aid-1")
-	access.ReadAidRow(ctx, tbl, "aid-2")
-	access.ReadAidRow(ctx, tbl, "aid-3")
+	access.ReadAidRow(ctx, tbl, "km69a-b3boj-1w6ft-9mh83-wao7m")
+	access.ReadAidRow(ctx, tbl, "f6bef-19n9f-ws6ck-ranir-35ksq")
+	access.ReadAidRow(ctx, tbl, "ns86o-94h6x-x9y51-o5xj6-og3n9")
 
 	if err := client.Close(); err != nil {
 		log.Fatalf("Could not close data operations client: %v", err)
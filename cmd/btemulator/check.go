@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/check"
+	"github.com/theotheradamsmith/btemulator/internal/rekey"
+)
+
+func runCheck(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	layout := fs.String("layout", "legacy", "The key layout of the main rows (legacy, hashed).")
+	asJSON := fs.Bool("json", false, "Print the report as JSON.")
+	repair := fs.Bool("repair", false, "Fix the findings that can be fixed safely.")
+	fixedTime := clockFlag(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	l, err := rekey.LayoutByName(*layout)
+	if err != nil {
+		log.Fatalf("Bad --layout: %v", err)
+	}
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	c := check.Checker{Table: client.Table, Layout: l, Clock: newClock(*fixedTime)}
+	report, err := c.Run(ctx)
+	if err != nil {
+		log.Fatalf("Could not check table: %v", err)
+	}
+	if *repair {
+		if err := c.Repair(ctx, report); err != nil {
+			log.Fatalf("Could not repair table: %v", err)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("Could not write report: %v", err)
+		}
+	} else {
+		for _, f := range report.Findings {
+			status := ""
+			if f.Repaired {
+				status = " (repaired)"
+			} else if f.Repairable {
+				status = " (repairable)"
+			}
+			fmt.Printf("%-21s %s: %s%s\n", f.Kind, f.Key, f.Detail, status)
+		}
+		fmt.Printf("%d main rows, %d pool rows, %d findings, %d unrepaired\n",
+			report.MainRows, report.PoolRows, len(report.Findings), report.Unrepaired())
+	}
+
+	if report.Unrepaired() > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/api/option"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/compare"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+const tableSpecHelp = "as project/instance[/table][@emulator-host:port]. Without an emulator host, BIGTABLE_EMULATOR_HOST or else Google Cloud is used."
+
+func runCompare(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	leftSpec := fs.String("left", "", "The left table, "+tableSpecHelp+" Required.")
+	rightSpec := fs.String("right", "", "The right table, "+tableSpecHelp+" Required.")
+	prefix := fs.String("prefix", "", "Only compare rows whose keys start with this prefix.")
+	ignoreTimestamps := fs.Bool("ignore-timestamps", false, "Compare cell values without their timestamps.")
+	ignoreColumns := fs.String("ignore-columns", "", "Comma-separated Family:Column or Family:* columns to leave out.")
+	asJSON := fs.Bool("json", false, "Print the report as JSON.")
+	maxDiffs := fs.Int("max-diffs", 100, "The most differences to print, or 0 for all of them.")
+	fs.Parse(args)
+
+	requireFlags(fs, "left", "right")
+
+	left := openTableSpec(ctx, *leftSpec)
+	defer left.Close()
+	right := openTableSpec(ctx, *rightSpec)
+	defer right.Close()
+
+	opts := compare.Options{IgnoreTimestamps: *ignoreTimestamps, IgnoreColumns: splitList(*ignoreColumns)}
+	if *prefix != "" {
+		opts.RowSet = bigtable.PrefixRange(*prefix)
+	}
+	rep, err := compare.Compare(ctx, left.Table, right.Table, opts)
+	if err != nil {
+		log.Fatalf("Compare failed: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rep); err != nil {
+			log.Fatalf("Could not write report: %v", err)
+		}
+	} else {
+		for i, d := range rep.Diffs {
+			if *maxDiffs > 0 && i == *maxDiffs {
+				fmt.Printf("... and %d more\n", len(rep.Diffs)-i)
+				break
+			}
+			fmt.Println(d)
+		}
+		fmt.Printf("%d left rows, %d right rows, %d matched, %d differences\n", rep.LeftRows, rep.RightRows, rep.Matched, len(rep.Diffs))
+	}
+	if len(rep.Diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// openTableSpec connects read-only to a table given as
+// project/instance[/table][@emulator-host:port].
+func openTableSpec(ctx context.Context, spec string) *build.BTClient {
+	path, host, _ := strings.Cut(spec, "@")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		log.Fatalf("Bad table %q, want project/instance[/table][@emulator-host:port]", spec)
+	}
+	table := schema.TableName
+	if len(parts) == 3 {
+		table = parts[2]
+	}
+	opts := []option.ClientOption{option.WithScopes(bigtable.ReadonlyScope)}
+	if host != "" {
+		opts = build.EmulatorOptions(host)
+	}
+	client, err := build.Connect(ctx, parts[0], parts[1], table, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
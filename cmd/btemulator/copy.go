@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/api/option"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/copier"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func runCopy(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("copy", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	fromProject := fs.String("from-project", "", "The project to copy from. Required.")
+	fromInstance := fs.String("from-instance", "", "The instance to copy from. Required.")
+	fromTable := fs.String("from-table", schema.TableName, "The table to copy from.")
+	fromEmulator := fs.String("from-emulator", "", "Copy from the emulator at this host:port instead of Google Cloud.")
+	ranges := fs.String("range", "", "Comma-separated start:end key ranges to copy. Either end may be empty.")
+	prefixes := fs.String("prefix", "", "Comma-separated key prefixes to copy.")
+	qids := fs.String("qid", "", "Comma-separated QIDs whose main and pairing rows to copy.")
+	redactKey := fs.String("redact-key", "btemulator", "The key pseudonyms are derived from. The same key gives the same pseudonyms.")
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance", "from-project", "from-instance")
+
+	// The copy only ever writes to the emulator. The destination client picks
+	// it up from the environment, so clear that before connecting to the
+	// source, which would otherwise also be the emulator.
+	emulator := os.Getenv("BIGTABLE_EMULATOR_HOST")
+	if emulator == "" {
+		log.Fatalf("BIGTABLE_EMULATOR_HOST must name the emulator to copy into.")
+	}
+	admin := build.DoAdmin(ctx, *project, *instance)
+	defer admin.Close()
+	dst := build.NewBTClient(ctx, *project, *instance)
+	defer dst.Close()
+	os.Unsetenv("BIGTABLE_EMULATOR_HOST")
+
+	opts := []option.ClientOption{option.WithScopes(bigtable.ReadonlyScope)}
+	if *fromEmulator != "" {
+		opts = build.EmulatorOptions(*fromEmulator)
+	}
+	src, err := build.Connect(ctx, *fromProject, *fromInstance, *fromTable, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+
+	var sel copier.Selection
+	for _, r := range splitList(*ranges) {
+		start, end, ok := strings.Cut(r, ":")
+		if !ok {
+			log.Fatalf("Bad --range %q, want start:end", r)
+		}
+		if end == "" {
+			sel.Ranges = append(sel.Ranges, bigtable.InfiniteRange(start))
+		} else {
+			sel.Ranges = append(sel.Ranges, bigtable.NewRange(start, end))
+		}
+	}
+	for _, p := range splitList(*prefixes) {
+		sel.Ranges = append(sel.Ranges, bigtable.PrefixRange(p))
+	}
+	sel.QIDs = splitList(*qids)
+
+	c := &copier.Copier{Source: src.Table, Dest: dst.Table, Redactor: &copier.Redactor{Key: []byte(*redactKey)}}
+	log.Printf("Copying from %s/%s %s into %s", *fromProject, *fromInstance, *fromTable, emulator)
+	stats, err := c.Copy(ctx, sel)
+	if err != nil {
+		log.Fatalf("Copy stopped after %d rows: %v", stats.Rows, err)
+	}
+	log.Printf("Copied %d rows, %d cells, %d redacted", stats.Rows, stats.Cells, stats.Redacted)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/export"
+)
+
+func runExport(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	out := fs.String("out", "-", "The file to write, or - for standard output.")
+	format := fs.String("format", "", "The output format, jsonl or csv. Defaults to the --out file extension, or jsonl.")
+	decode := fs.Bool("decode", false, "Add each value decoded through the schema registry alongside its base64 bytes.")
+	prefix := fs.String("prefix", "", "Only export rows whose keys start with this prefix.")
+	start := fs.String("start", "", "Only export rows with keys at or after this key.")
+	end := fs.String("end", "", "Only export rows with keys before this key.")
+	checkpoint := fs.String("checkpoint", "export.checkpoint", "The file progress is saved to when writing to a file. An existing checkpoint is resumed.")
+	every := fs.Int("checkpoint-every", 1000, "The number of rows written between checkpoints.")
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	e := &export.Exporter{
+		Table:           client.Table,
+		Format:          formatFor(*format, *out),
+		Decode:          *decode,
+		Prefix:          *prefix,
+		Start:           *start,
+		End:             *end,
+		CheckpointPath:  *checkpoint,
+		CheckpointEvery: *every,
+	}
+	if *out == "-" {
+		if _, err := e.Export(ctx, os.Stdout); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	}
+	n, err := e.Run(ctx, *out)
+	if err != nil {
+		log.Fatalf("Export stopped after %d rows, rerun to resume from %s: %v", n, *checkpoint, err)
+	}
+	log.Printf("Exported %d rows to %s", n, *out)
+}
+
+// formatFor is the export format name, or else the one implied by the
+// extension of path.
+func formatFor(name, path string) string {
+	if name != "" {
+		return name
+	}
+	if filepath.Ext(path) == ".csv" {
+		return export.FormatCSV
+	}
+	return export.FormatJSONL
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/gateway"
+)
+
+func runGateway(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	addr := fs.String("addr", "localhost:8081", "The address to serve the API on.")
+	fixedTime := clockFlag(fs)
+	roots := attestationRootsFlag(fs)
+	keys := sealerFlags(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance", "addr")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	r := &access.Registrar{Table: client.Table, Clock: newClock(*fixedTime), AttestationRoots: loadAttestationRoots(*roots), Sealer: keys.sealer(ctx)}
+	log.Printf("Serving the registration API for %s/%s on http://%s/ (spec at /openapi.json)", *project, *instance, *addr)
+	if err := http.ListenAndServe(*addr, gateway.New(r)); err != nil {
+		log.Fatalf("Could not serve: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/export"
+	"github.com/theotheradamsmith/btemulator/internal/importer"
+)
+
+func runImport(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	fixedTime := clockFlag(fs)
+	csvPath := fs.String("csv", "", "The CSV file of device pairings to import.")
+	restore := fs.String("restore", "", "A file written by export to write back, cells and timestamps unchanged.")
+	format := fs.String("format", "", "The --restore file format, jsonl or csv. Defaults to the file extension, or jsonl.")
+	mapping := fs.String("map", "", "Header names for each field, such as aid=Adoption ID,did=Serial. Fields default to aid, qid, did and fcm.")
+	chunk := fs.Int("chunk", 500, "The number of records checked and written per bulk write.")
+	dryRun := fs.Bool("dry-run", false, "Validate the file without writing anything.")
+	legacyAIDs := fs.Bool("legacy-aids", false, "Accept AIDs issued before AIDs had a check character.")
+	reportPath := fs.String("report", "", "Write the per-row error report to this CSV file instead of standard output.")
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+	if (*csvPath == "") == (*restore == "") {
+		log.Fatalf("Exactly one of --csv and --restore is required.")
+	}
+
+	m, err := importer.ParseMapping(*mapping)
+	if err != nil {
+		log.Fatalf("Bad --map: %v", err)
+	}
+	path := *csvPath + *restore
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Could not open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	im := &importer.Importer{Table: client.Table, Clock: newClock(*fixedTime), Mapping: m, ChunkSize: *chunk, DryRun: *dryRun, LegacyAIDs: *legacyAIDs}
+	var rep *importer.Report
+	if *restore != "" {
+		rd, rerr := export.NewReader(f, formatFor(*format, path))
+		if rerr != nil {
+			log.Fatalf("Could not read %s: %v", path, rerr)
+		}
+		rep, err = im.Restore(ctx, rd)
+	} else {
+		rep, err = im.ImportCSV(ctx, f)
+	}
+	if rep != nil {
+		writeImportReport(rep, *reportPath)
+		verb := "Imported"
+		if *dryRun {
+			verb = "Would import"
+		}
+		log.Printf("%s %d of %d records, %d rejected", verb, rep.Imported, rep.Records, len(rep.Errors))
+	}
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	if len(rep.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func writeImportReport(rep *importer.Report, path string) {
+	if path == "" {
+		for _, e := range rep.Errors {
+			fmt.Printf("REJECTED: %v\n", e)
+		}
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Could not create %s: %v", path, err)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"line", "aid", "qid", "did", "error"})
+	for _, e := range rep.Errors {
+		w.Write([]string{strconv.Itoa(e.Line), e.Device.AID, e.Device.QID, e.Device.DID, e.Err.Error()})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Fatalf("Could not write %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Could not write %s: %v", path, err)
+	}
+}
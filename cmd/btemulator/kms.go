@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+)
+
+func runKMS(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("kms", flag.ExitOnError)
+	state := fs.String("state", "kms.json", "The local KMS state file.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: btemulator kms [flags] create|rotate|primary <key>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		log.Fatalf("Expected an action and a key name.")
+	}
+	kms, err := envelope.OpenLocalKMS(*state)
+	if err != nil {
+		log.Fatalf("Could not open local KMS: %v", err)
+	}
+	var version string
+	switch action, name := fs.Arg(0), fs.Arg(1); action {
+	case "create":
+		version, err = kms.CreateKey(name)
+	case "rotate":
+		version, err = kms.RotateKey(name)
+	case "primary":
+		version, err = kms.Primary(name)
+	default:
+		log.Fatalf("Unknown action %q.", action)
+	}
+	if err != nil {
+		log.Fatalf("Could not %s key: %v", fs.Arg(0), err)
+	}
+	fmt.Println(version)
+}
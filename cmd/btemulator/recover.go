@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+)
+
+func runRecover(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	staleAfter := fs.Duration("stale-after", time.Minute, "How old a registration intent must be before it is treated as abandoned.")
+	fixedTime := clockFlag(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	r := access.Registrar{Table: client.Table, Clock: newClock(*fixedTime), StaleAfter: *staleAfter}
+	rec, err := r.Recover(ctx)
+	for _, key := range rec.Resumed {
+		log.Printf("\tfinished registration of %s", key)
+	}
+	for _, key := range rec.RolledBack {
+		log.Printf("\trolled back registration of %s", key)
+	}
+	if err != nil {
+		log.Fatalf("Could not recover every registration: %v", err)
+	}
+	log.Printf("Recovered %d registrations", len(rec.Resumed)+len(rec.RolledBack))
+}
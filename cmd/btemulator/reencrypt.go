@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+)
+
+func runReencrypt(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	keys := sealerFlags(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	sealer := keys.sealer(ctx)
+	if sealer == nil {
+		log.Fatalf("One of --key-file, --key-env or --kms is required.")
+	}
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	r := envelope.Reencrypter{Table: client.Table, Sealer: sealer}
+	stats, err := r.Run(ctx)
+	if err != nil {
+		log.Fatalf("Could not re-encrypt AppKs: %v", err)
+	}
+	log.Printf("Scanned %d rows: encrypted %d AppKs, rewrapped %d, %d already current, %d in registration intents", stats.Rows, stats.Encrypted, stats.Rewrapped, stats.Current, stats.Intents)
+	if stats.Changed > 0 {
+		log.Printf("%d AppKs or intents changed while re-encrypting; rerun to finish them", stats.Changed)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+
+	"google.golang.org/grpc"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/rpc"
+	"github.com/theotheradamsmith/btemulator/registry/registrypb"
+)
+
+func runRegistry(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("registry", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	addr := fs.String("addr", "localhost:9090", "The address to serve the DeviceRegistry gRPC service on.")
+	fixedTime := clockFlag(fs)
+	roots := attestationRootsFlag(fs)
+	keys := sealerFlags(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance", "addr")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %v", *addr, err)
+	}
+	srv := grpc.NewServer()
+	registrypb.RegisterDeviceRegistryServer(srv, &rpc.Server{Registrar: &access.Registrar{Table: client.Table, Clock: newClock(*fixedTime), AttestationRoots: loadAttestationRoots(*roots), Sealer: keys.sealer(ctx)}})
+	log.Printf("Serving DeviceRegistry for %s/%s on %s", *project, *instance, lis.Addr())
+	if err := srv.Serve(lis); err != nil {
+		log.Fatalf("Could not serve: %v", err)
+	}
+}
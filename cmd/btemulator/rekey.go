@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/rekey"
+)
+
+func runRekey(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	from := fs.String("from", "legacy", "The key layout the main rows are currently stored in (legacy, hashed).")
+	to := fs.String("to", "hashed", "The key layout to move the main rows to (legacy, hashed).")
+	batch := fs.Int("batch", 100, "The number of rows to copy, verify and delete at a time.")
+	checkpoint := fs.String("checkpoint", "rekey.checkpoint", "The file progress is saved to. An existing checkpoint is resumed.")
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	fromLayout, err := rekey.LayoutByName(*from)
+	if err != nil {
+		log.Fatalf("Bad --from: %v", err)
+	}
+	toLayout, err := rekey.LayoutByName(*to)
+	if err != nil {
+		log.Fatalf("Bad --to: %v", err)
+	}
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	m := rekey.Migrator{
+		Table:          client.Table,
+		From:           fromLayout,
+		To:             toLayout,
+		BatchSize:      *batch,
+		CheckpointPath: *checkpoint,
+	}
+	log.Printf("Re-keying main rows from %s to %s layout", fromLayout.Name(), toLayout.Name())
+	stats, err := m.Run(ctx)
+	if err != nil {
+		log.Fatalf("Re-keying stopped after %d rows, rerun to resume from %s: %v", stats.Copied, *checkpoint, err)
+	}
+	log.Printf("Re-keyed %d of %d scanned rows", stats.Copied, stats.Scanned)
+}
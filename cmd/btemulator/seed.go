@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+	"github.com/theotheradamsmith/btemulator/internal/gen"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func runSeed(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	fixedTime := clockFlag(fs)
+	scenarios := fs.String("scenarios", "", "Comma-separated seed scenarios to write. Defaults to all of them unless --generate is set.")
+	var cfg gen.Config
+	fs.IntVar(&cfg.Devices, "generate", 0, "The number of synthetic devices to generate.")
+	fs.Int64Var(&cfg.Seed, "seed", 1, "The random seed for generated devices.")
+	states := fs.String("states", "", "Weights of generated registration states, such as ready=60,registered=40.")
+	perQID := fs.String("per-qid", "", "Weights of generated devices per QID, such as 1=50,2=30,5=20.")
+	fs.DurationVar(&cfg.CreatedSpread, "created-spread", 90*24*time.Hour, "How far back generated CreatedDate values reach.")
+	keys := sealerFlags(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+	sealer := keys.sealer(ctx)
+
+	if *states != "" {
+		cfg.States = parseStates(*states)
+	}
+	if *perQID != "" {
+		cfg.DevicesPerQID = parsePerQID(*perQID)
+	}
+	names := build.Scenarios
+	if *scenarios != "" {
+		names = strings.Split(*scenarios, ",")
+	} else if cfg.Devices > 0 {
+		names = nil
+	}
+
+	admin := build.DoAdmin(ctx, *project, *instance)
+	defer admin.Close()
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	clk := newClock(*fixedTime)
+	if err := build.Seed(ctx, client.Table, clk, names...); err != nil {
+		log.Fatalf("Could not seed %s: %v", schema.TableName, err)
+	}
+	// The scenarios are written in plaintext, so they are sealed in place.
+	if sealer != nil && len(names) > 0 {
+		r := envelope.Reencrypter{Table: client.Table, Sealer: sealer}
+		if _, err := r.Run(ctx); err != nil {
+			log.Fatalf("Could not seal seeded AppKs: %v", err)
+		}
+	}
+	if cfg.Devices > 0 {
+		cfg.Now = clk.Now()
+		log.Printf("Writing %d generated devices", cfg.Devices)
+		devices, err := gen.Generate(cfg)
+		if err != nil {
+			log.Fatalf("Could not generate devices: %v", err)
+		}
+		if err := gen.Write(ctx, client.Table, devices, sealer); err != nil {
+			log.Fatalf("Could not write generated devices: %v", err)
+		}
+	}
+}
+
+func parseStates(s string) map[access.State]int {
+	weights, err := gen.ParseWeights(s)
+	if err != nil {
+		log.Fatalf("Bad --states: %v", err)
+	}
+	states := make(map[access.State]int)
+	for name, w := range weights {
+		known := false
+		for _, st := range access.States {
+			known = known || string(st) == name
+		}
+		if !known {
+			log.Fatalf("Bad --states: unknown state %q", name)
+		}
+		states[access.State(name)] = w
+	}
+	return states
+}
+
+func parsePerQID(s string) map[int]int {
+	weights, err := gen.ParseWeights(s)
+	if err != nil {
+		log.Fatalf("Bad --per-qid: %v", err)
+	}
+	perQID := make(map[int]int)
+	for name, w := range weights {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 1 {
+			log.Fatalf("Bad --per-qid: %q is not a device count", name)
+		}
+		perQID[n] = w
+	}
+	return perQID
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/peterh/liner"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/shell"
+)
+
+func runShell(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	limit := fs.Int("limit", shell.DefaultLimit, "The most rows scan and qid list.")
+	historyFile := fs.String("history", defaultHistoryFile(), "The file to keep the shell's command history in. Empty keeps none.")
+	fixedTime := clockFlag(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	sh := &shell.Shell{Table: client.Table, Clock: newClock(*fixedTime), Out: os.Stdout, Limit: *limit}
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetCompleter(func(l string) []string {
+		return sh.Complete(ctx, l)
+	})
+	if *historyFile != "" {
+		if f, err := os.Open(*historyFile); err == nil {
+			line.ReadHistory(f)
+			f.Close()
+		}
+		defer func() {
+			f, err := os.Create(*historyFile)
+			if err != nil {
+				log.Printf("Could not save history: %v", err)
+				return
+			}
+			defer f.Close()
+			line.WriteHistory(f)
+		}()
+	}
+
+	fmt.Printf("Connected to %s/%s. Type help for the commands.\n", *project, *instance)
+	for {
+		input, err := line.Prompt("btemulator> ")
+		if errors.Is(err, liner.ErrPromptAborted) {
+			continue
+		} else if errors.Is(err, io.EOF) {
+			fmt.Println()
+			return
+		} else if err != nil {
+			log.Printf("Could not read input: %v", err)
+			return
+		}
+		line.AppendHistory(input)
+		if err := sh.Exec(ctx, input); errors.Is(err, shell.ErrQuit) {
+			return
+		} else if err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".btemulator_history")
+}
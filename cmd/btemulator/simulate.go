@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/simulate"
+)
+
+func runSimulate(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	fixedTime := clockFlag(fs)
+	var cfg simulate.Config
+	fs.IntVar(&cfg.Devices, "devices", 100, "The number of simulated devices to seed.")
+	fs.IntVar(&cfg.Appliances, "appliances", 100, "The number of simulated appliances to register.")
+	fs.Float64Var(&cfg.RaceRate, "race", 0.1, "The fraction of appliances that race another for the same device.")
+	fs.Float64Var(&cfg.AbandonRate, "abandon", 0.1, "The fraction of registrations abandoned before completing.")
+	fs.Float64Var(&cfg.ReregisterRate, "reregister", 0.1, "The fraction of registered devices that are deregistered and registered again.")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 8, "The number of appliances registering at once.")
+	fs.Int64Var(&cfg.Seed, "seed", 1, "The random seed that picks targets and decisions.")
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	sim := simulate.Simulator{Table: client.Table, Clock: newClock(*fixedTime), Config: cfg}
+	log.Printf("Seeding %d simulated devices", cfg.Devices)
+	if err := sim.Seed(ctx); err != nil {
+		log.Fatalf("Could not seed devices: %v", err)
+	}
+	log.Printf("Registering %d simulated appliances", cfg.Appliances)
+	res, err := sim.Run(ctx)
+	if err != nil {
+		log.Fatalf("Simulation failed: %v", err)
+	}
+
+	fmt.Println("Appliance outcomes:")
+	for _, o := range []simulate.Outcome{
+		simulate.OutcomeRegistered, simulate.OutcomeReregistered, simulate.OutcomeLostRace,
+		simulate.OutcomeAbandonedClaim, simulate.OutcomeAbandonedChallenge, simulate.OutcomeError,
+	} {
+		fmt.Printf("\t%-26s %d\n", o, res.Outcomes[o])
+	}
+	fmt.Println("Device states:")
+	for _, s := range access.States {
+		fmt.Printf("\t%-26s %d\n", s, res.States[s])
+	}
+	for _, e := range res.Errors {
+		fmt.Printf("ERROR: %s\n", e)
+	}
+	for _, v := range res.Violations {
+		fmt.Printf("VIOLATION: %s\n", v)
+	}
+	if len(res.Violations) > 0 || len(res.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/ui"
+)
+
+func runUI(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("ui", flag.ExitOnError)
+	project, instance := connectionFlags(fs)
+	addr := fs.String("addr", "localhost:8080", "The address to serve the page on.")
+	fixedTime := clockFlag(fs)
+	fs.Parse(args)
+
+	requireFlags(fs, "project", "instance", "addr")
+
+	client := build.NewBTClient(ctx, *project, *instance)
+	defer client.Close()
+
+	r := &access.Registrar{Table: client.Table, Clock: newClock(*fixedTime)}
+	log.Printf("Serving %s/%s on http://%s/", *project, *instance, *addr)
+	if err := http.ListenAndServe(*addr, ui.New(client.Table, r)); err != nil {
+		log.Fatalf("Could not serve: %v", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"reflect"
-	"strings"
 
 	"cloud.google.com/go/bigtable"
 	"github.com/theotheradamsmith/btemulator/internal/schema"
@@ -17,8 +16,14 @@ var (
 	ErrUnexpectedAppK = errors.New("found AppK when none should exist")
 	ErrReadError      = errors.New("could not read row")
 	ErrBadKey         = errors.New("invalid key format")
+	ErrNoPairing      = errors.New("no aid-did pairing in registration pool")
 )
 
+// GetAppK returns the current AppK stored on key and never the one it
+// replaced; reads that should accept the previous AppK during its grace
+// period use GetAppKs or Registrar.AppKs. Both GetAppK and GetAppKs return
+// AppKs as stored, which may be sealed; Registrar.AppK and Registrar.AppKs
+// open them.
 func GetAppK(ctx context.Context, tbl *bigtable.Table, key string) ([]byte, error) {
 	var r bigtable.Row
 	filter := bigtable.ChainFilters(bigtable.FamilyFilter(schema.ColumnFamilyDeviceProperties), bigtable.ColumnFilter(schema.ColumnAppK))
@@ -85,13 +90,17 @@ func AidIsPairedAndUnregistered(ctx context.Context, tbl *bigtable.Table, aid st
 func ReadAidRow(ctx context.Context, tbl *bigtable.Table, aid string) (string, error) {
 	//log.Printf("readAidRow: %s\n", aid)
 	//aidRow, err := tbl.ReadRow(ctx, aid)
+	aid, err := parseAID(aid)
+	if err != nil {
+		return "", err
+	}
 	var r bigtable.Row
-	err := tbl.ReadRows(ctx, bigtable.PrefixRange(aid), func(row bigtable.Row) bool {
+	err = tbl.ReadRows(ctx, bigtable.PrefixRange(aid+"#"), func(row bigtable.Row) bool {
 		r = row
 		return true
 	})
 	if r == nil {
-		return "", errors.New("no aid-did pairing in registration pool")
+		return "", fmt.Errorf("%w: aid %s", ErrNoPairing, aid)
 	} else if err != nil {
 		return "", fmt.Errorf("could not read row with key %s: %v", aid, err)
 	}
@@ -110,26 +119,25 @@ func ReadAllRows(ctx context.Context, tbl *bigtable.Table, columnName, columnFam
 }
 
 func ParseRPKey(key string) (string, error) {
-	sVec := strings.Split(key, "#")
-	if len(sVec) != 3 {
-		return "", ErrBadKey
-	}
-	for _, s := range sVec {
-		if len(s) == 0 {
-			return "", ErrBadKey
-		}
+	rp, err := SplitRPKey(key)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%s#%s", sVec[1], sVec[2]), nil
+	return rp.MainKey.String(), nil
 }
 
 func GetAidRow(ctx context.Context, tbl *bigtable.Table, aid string) (bigtable.Row, error) {
+	aid, err := parseAID(aid)
+	if err != nil {
+		return nil, err
+	}
 	var r bigtable.Row
-	err := tbl.ReadRows(ctx, bigtable.PrefixRange(aid), func(row bigtable.Row) bool {
+	err = tbl.ReadRows(ctx, bigtable.PrefixRange(aid+"#"), func(row bigtable.Row) bool {
 		r = row
 		return true
 	})
 	if r == nil {
-		return nil, errors.New("no aid-did pairing in registration pool")
+		return nil, fmt.Errorf("%w: aid %s", ErrNoPairing, aid)
 	} else if err != nil {
 		return nil, fmt.Errorf("could not read row with key %s: %v", aid, err)
 	}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigtable"
 	"github.com/alecthomas/assert/v2"
 
 	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
 	"github.com/theotheradamsmith/btemulator/internal/build"
 	"github.com/theotheradamsmith/btemulator/internal/schema"
 )
@@ -18,6 +21,12 @@ type testDeviceEntry struct {
 	schema.DeviceEntry
 }
 
+const (
+	aid1       = "km69a-b3boj-1w6ft-9mh83-wao7m"
+	aidMissing = "ns86o-94h6x-x9y51-o5xj6-og3n9"
+	aidTest    = "6x9w4-te6ek-xboeo-iimzy-pesso"
+)
+
 func insertTestCase(t testing.TB, ctx context.Context, tde testDeviceEntry, tbl *bigtable.Table) error {
 	t.Helper()
 	mut := bigtable.NewMutation()
@@ -28,23 +37,41 @@ func insertTestCase(t testing.TB, ctx context.Context, tde testDeviceEntry, tbl
 }
 
 func TestReadAidRow(t *testing.T) {
+	t.Parallel()
 	ctx := context.Background()
-	testClient := build.NewBTClient(ctx, schema.Project, schema.Instance)
+	testClient := btetest.New(t, build.ScenarioDevices)
 	t.Run("retrieve an existing row", func(t *testing.T) {
-		key, err := access.ReadAidRow(ctx, testClient.Table, "aid-1")
+		key, err := access.ReadAidRow(ctx, testClient.Table, aid1)
 		assert.NoError(t, err)
-		assert.Equal(t, "aid-1#qid-1#did-1", key)
+		assert.Equal(t, aid1+"#qid-1#did-1", key)
 	})
 	t.Run("retrieve a row that does not exist", func(t *testing.T) {
-		key, err := access.ReadAidRow(ctx, testClient.Table, "aid-3")
+		key, err := access.ReadAidRow(ctx, testClient.Table, aidMissing)
 		assert.Error(t, err)
 		assert.Equal(t, "", key)
 	})
+	t.Run("accept an AID typed loosely", func(t *testing.T) {
+		key, err := access.ReadAidRow(ctx, testClient.Table, " KM69A B3B0J 1W6FT 9MH83 WA07M ")
+		assert.NoError(t, err)
+		assert.Equal(t, aid1+"#qid-1#did-1", key)
+	})
+	t.Run("reject a malformed AID", func(t *testing.T) {
+		_, _, err := access.AidIsPairedAndUnregistered(ctx, testClient.Table, "aid-1")
+		assert.IsError(t, err, aid.ErrLength)
+	})
+	t.Run("retrieve a row whose AID has no check character", func(t *testing.T) {
+		const legacy = "wyszz-ty4ey-eqgtc-ae44e-47yjg"
+		tde := testDeviceEntry{DeviceEntry: schema.DeviceEntry{AID: legacy, QID: "qid-legacy", DID: "did-legacy"}}
+		assert.NoError(t, insertTestCase(t, ctx, tde, testClient.Table))
+		key, err := access.ReadAidRow(ctx, testClient.Table, "WYSZZ TY4EY EQGTC AE44E 47YJG")
+		assert.NoError(t, err)
+		assert.Equal(t, legacy+"#qid-legacy#did-legacy", key)
+	})
 	t.Run("retrieve an existing row that contains an AppK", func(t *testing.T) {
 		tde := testDeviceEntry{
 			AppK: "appk-test",
 			DeviceEntry: schema.DeviceEntry{
-				AID: "aid-test",
+				AID: aidTest,
 				QID: "qid-test",
 				DID: "did-test",
 			},
@@ -53,10 +80,10 @@ func TestReadAidRow(t *testing.T) {
 		err := insertTestCase(t, ctx, tde, testClient.Table)
 		assert.NoError(t, err)
 		// Verify insertion
-		key, err := access.ReadAidRow(ctx, testClient.Table, "aid-test")
+		key, err := access.ReadAidRow(ctx, testClient.Table, aidTest)
 		assert.NoError(t, err)
-		assert.Equal(t, "aid-test#qid-test#did-test", key)
-		ready, _, err := access.AidIsPairedAndUnregistered(ctx, testClient.Table, "aid-test")
+		assert.Equal(t, aidTest+"#qid-test#did-test", key)
+		ready, _, err := access.AidIsPairedAndUnregistered(ctx, testClient.Table, aidTest)
 		assert.False(t, ready)
 		assert.Error(t, err)
 		assert.IsError(t, err, access.ErrUnexpectedAppK)
@@ -67,18 +94,18 @@ func TestReadAidRow(t *testing.T) {
 
 	})
 	t.Run("GetAppK for entry without AppK", func(t *testing.T) {
-		key, err := access.ReadAidRow(ctx, testClient.Table, "aid-1")
-		assert.Equal(t, "aid-1#qid-1#did-1", key)
+		key, err := access.ReadAidRow(ctx, testClient.Table, aid1)
+		assert.Equal(t, aid1+"#qid-1#did-1", key)
 		assert.NoError(t, err)
 		_, err = access.GetAppK(ctx, testClient.Table, key)
 		fmt.Println(key, err)
 		assert.Error(t, err)
 		assert.IsError(t, err, access.ErrNoAppK)
 	})
-	testClient.Close()
 }
 
 func TestParseRPKey(t *testing.T) {
+	t.Parallel()
 	t.Run("parse valid key", func(t *testing.T) {
 		key := "aid123#qid123#did123"
 		qidDID, err := access.ParseRPKey(key)
@@ -93,14 +120,29 @@ func TestParseRPKey(t *testing.T) {
 	})
 }
 
+func TestParseMainKey(t *testing.T) {
+	t.Parallel()
+	t.Run("parse valid key", func(t *testing.T) {
+		k, err := access.ParseMainKey("qid123#did123")
+		assert.NoError(t, err)
+		assert.Equal(t, access.MainKey{QID: "qid123", DID: "did123"}, k)
+		assert.Equal(t, "qid123#did123", k.String())
+	})
+	t.Run("parse registration pool key", func(t *testing.T) {
+		_, err := access.ParseMainKey("aid123#qid123#did123")
+		assert.IsError(t, err, access.ErrBadKey)
+	})
+}
+
 func TestGetAidRow(t *testing.T) {
+	t.Parallel()
 	ctx := context.Background()
-	testClient := build.NewBTClient(ctx, schema.Project, schema.Instance)
-	row, err := access.GetAidRow(ctx, testClient.Table, "qid-1")
+	testClient := btetest.New(t, build.ScenarioDevices)
+	row, err := access.GetAidRow(ctx, testClient.Table, aid1)
 	assert.NoError(t, err)
-	readItems := row["DeviceProperties"]
-	for _, item := range readItems {
-		assert.Equal(t, "DeviceProperties:CreatedDate", item.Column)
-	}
-	assert.Equal(t, nil, row)
+	btetest.AssertColumns(t, row, btetest.Cells{
+		"DeviceProperties:CreatedDate": btetest.Epoch.Format(time.UnixDate),
+	})
+	btetest.AssertVersions(t, row, schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, 1)
+	btetest.AssertNoColumn(t, row, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
 }
@@ -0,0 +1,70 @@
+package access
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoAttestation  = errors.New("hardware trust needs an attestation")
+	ErrBadAttestation = errors.New("attestation does not verify")
+	ErrNotHardware    = errors.New("device was not claimed as hardware")
+)
+
+// ParseCertificates reads the certificates in PEM data, in order. An
+// attestation chain starts with the device's own certificate.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// verifyAttestation checks chain certifies pub, the key the challenge
+// response was signed with, and leads to one of the AttestationRoots.
+func (r *Registrar) verifyAttestation(chain []*x509.Certificate, pub crypto.PublicKey, now time.Time) error {
+	if len(chain) == 0 {
+		return ErrNoAttestation
+	}
+	if r.AttestationRoots == nil {
+		return fmt.Errorf("%w: no trusted roots", ErrBadAttestation)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         r.AttestationRoots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadAttestation, err)
+	}
+	leaf, ok := chain[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !leaf.Equal(pub) {
+		return fmt.Errorf("%w: device certificate is not for the device key", ErrBadAttestation)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package access_test
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+	"github.com/theotheradamsmith/btemulator/internal/testca"
+)
+
+func TestCompleteAttested(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	ca, err := testca.New("Vendor", env.Clock.Now())
+	assert.NoError(t, err)
+	other, err := testca.New("Other Vendor", env.Clock.Now())
+	assert.NoError(t, err)
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock, AttestationRoots: ca.Pool()}
+
+	key, deviceKey := newDeviceKey(t)
+	appk := newAppK(t)
+	chain, err := ca.Issue(key.Public(), "device")
+	assert.NoError(t, err)
+
+	t.Run("hardware is recorded only once attested", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "is4h5-kq36z-53csb-g4kk6-1wyoj", QID: "qid-attest", DID: "did-hardware"}
+		insertPairing(t, ctx, d, env.Table)
+		_, err := r.Register(ctx, d.AID, appk, deviceKey, access.TrustHardware)
+		assert.NoError(t, err)
+		btetest.AssertNoColumn(t, readRow(t, ctx, env.Table, d.QID+"#"+d.DID), schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted)
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		response := sign(t, key, challenge)
+
+		assert.IsError(t, r.Complete(ctx, d.AID, appk, response), access.ErrNoAttestation)
+		assert.IsError(t, r.CompleteAttested(ctx, d.AID, appk, response, nil), access.ErrNoAttestation)
+		untrusted, err := other.Issue(key.Public(), "device")
+		assert.NoError(t, err)
+		assert.IsError(t, r.CompleteAttested(ctx, d.AID, appk, response, untrusted), access.ErrBadAttestation)
+		otherKey, _ := newDeviceKey(t)
+		unbound, err := ca.Issue(otherKey.Public(), "device")
+		assert.NoError(t, err)
+		assert.IsError(t, r.CompleteAttested(ctx, d.AID, appk, response, unbound), access.ErrBadAttestation)
+		noRoots := &access.Registrar{Table: env.Table, Clock: env.Clock}
+		assert.IsError(t, noRoots.CompleteAttested(ctx, d.AID, appk, response, chain), access.ErrBadAttestation)
+		state, _, err := access.GetState(ctx, env.Table, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateInFlight, state)
+
+		assert.NoError(t, r.CompleteAttested(ctx, d.AID, appk, response, chain))
+		for _, key := range []string{d.QID + "#" + d.DID, d.AID + "#" + d.QID + "#" + d.DID} {
+			btetest.AssertColumns(t, readRow(t, ctx, env.Table, key), btetest.Cells{"DeviceProperties:Trusted": "hardware"})
+		}
+		state, _, err = access.GetState(ctx, env.Table, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateRegistered, state)
+	})
+
+	t.Run("software claims cannot be attested", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "idwj9-knhkh-45qos-t8ck5-41uhk", QID: "qid-attest", DID: "did-software"}
+		insertPairing(t, ctx, d, env.Table)
+		_, err := r.Register(ctx, d.AID, appk, deviceKey, access.TrustSoftware)
+		assert.NoError(t, err)
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		response := sign(t, key, challenge)
+		assert.IsError(t, r.CompleteAttested(ctx, d.AID, appk, response, chain), access.ErrNotHardware)
+
+		assert.NoError(t, r.Complete(ctx, d.AID, appk, response))
+		for _, key := range []string{d.QID + "#" + d.DID, d.AID + "#" + d.QID + "#" + d.DID} {
+			btetest.AssertColumns(t, readRow(t, ctx, env.Table, key), btetest.Cells{"DeviceProperties:Trusted": "software"})
+		}
+	})
+
+	t.Run("pool trust is withdrawn if the main row is not registered", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "hkpuy-wk9jt-b11yo-fsgin-j7qn5", QID: "qid-attest", DID: "did-withdrawn"}
+		poolKey, mainKey := d.AID+"#"+d.QID+"#"+d.DID, d.QID+"#"+d.DID
+		insertPairing(t, ctx, d, env.Table)
+		r := &access.Registrar{Table: env.Table, Clock: env.Clock, AttestationRoots: ca.Pool()}
+		_, err := r.Register(ctx, d.AID, appk, deviceKey, access.TrustHardware)
+		assert.NoError(t, err)
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+
+		// Another attempt answers the challenge between the two writes.
+		access.SetAfterStep(r, func(step string) error {
+			if step != access.StepPoolAttested {
+				return nil
+			}
+			del := bigtable.NewMutation()
+			del.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallengeExpiry)
+			return env.Table.Apply(ctx, mainKey, del)
+		})
+		assert.IsError(t, r.CompleteAttested(ctx, d.AID, appk, sign(t, key, challenge), chain), access.ErrChallengeReplayed)
+		btetest.AssertNoColumn(t, readRow(t, ctx, env.Table, poolKey), schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted)
+		btetest.AssertNoColumn(t, readRow(t, ctx, env.Table, mainKey), schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted)
+	})
+}
+
+func TestParseCertificates(t *testing.T) {
+	t.Parallel()
+	ca, err := testca.New("Vendor", btetest.Epoch)
+	assert.NoError(t, err)
+	key, _ := newDeviceKey(t)
+	chain, err := ca.Issue(key.Public(), "device")
+	assert.NoError(t, err)
+
+	got, err := access.ParseCertificates(testca.EncodePEM(chain...))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(got))
+	assert.True(t, got[0].Equal(chain[0]))
+	assert.True(t, got[1].Equal(ca.Intermediate))
+	_, err = access.ParseCertificates([]byte("not a certificate"))
+	assert.Error(t, err)
+}
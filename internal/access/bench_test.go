@@ -0,0 +1,52 @@
+package access_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/theotheradamsmith/btemulator/internal/bench"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+)
+
+// benchPool seeds a 10k row registration pool, half of it claimed.
+func benchPool(b *testing.B) (*btetest.Env, *bench.Pool) {
+	b.Helper()
+	env := btetest.New(b)
+	pool, err := bench.Seed(context.Background(), env.Table, env.Clock, bench.Config{
+		PoolSize:    10000,
+		Keys:        bench.KeysRandom,
+		ClaimedRate: 0.5,
+		Seed:        1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	return env, pool
+}
+
+func benchmarkOp(b *testing.B, op bench.Op) {
+	ctx := context.Background()
+	env, pool := benchPool(b)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if err := pool.Do(ctx, env.Table, op, i%len(pool.AIDs)); err != nil {
+				b.Error(err)
+			}
+			i += 7919
+		}
+	})
+}
+
+func BenchmarkReadAidRow(b *testing.B) {
+	benchmarkOp(b, bench.OpReadAidRow)
+}
+
+func BenchmarkGetAppK(b *testing.B) {
+	benchmarkOp(b, bench.OpGetAppK)
+}
+
+func BenchmarkAidIsPairedAndUnregistered(b *testing.B) {
+	benchmarkOp(b, bench.OpPairedUnregistered)
+}
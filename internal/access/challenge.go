@@ -0,0 +1,346 @@
+package access
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var (
+	ErrWrongAppK         = errors.New("AppK does not match")
+	ErrBadAppK           = errors.New("bad AppK")
+	ErrNoDeviceKey       = errors.New("no device key")
+	ErrNoChallenge       = errors.New("no challenge issued")
+	ErrBadResponse       = errors.New("challenge response does not match")
+	ErrAlreadyRegistered = errors.New("device already registered")
+	ErrChallengeExpired  = errors.New("challenge expired")
+	ErrChallengeReplayed = errors.New("challenge already answered")
+)
+
+// DefaultChallengeTTL is how long a challenge can be answered for when the
+// Registrar does not say.
+const DefaultChallengeTTL = 5 * time.Minute
+
+// Challenge stores challenge on the main row of a device the appliance
+// holding appk has claimed, along with when it expires. Most callers want
+// IssueChallenge.
+func (r *Registrar) Challenge(ctx context.Context, aid, appk, challenge string) error {
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return err
+	}
+	return r.unlessRegistered(ctx, rp.MainKey.String(), r.challengeMutation(challenge))
+}
+
+// IssueChallenge stores a fresh random challenge for a claimed device and
+// returns it.
+func (r *Registrar) IssueChallenge(ctx context.Context, aid, appk string) (string, error) {
+	challenge, err := newChallenge()
+	if err != nil {
+		return "", err
+	}
+	if err := r.Challenge(ctx, aid, appk, challenge); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// Claim registers appk and deviceKey against aid and issues the device a
+// challenge. If the challenge cannot be issued the claim is aborted, so the
+// appliance can try again rather than finding the device already claimed.
+func (r *Registrar) Claim(ctx context.Context, aid, appk, deviceKey, trusted string) (*Intent, string, error) {
+	in, err := r.Register(ctx, aid, appk, deviceKey, trusted)
+	if err != nil {
+		return nil, "", err
+	}
+	var challenge string
+	err = r.step(StepClaimed)
+	if err == nil {
+		challenge, err = r.IssueChallenge(ctx, in.AID, appk)
+	}
+	if err != nil {
+		if aerr := r.Abort(ctx, in.AID, appk); aerr != nil {
+			return nil, "", errors.Join(err, aerr)
+		}
+		return nil, "", err
+	}
+	return in, challenge, nil
+}
+
+// Complete marks the device registered once the appliance holding appk has
+// answered the challenge it was sent with the challenge signed by the device
+// key it was claimed with.
+// A challenge can be answered once, and only before it expires. Devices
+// claimed as hardware need CompleteAttested instead.
+func (r *Registrar) Complete(ctx context.Context, aid, appk, response string) error {
+	return r.complete(ctx, aid, appk, response, nil)
+}
+
+// CompleteAttested completes a registration as Complete does and records the
+// device as hardware trusted, provided it was claimed as hardware and chain,
+// leaf first, certifies the key that signed the response and leads to one of
+// the AttestationRoots.
+func (r *Registrar) CompleteAttested(ctx context.Context, aid, appk, response string, chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return ErrNoAttestation
+	}
+	return r.complete(ctx, aid, appk, response, chain)
+}
+
+func (r *Registrar) complete(ctx context.Context, aid, appk, response string, chain []*x509.Certificate) error {
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return err
+	}
+	mainKey := rp.MainKey.String()
+	filter := bigtable.ChainFilters(
+		bigtable.ColumnFilter(fmt.Sprintf("%s|%s|%s|%s|%s", schema.ColumnChallenge, schema.ColumnChallengeExpiry, schema.ColumnRegistered, schema.ColumnTrusted, schema.ColumnDeviceKey)),
+		bigtable.LatestNFilter(1),
+	)
+	row, err := r.Table.ReadRow(ctx, mainKey, bigtable.RowFilter(filter))
+	if err != nil {
+		return fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	cells := make(map[string]bigtable.ReadItem)
+	for _, items := range row {
+		for _, item := range items {
+			_, name := schema.SplitColumn(item.Column)
+			cells[name] = item
+		}
+	}
+	if _, ok := cells[schema.ColumnRegistered]; ok {
+		return fmt.Errorf("%w: key %s", ErrAlreadyRegistered, mainKey)
+	}
+	challenge, ok := cells[schema.ColumnChallenge]
+	if !ok {
+		return fmt.Errorf("%w: key %s", ErrNoChallenge, mainKey)
+	}
+	// The expiry goes when the challenge is answered, and challenges from
+	// before expiries were recorded never had one.
+	expiry, ok := cells[schema.ColumnChallengeExpiry]
+	if !ok {
+		return fmt.Errorf("%w: key %s", ErrChallengeReplayed, mainKey)
+	}
+	ms, err := strconv.ParseInt(string(expiry.Value), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: key %s: bad expiry %q", ErrChallengeExpired, mainKey, expiry.Value)
+	}
+	now := clock.Or(r.Clock).Now()
+	if !now.Before(time.UnixMilli(ms)) {
+		return fmt.Errorf("%w: key %s", ErrChallengeExpired, mainKey)
+	}
+	deviceKey, ok := cells[schema.ColumnDeviceKey]
+	if !ok {
+		return fmt.Errorf("%w: key %s", ErrNoDeviceKey, mainKey)
+	}
+	pub, err := ParsePublicKey(string(deviceKey.Value))
+	if err != nil {
+		return fmt.Errorf("key %s: %w", mainKey, err)
+	}
+	if !verifyResponse(pub, string(challenge.Value), response) {
+		return fmt.Errorf("%w: key %s", ErrBadResponse, mainKey)
+	}
+	// A hardware claim leaves Trusted unset until it is attested.
+	if chain != nil {
+		if trusted, ok := cells[schema.ColumnTrusted]; ok {
+			return fmt.Errorf("%w: key %s is claimed as %s", ErrNotHardware, mainKey, trusted.Value)
+		}
+		if err := r.verifyAttestation(chain, pub, now); err != nil {
+			return fmt.Errorf("key %s: %w", mainKey, err)
+		}
+	} else if trusted, ok := cells[schema.ColumnTrusted]; !ok || string(trusted.Value) == TrustHardware {
+		return fmt.Errorf("%w: key %s", ErrNoAttestation, mainKey)
+	}
+
+	// Hardware trust goes on the pool row first and comes off again if the
+	// main row is not registered, so the rows agree once complete returns. A
+	// crash in between leaves only the pool row trusted, which the next
+	// attempt or a release puts right.
+	ts := bigtable.Time(now)
+	if chain != nil {
+		pool := bigtable.NewMutation()
+		pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted, ts, []byte(TrustHardware))
+		if err := r.Table.Apply(ctx, rp.String(), pool); err != nil {
+			return fmt.Errorf("could not update %s: %v", rp, err)
+		}
+		if err := r.step(StepPoolAttested); err != nil {
+			return r.unattest(ctx, rp, ts, err)
+		}
+	}
+
+	// Registering removes the expiry, and only happens if it is the one just
+	// read, so the same challenge cannot be answered twice.
+	pending := bigtable.ChainFilters(
+		bigtable.FamilyFilter(schema.ColumnFamilyRegistrationProperties),
+		bigtable.ColumnFilter(schema.ColumnChallengeExpiry),
+		bigtable.TimestampRangeFilterMicros(expiry.Timestamp, expiry.Timestamp+bigtable.Timestamp(time.Millisecond/time.Microsecond)),
+	)
+	set := bigtable.NewMutation()
+	set.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnRegistered, ts,
+		[]byte(strconv.FormatInt(now.UTC().UnixMilli(), 10)))
+	set.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallengeExpiry)
+	if chain != nil {
+		set.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted, ts, []byte(TrustHardware))
+	}
+	var matched bool
+	cond := bigtable.NewCondMutation(pending, set, nil)
+	err = r.Table.Apply(ctx, mainKey, cond, bigtable.GetCondMutationResult(&matched))
+	switch {
+	case err != nil:
+		err = fmt.Errorf("could not update %s: %v", mainKey, err)
+	case !matched:
+		err = fmt.Errorf("%w: key %s", ErrChallengeReplayed, mainKey)
+	default:
+		return nil
+	}
+	if chain != nil {
+		return r.unattest(ctx, rp, ts, err)
+	}
+	return err
+}
+
+// unattest removes the hardware trust complete wrote to the pool row at ts
+// and returns cause, joined with any error hit doing so.
+func (r *Registrar) unattest(ctx context.Context, rp RPKey, ts bigtable.Timestamp, cause error) error {
+	undo := bigtable.NewMutation()
+	undo.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted, ts, ts+bigtable.Timestamp(time.Millisecond/time.Microsecond))
+	if err := r.Table.Apply(ctx, rp.String(), undo); err != nil {
+		return errors.Join(cause, fmt.Errorf("could not update %s: %v", rp, err))
+	}
+	return cause
+}
+
+func (r *Registrar) challengeMutation(challenge string) *bigtable.Mutation {
+	ttl := r.ChallengeTTL
+	if ttl <= 0 {
+		ttl = DefaultChallengeTTL
+	}
+	now := clock.Or(r.Clock).Now()
+	set := bigtable.NewMutation()
+	set.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallenge, bigtable.Time(now), []byte(challenge))
+	set.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallengeExpiry, bigtable.Time(now),
+		[]byte(strconv.FormatInt(now.Add(ttl).UTC().UnixMilli(), 10)))
+	return set
+}
+
+func newChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Deregister releases a claimed or registered device so it can be registered
+// again. The pairing itself, and the AID on the main row, are kept.
+func (r *Registrar) Deregister(ctx context.Context, aid, appk string) error {
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return err
+	}
+	if err := r.Table.Apply(ctx, rp.MainKey.String(), releaseMutation()); err != nil {
+		return fmt.Errorf("could not deregister %s: %v", rp.MainKey, err)
+	}
+	return r.releasePool(ctx, rp)
+}
+
+// Abort gives up a registration the appliance holding appk has started but
+// not completed, leaving the device ready for another claim.
+func (r *Registrar) Abort(ctx context.Context, aid, appk string) error {
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return err
+	}
+	if err := r.unlessRegistered(ctx, rp.MainKey.String(), releaseMutation()); err != nil {
+		return err
+	}
+	return r.releasePool(ctx, rp)
+}
+
+func releaseMutation() *bigtable.Mutation {
+	main := bigtable.NewMutation()
+	main.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+	main.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnDeviceKey)
+	main.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted)
+	main.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken)
+	main.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallenge)
+	main.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallengeExpiry)
+	main.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnRegistered)
+	return main
+}
+
+// releasePool clears the claim from the pool row. It goes last: while the
+// pool row still holds the AppK nobody else can claim the device.
+func (r *Registrar) releasePool(ctx context.Context, rp RPKey) error {
+	pool := bigtable.NewMutation()
+	pool.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+	pool.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted)
+	if err := r.Table.Apply(ctx, rp.String(), pool); err != nil {
+		return fmt.Errorf("could not release %s: %v", rp, err)
+	}
+	return nil
+}
+
+// claimed finds the pool row for aid and checks appk is its current AppK.
+// An AppK it was rotated away from is not accepted, however recently.
+func (r *Registrar) claimed(ctx context.Context, aid, appk string) (RPKey, error) {
+	poolKey, err := ReadAidRow(ctx, r.Table, aid)
+	if err != nil {
+		return RPKey{}, err
+	}
+	rp, err := SplitRPKey(poolKey)
+	if err != nil {
+		return RPKey{}, err
+	}
+	accepted, err := r.appKs(ctx, poolKey, 0)
+	if err != nil {
+		return RPKey{}, err
+	}
+	for _, stored := range accepted {
+		if bytes.Equal(stored, []byte(appk)) {
+			return rp, nil
+		}
+	}
+	return RPKey{}, fmt.Errorf("%w: key %s", ErrWrongAppK, poolKey)
+}
+
+// appKs are the AppKs stored on a pool row, opened: the current one and,
+// within grace of a rotation, the one before it.
+func (r *Registrar) appKs(ctx context.Context, poolKey string, grace time.Duration) ([][]byte, error) {
+	appks, err := GetAppKs(ctx, r.Table, poolKey, grace, clock.Or(r.Clock).Now())
+	if err != nil {
+		return nil, err
+	}
+	for i, appk := range appks {
+		if appks[i], err = r.Sealer.Open(ctx, appk); err != nil {
+			return nil, fmt.Errorf("could not open AppK on %s: %w", poolKey, err)
+		}
+	}
+	return appks, nil
+}
+
+func (r *Registrar) unlessRegistered(ctx context.Context, mainKey string, mut *bigtable.Mutation) error {
+	registered := bigtable.ChainFilters(
+		bigtable.FamilyFilter(schema.ColumnFamilyRegistrationProperties),
+		bigtable.ColumnFilter(schema.ColumnRegistered),
+	)
+	var matched bool
+	cond := bigtable.NewCondMutation(registered, nil, mut)
+	if err := r.Table.Apply(ctx, mainKey, cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return fmt.Errorf("could not update %s: %v", mainKey, err)
+	}
+	if matched {
+		return fmt.Errorf("%w: key %s", ErrAlreadyRegistered, mainKey)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var ErrNoDevice = errors.New("no such device")
+
+// Device is a main row summarised for listing. Key is the row key, which
+// differs from the MainKey in the hashed layout.
+type Device struct {
+	MainKey
+	Key   string
+	AID   string
+	State State
+}
+
+// QIDCount is a QID and how many main rows it has.
+type QIDCount struct {
+	QID     string
+	Devices int
+}
+
+// ListQIDs scans the main rows and counts the devices of each QID.
+func ListQIDs(ctx context.Context, tbl *bigtable.Table) ([]QIDCount, error) {
+	counts := make(map[string]int)
+	err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		if mk, err := parseRowKey(row.Key()); err == nil {
+			counts[mk.QID]++
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(bigtable.LatestNFilter(1), bigtable.StripValueFilter())))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrReadError, err)
+	}
+	qids := make([]QIDCount, 0, len(counts))
+	for qid, n := range counts {
+		qids = append(qids, QIDCount{QID: qid, Devices: n})
+	}
+	sort.Slice(qids, func(i, j int) bool { return qids[i].QID < qids[j].QID })
+	return qids, nil
+}
+
+// ListDevices lists the main rows of qid, or of every QID if qid is empty,
+// keeping only those in state unless state is empty. Rows in either key
+// layout are listed, ordered by main key.
+func ListDevices(ctx context.Context, tbl *bigtable.Table, qid string, state State) ([]Device, error) {
+	type scan struct {
+		rows   bigtable.RowSet
+		filter bigtable.Filter
+	}
+	latest := bigtable.LatestNFilter(1)
+	scans := []scan{{bigtable.InfiniteRange(""), latest}}
+	if qid != "" {
+		// Hashed keys do not share a prefix, so they are found by key.
+		hashed := bigtable.RowKeyFilter(`[0-9a-f]{4}\.` + regexp.QuoteMeta(qid) + `#[^#]+`)
+		scans = []scan{
+			{bigtable.PrefixRange(qid + "#"), latest},
+			{bigtable.InfiniteRange(""), bigtable.ChainFilters(hashed, latest)},
+		}
+	}
+	var devices []Device
+	for _, sc := range scans {
+		err := tbl.ReadRows(ctx, sc.rows, func(row bigtable.Row) bool {
+			if d, ok := listed(row, qid, state); ok {
+				devices = append(devices, d)
+			}
+			return true
+		}, bigtable.RowFilter(sc.filter))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrReadError, err)
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool { return devices[i].MainKey.String() < devices[j].MainKey.String() })
+	return devices, nil
+}
+
+// listed summarises row if it is a main row of qid, or of any QID if qid is
+// empty, in state.
+func listed(row bigtable.Row, qid string, state State) (Device, bool) {
+	mk, err := parseRowKey(row.Key())
+	if err != nil || qid != "" && mk.QID != qid {
+		return Device{}, false
+	}
+	d := Device{MainKey: mk, Key: row.Key(), State: StateOf(row)}
+	if state != "" && d.State != state {
+		return Device{}, false
+	}
+	for _, item := range row[schema.ColumnFamilyDeviceProperties] {
+		if item.Column == schema.ColumnFamilyDeviceProperties+":"+schema.ColumnAID {
+			d.AID = string(item.Value)
+		}
+	}
+	return d, true
+}
+
+// ReadDevice reads every version of every cell on a device's main row.
+func ReadDevice(ctx context.Context, tbl *bigtable.Table, mainKey string) (bigtable.Row, error) {
+	if _, err := ParseMainKey(mainKey); err != nil {
+		return nil, err
+	}
+	row, err := tbl.ReadRow(ctx, mainKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	if len(row) == 0 {
+		return nil, fmt.Errorf("%w: key %s", ErrNoDevice, mainKey)
+	}
+	return row, nil
+}
+
+// Reset returns a device to ready whatever state it is in, without needing
+// the AppK it was claimed with. It is for operators; appliances use
+// Deregister.
+func (r *Registrar) Reset(ctx context.Context, mainKey string) error {
+	mk, err := ParseMainKey(mainKey)
+	if err != nil {
+		return err
+	}
+	row, err := ReadDevice(ctx, r.Table, mainKey)
+	if err != nil {
+		return err
+	}
+	if err := r.Table.Apply(ctx, mainKey, releaseMutation()); err != nil {
+		return fmt.Errorf("could not reset %s: %v", mainKey, err)
+	}
+
+	var aid string
+	for _, item := range row[schema.ColumnFamilyDeviceProperties] {
+		if item.Column == schema.ColumnFamilyDeviceProperties+":"+schema.ColumnAID {
+			aid = string(item.Value)
+			break
+		}
+	}
+	if aid == "" {
+		return nil
+	}
+	poolKey := RPKey{AID: aid, MainKey: mk}.String()
+	pool := bigtable.NewMutation()
+	pool.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+	pool.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted)
+	pool.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent)
+	if err := r.Table.Apply(ctx, poolKey, pool); err != nil {
+		return fmt.Errorf("could not reset %s: %v", poolKey, err)
+	}
+	return nil
+}
+
+// MarkInFlight puts a device back to having been sent challenge and not yet
+// answered it, clearing any registration. The challenge expires as one from
+// IssueChallenge would.
+func (r *Registrar) MarkInFlight(ctx context.Context, mainKey, challenge string) error {
+	if _, err := ReadDevice(ctx, r.Table, mainKey); err != nil {
+		return err
+	}
+	mut := r.challengeMutation(challenge)
+	mut.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnRegistered)
+	if err := r.Table.Apply(ctx, mainKey, mut); err != nil {
+		return fmt.Errorf("could not mark %s in flight: %v", mainKey, err)
+	}
+	return nil
+}
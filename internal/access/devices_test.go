@@ -0,0 +1,70 @@
+package access_test
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func TestDevices(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.Scenarios...)
+
+	qids, err := access.ListQIDs(ctx, env.Table)
+	assert.NoError(t, err)
+	assert.Equal(t, access.QIDCount{QID: "foo-usd-123", Devices: 3}, qids[0])
+
+	devices, err := access.ListDevices(ctx, env.Table, "", access.StateInFlight)
+	assert.NoError(t, err)
+	assert.Equal(t, []access.Device{{
+		MainKey: access.MainKey{QID: "qid-in-flight", DID: "did-in-flight"},
+		Key:     "qid-in-flight#did-in-flight",
+		AID:     "hky85-8y73a-uk6yg-ko8kx-hrqn3",
+		State:   access.StateInFlight,
+	}}, devices)
+
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock}
+	assert.NoError(t, r.Reset(ctx, "qid-already-registered#did-already-registered"))
+	row, err := access.ReadDevice(ctx, env.Table, "qid-already-registered#did-already-registered")
+	assert.NoError(t, err)
+	assert.Equal(t, access.StateReady, access.StateOf(row))
+	btetest.AssertNoColumn(t, row, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+
+	assert.NoError(t, r.MarkInFlight(ctx, "qid-already-registered#did-already-registered", "again"))
+	devices, err = access.ListDevices(ctx, env.Table, "qid-already-registered", "")
+	assert.NoError(t, err)
+	assert.Equal(t, access.StateInFlight, devices[0].State)
+
+	// Rows in the hashed layout are listed under their QID too.
+	hashed := access.MainKey{QID: "qid-hashed", DID: "did-hashed"}
+	mut := bigtable.NewMutation()
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, bigtable.Time(env.Clock.Now()), []byte(hashed.DID))
+	assert.NoError(t, env.Table.Apply(ctx, hashed.Hashed(), mut))
+	devices, err = access.ListDevices(ctx, env.Table, "qid-hashed", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []access.Device{{MainKey: hashed, Key: hashed.Hashed(), State: access.StateReady}}, devices)
+	qids, err = access.ListQIDs(ctx, env.Table)
+	assert.NoError(t, err)
+	assert.True(t, containsQID(qids, access.QIDCount{QID: "qid-hashed", Devices: 1}))
+
+	_, err = access.ReadDevice(ctx, env.Table, "qid-nope#did-nope")
+	assert.IsError(t, err, access.ErrNoDevice)
+	assert.IsError(t, r.Reset(ctx, "not-a-main-key"), access.ErrBadKey)
+}
+
+func containsQID(qids []access.QIDCount, want access.QIDCount) bool {
+	for _, q := range qids {
+		if q == want {
+			return true
+		}
+	}
+	return false
+}
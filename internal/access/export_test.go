@@ -0,0 +1,5 @@
+package access
+
+func SetAfterStep(r *Registrar, f func(step string) error) {
+	r.afterStep = f
+}
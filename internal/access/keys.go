@@ -0,0 +1,95 @@
+package access
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+)
+
+// MainKey identifies a device's main row, stored as qid#did.
+type MainKey struct {
+	QID string
+	DID string
+}
+
+func (k MainKey) String() string {
+	return fmt.Sprintf("%s#%s", k.QID, k.DID)
+}
+
+// RPKey identifies a registration pool row, stored as aid#qid#did.
+type RPKey struct {
+	AID string
+	MainKey
+}
+
+func (k RPKey) String() string {
+	return fmt.Sprintf("%s#%s", k.AID, k.MainKey)
+}
+
+// Hashed is the key the hashed layout stores the main row under:
+// pppp.qid#did, where pppp is a hex hash of qid#did that spreads sequential
+// QIDs across tablets.
+func (k MainKey) Hashed() string {
+	return fmt.Sprintf("%s.%s", hashPrefix(k.String()), k)
+}
+
+func hashPrefix(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%04x", h.Sum32()&0xffff)
+}
+
+// ParseHashedMainKey parses a main row key in the hashed layout.
+func ParseHashedMainKey(key string) (MainKey, error) {
+	prefix, rest, ok := strings.Cut(key, ".")
+	if !ok || prefix != hashPrefix(rest) {
+		return MainKey{}, fmt.Errorf("%w: %q", ErrBadKey, key)
+	}
+	return ParseMainKey(rest)
+}
+
+// parseRowKey parses the key of a main row stored in either layout.
+func parseRowKey(key string) (MainKey, error) {
+	if mk, err := ParseHashedMainKey(key); err == nil {
+		return mk, nil
+	}
+	return ParseMainKey(key)
+}
+
+func ParseMainKey(key string) (MainKey, error) {
+	sVec, err := splitKey(key, 2)
+	if err != nil {
+		return MainKey{}, err
+	}
+	return MainKey{QID: sVec[0], DID: sVec[1]}, nil
+}
+
+func SplitRPKey(key string) (RPKey, error) {
+	sVec, err := splitKey(key, 3)
+	if err != nil {
+		return RPKey{}, err
+	}
+	return RPKey{AID: sVec[0], MainKey: MainKey{QID: sVec[1], DID: sVec[2]}}, nil
+}
+
+func splitKey(key string, parts int) ([]string, error) {
+	sVec := strings.Split(key, "#")
+	if len(sVec) != parts {
+		return nil, fmt.Errorf("%w: %q", ErrBadKey, key)
+	}
+	for _, s := range sVec {
+		if len(s) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrBadKey, key)
+		}
+	}
+	return sVec, nil
+}
+
+// parseAID canonicalises an AID given by a caller, so a malformed one is
+// rejected before any read. The check character is not verified, as AIDs
+// issued before it existed are still in use.
+func parseAID(s string) (string, error) {
+	return aid.Parse(s)
+}
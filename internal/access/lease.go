@@ -0,0 +1,121 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var (
+	ErrLeaseHeld = errors.New("lease held by another owner")
+	ErrLeaseLost = errors.New("lease not held")
+)
+
+// Lease gives one owner exclusive use of a row for a limited time. The lease
+// is a single RegistrationProperties:Lease cell holding the expiry in unix
+// milliseconds, zero padded so values sort by expiry, followed by the owner:
+//
+//	00000001697040000000|owner
+//
+// Every change is a conditional mutation on that cell, so two owners can never
+// both believe they hold the lease.
+type Lease struct {
+	Table *bigtable.Table
+	Key   string
+	Owner string
+	TTL   time.Duration
+	Clock clock.Clock
+
+	expiry time.Time
+}
+
+// Acquire takes the lease if nobody holds it or the last holder let it
+// expire. An owner that already holds the lease should Renew it instead.
+func (l *Lease) Acquire(ctx context.Context) error {
+	now := clock.Or(l.Clock).Now()
+	held := l.filter(bigtable.ValueRangeFilter(leaseBound(now), nil))
+	matched, err := l.apply(ctx, bigtable.NewCondMutation(held, nil, l.set(now)))
+	if err != nil {
+		return err
+	}
+	if matched {
+		return fmt.Errorf("%w: key %s", ErrLeaseHeld, l.Key)
+	}
+	l.expiry = now.Add(l.TTL)
+	return nil
+}
+
+// Renew extends a lease this owner still holds by another TTL.
+func (l *Lease) Renew(ctx context.Context) error {
+	now := clock.Or(l.Clock).Now()
+	mine := l.filter(bigtable.ValueRangeFilter(leaseBound(now), nil), l.ownerFilter())
+	matched, err := l.apply(ctx, bigtable.NewCondMutation(mine, l.set(now), nil))
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return fmt.Errorf("%w: key %s owner %s", ErrLeaseLost, l.Key, l.Owner)
+	}
+	l.expiry = now.Add(l.TTL)
+	return nil
+}
+
+// Release gives up the lease. It fails with ErrLeaseLost if the lease has
+// since been taken over by another owner.
+func (l *Lease) Release(ctx context.Context) error {
+	del := bigtable.NewMutation()
+	del.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnLease)
+	matched, err := l.apply(ctx, bigtable.NewCondMutation(l.filter(l.ownerFilter()), del, nil))
+	if err != nil {
+		return err
+	}
+	l.expiry = time.Time{}
+	if !matched {
+		return fmt.Errorf("%w: key %s owner %s", ErrLeaseLost, l.Key, l.Owner)
+	}
+	return nil
+}
+
+// Expiry is when the lease runs out, as of the last successful Acquire or
+// Renew by this owner.
+func (l *Lease) Expiry() time.Time {
+	return l.expiry
+}
+
+func (l *Lease) filter(filters ...bigtable.Filter) bigtable.Filter {
+	return bigtable.ChainFilters(append([]bigtable.Filter{
+		bigtable.FamilyFilter(schema.ColumnFamilyRegistrationProperties),
+		bigtable.ColumnFilter(schema.ColumnLease),
+		bigtable.LatestNFilter(1),
+	}, filters...)...)
+}
+
+func (l *Lease) ownerFilter() bigtable.Filter {
+	return bigtable.ValueFilter(`[0-9]{20}\|` + regexp.QuoteMeta(l.Owner))
+}
+
+func (l *Lease) set(now time.Time) *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnLease)
+	value := fmt.Sprintf("%s|%s", leaseBound(now.Add(l.TTL)), l.Owner)
+	mut.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnLease, bigtable.Time(now), []byte(value))
+	return mut
+}
+
+func (l *Lease) apply(ctx context.Context, mut *bigtable.Mutation) (bool, error) {
+	var matched bool
+	if err := l.Table.Apply(ctx, l.Key, mut, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return false, fmt.Errorf("could not update lease on %s: %v", l.Key, err)
+	}
+	return matched, nil
+}
+
+func leaseBound(t time.Time) []byte {
+	return []byte(fmt.Sprintf("%020d", t.UnixMilli()))
+}
@@ -0,0 +1,85 @@
+package access_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+)
+
+func TestLease(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	tbl, clk := env.Table, env.Clock
+
+	newLease := func(key, owner string) *access.Lease {
+		return &access.Lease{Table: tbl, Key: key, Owner: owner, TTL: 30 * time.Second, Clock: clk}
+	}
+
+	t.Run("only one of many contenders acquires", func(t *testing.T) {
+		key := "qid-lease#did-contention"
+		var (
+			wg  sync.WaitGroup
+			mu  sync.Mutex
+			won []string
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(owner string) {
+				defer wg.Done()
+				err := newLease(key, owner).Acquire(ctx)
+				if err == nil {
+					mu.Lock()
+					won = append(won, owner)
+					mu.Unlock()
+					return
+				}
+				assert.IsError(t, err, access.ErrLeaseHeld)
+			}(fmt.Sprintf("owner-%d", i))
+		}
+		wg.Wait()
+		assert.Equal(t, 1, len(won))
+	})
+
+	t.Run("renew and release", func(t *testing.T) {
+		key := "qid-lease#did-renew"
+		a := newLease(key, "owner-a")
+		assert.NoError(t, a.Acquire(ctx))
+		assert.Equal(t, clk.Now().Add(30*time.Second), a.Expiry())
+
+		b := newLease(key, "owner-b")
+		assert.IsError(t, b.Renew(ctx), access.ErrLeaseLost)
+		assert.IsError(t, b.Release(ctx), access.ErrLeaseLost)
+
+		clk.Advance(20 * time.Second)
+		assert.NoError(t, a.Renew(ctx))
+		clk.Advance(20 * time.Second)
+		assert.IsError(t, b.Acquire(ctx), access.ErrLeaseHeld)
+
+		assert.NoError(t, a.Release(ctx))
+		assert.NoError(t, b.Acquire(ctx))
+	})
+
+	t.Run("expired leases can be taken over", func(t *testing.T) {
+		key := "qid-lease#did-expiry"
+		a := newLease(key, "owner-a")
+		b := newLease(key, "owner-b")
+		assert.NoError(t, a.Acquire(ctx))
+
+		clk.Advance(29 * time.Second)
+		assert.IsError(t, b.Acquire(ctx), access.ErrLeaseHeld)
+
+		clk.Advance(2 * time.Second)
+		assert.NoError(t, b.Acquire(ctx))
+		assert.IsError(t, a.Renew(ctx), access.ErrLeaseLost)
+		assert.IsError(t, a.Release(ctx), access.ErrLeaseLost)
+		assert.NoError(t, b.Renew(ctx))
+	})
+}
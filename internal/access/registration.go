@@ -0,0 +1,320 @@
+package access
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+	"github.com/theotheradamsmith/btemulator/internal/util"
+)
+
+var (
+	ErrAlreadyClaimed = errors.New("registration pool row already claimed")
+	ErrBadIntent      = errors.New("could not decode registration intent")
+	ErrBadTrust       = errors.New("unknown trust level")
+)
+
+// Trust levels are how an appliance can vouch for a device it claims. A
+// hardware claim is only recorded once Complete verifies its attestation.
+const (
+	TrustHardware = "hardware"
+	TrustSoftware = "software"
+)
+
+var TrustLevels = []string{TrustHardware, TrustSoftware}
+
+// Registration steps, in order. An intent records the last step that was
+// fully applied.
+const (
+	StepRecorded    = "recorded"
+	StepPoolWritten = "pool-written"
+)
+
+// StepClaimed is when Claim has registered a device and not yet challenged
+// it, StepPoolAttested when CompleteAttested has recorded hardware trust on
+// the pool row and not yet on the main row, and StepPoolRotated when
+// RotateAppK has rotated the pool row and not yet the main row. Intents never
+// record them.
+const (
+	StepClaimed      = "claimed"
+	StepPoolAttested = "pool-attested"
+	StepPoolRotated  = "pool-rotated"
+)
+
+// Intent is written to the pool row before a registration touches anything
+// else, so a crash part way through can be finished or undone.
+type Intent struct {
+	ID      string `json:"id"`
+	PoolKey string `json:"poolKey"`
+	MainKey string `json:"mainKey"`
+	AID     string `json:"aid"`
+	// AppK is as stored, so sealed if the Registrar has a Sealer.
+	AppK string `json:"appk"`
+	// DeviceKey is the public key the device answers challenges with.
+	DeviceKey string `json:"deviceKey"`
+	Trusted   string `json:"trusted"`
+	Step      string `json:"step"`
+	// Timestamp is used for every cell the registration writes, which makes
+	// each step idempotent and lets compensation delete exactly those cells.
+	Timestamp bigtable.Timestamp `json:"timestamp"`
+}
+
+// Registrar claims a registration pool row for an appliance and copies the
+// claim onto the device's main row. Bigtable has no multi-row transactions,
+// so the pool row carries an intent until both rows are written.
+type Registrar struct {
+	Table *bigtable.Table
+	Clock clock.Clock
+	// StaleAfter is how old an intent must be before Recover treats its
+	// registration as abandoned.
+	StaleAfter time.Duration
+	// ChallengeTTL is how long a challenge can be answered for; zero means
+	// DefaultChallengeTTL.
+	ChallengeTTL time.Duration
+	// AttestationRoots are the CAs whose attestations earn a device hardware
+	// trust. With none, no device can be registered as hardware.
+	AttestationRoots *x509.CertPool
+	// TokenTTL is how long an auth token is valid for; zero means
+	// DefaultTokenTTL.
+	TokenTTL time.Duration
+	// TokenKey is the server's secret that auth tokens are signed with.
+	// Without one, tokens can be neither issued nor validated.
+	TokenKey []byte
+	// AppKGrace is how long tokens signed for the AppK a device rotated away
+	// from are still accepted. Everything else needs the current AppK.
+	AppKGrace time.Duration
+	// Sealer, if set, encrypts the AppKs the Registrar stores and opens them
+	// again when it reads them. AppKs stored in plaintext are still read.
+	Sealer *envelope.Sealer
+
+	// afterStep is called once each step is applied; tests use it to crash
+	// a registration part way through.
+	afterStep func(step string) error
+}
+
+// Register claims the device paired with aid for the appliance holding appk,
+// which it presents from then on to act for the device. deviceKey is the
+// public key the device will sign its challenge with.
+func (r *Registrar) Register(ctx context.Context, aid, appk, deviceKey, trusted string) (*Intent, error) {
+	aid, err := parseAID(aid)
+	if err != nil {
+		return nil, err
+	}
+	if appk == "" {
+		return nil, fmt.Errorf("%w: AppK is empty", ErrBadAppK)
+	}
+	if _, err := ParsePublicKey(deviceKey); err != nil {
+		return nil, err
+	}
+	if !util.SliceContains(TrustLevels, trusted) {
+		return nil, fmt.Errorf("%w: %q", ErrBadTrust, trusted)
+	}
+	poolKey, err := ReadAidRow(ctx, r.Table, aid)
+	if err != nil {
+		return nil, err
+	}
+	mainKey, err := ParseRPKey(poolKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := r.Sealer.Seal(ctx, []byte(appk))
+	if err != nil {
+		return nil, err
+	}
+
+	in := &Intent{
+		ID:        newIntentID(),
+		PoolKey:   poolKey,
+		MainKey:   mainKey,
+		AID:       aid,
+		AppK:      string(sealed),
+		DeviceKey: deviceKey,
+		Trusted:   trusted,
+		Step:      StepRecorded,
+		Timestamp: bigtable.Time(clock.Or(r.Clock).Now()),
+	}
+	if err := r.record(ctx, in); err != nil {
+		return nil, err
+	}
+	if err := r.step(StepRecorded); err != nil {
+		return in, r.abort(ctx, in, err)
+	}
+	if err := r.resume(ctx, in); err != nil {
+		return in, r.abort(ctx, in, err)
+	}
+	return in, nil
+}
+
+// record writes the intent, provided the pool row has neither an AppK nor
+// another registration's intent.
+func (r *Registrar) record(ctx context.Context, in *Intent) error {
+	v, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	claimed := bigtable.ChainFilters(
+		bigtable.ColumnFilter(fmt.Sprintf("%s|%s", schema.ColumnAppK, schema.ColumnIntent)),
+		bigtable.ValueRangeFilter([]byte{0}, nil),
+	)
+	set := bigtable.NewMutation()
+	set.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent, in.Timestamp, v)
+
+	var matched bool
+	mut := bigtable.NewCondMutation(claimed, nil, set)
+	if err := r.Table.Apply(ctx, in.PoolKey, mut, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return fmt.Errorf("could not record intent on %s: %v", in.PoolKey, err)
+	}
+	if matched {
+		return fmt.Errorf("%w: key %s", ErrAlreadyClaimed, in.PoolKey)
+	}
+	return nil
+}
+
+// resume applies every step after the one the intent records and then clears
+// the intent.
+func (r *Registrar) resume(ctx context.Context, in *Intent) error {
+	if in.Step == StepRecorded {
+		in.Step = StepPoolWritten
+		v, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		mut := r.claimMutation(in)
+		mut.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent, in.Timestamp, v)
+		if err := r.Table.Apply(ctx, in.PoolKey, mut); err != nil {
+			in.Step = StepRecorded
+			return fmt.Errorf("could not claim %s: %v", in.PoolKey, err)
+		}
+		if err := r.step(StepPoolWritten); err != nil {
+			return err
+		}
+	}
+
+	mut := r.claimMutation(in)
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAID, in.Timestamp, []byte(in.AID))
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDeviceKey, in.Timestamp, []byte(in.DeviceKey))
+	if err := r.Table.Apply(ctx, in.MainKey, mut); err != nil {
+		return fmt.Errorf("could not claim %s: %v", in.MainKey, err)
+	}
+
+	done := bigtable.NewMutation()
+	done.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent)
+	if err := r.Table.Apply(ctx, in.PoolKey, done); err != nil {
+		return fmt.Errorf("could not clear intent on %s: %v", in.PoolKey, err)
+	}
+	return nil
+}
+
+func (r *Registrar) claimMutation(in *Intent) *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, in.Timestamp, []byte(in.AppK))
+	if in.Trusted != TrustHardware {
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted, in.Timestamp, []byte(in.Trusted))
+	}
+	return mut
+}
+
+// abort compensates for a failed registration and returns cause, joined with
+// any error hit while compensating.
+func (r *Registrar) abort(ctx context.Context, in *Intent, cause error) error {
+	if err := r.rollback(ctx, in); err != nil {
+		return errors.Join(cause, err)
+	}
+	return cause
+}
+
+// rollback deletes the cells written at the intent's timestamp from both rows,
+// leaving anything written before the registration started, and then the
+// intent itself.
+func (r *Registrar) rollback(ctx context.Context, in *Intent) error {
+	// Cell timestamps are in microseconds but only kept to the millisecond.
+	end := in.Timestamp + bigtable.Timestamp(time.Millisecond/time.Microsecond)
+	undo := bigtable.NewMutation()
+	for _, col := range []string{schema.ColumnAID, schema.ColumnAppK, schema.ColumnDeviceKey, schema.ColumnTrusted} {
+		undo.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, col, in.Timestamp, end)
+	}
+	if err := r.Table.Apply(ctx, in.MainKey, undo); err != nil {
+		return fmt.Errorf("could not roll back %s: %v", in.MainKey, err)
+	}
+	undo.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent)
+	if err := r.Table.Apply(ctx, in.PoolKey, undo); err != nil {
+		return fmt.Errorf("could not roll back %s: %v", in.PoolKey, err)
+	}
+	return nil
+}
+
+type Recovery struct {
+	Resumed    []string
+	RolledBack []string
+}
+
+// Recover finds registrations whose intent is older than StaleAfter. Those
+// that got as far as claiming the pool row are finished; the rest are rolled
+// back.
+func (r *Registrar) Recover(ctx context.Context) (Recovery, error) {
+	var (
+		rec     Recovery
+		intents []*Intent
+		errs    []error
+	)
+	filter := bigtable.ChainFilters(
+		bigtable.FamilyFilter(schema.ColumnFamilyRegistrationProperties),
+		bigtable.ColumnFilter(schema.ColumnIntent),
+		bigtable.LatestNFilter(1),
+	)
+	cutoff := bigtable.Time(clock.Or(r.Clock).Now().Add(-r.StaleAfter))
+	err := r.Table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		item := row[schema.ColumnFamilyRegistrationProperties][0]
+		in := &Intent{}
+		if err := json.Unmarshal(item.Value, in); err != nil {
+			errs = append(errs, fmt.Errorf("%w: key %s: %v", ErrBadIntent, row.Key(), err))
+			return true
+		}
+		if in.Timestamp <= cutoff {
+			intents = append(intents, in)
+		}
+		return true
+	}, bigtable.RowFilter(filter))
+	if err != nil {
+		return rec, fmt.Errorf("could not scan for intents: %v", err)
+	}
+
+	for _, in := range intents {
+		if in.Step == StepPoolWritten {
+			if err := r.resume(ctx, in); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			rec.Resumed = append(rec.Resumed, in.PoolKey)
+			continue
+		}
+		if err := r.rollback(ctx, in); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rec.RolledBack = append(rec.RolledBack, in.PoolKey)
+	}
+	return rec, errors.Join(errs...)
+}
+
+func (r *Registrar) step(step string) error {
+	if r.afterStep == nil {
+		return nil
+	}
+	return r.afterStep(step)
+}
+
+func newIntentID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
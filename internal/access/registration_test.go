@@ -0,0 +1,211 @@
+package access_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+	"github.com/theotheradamsmith/btemulator/internal/util"
+)
+
+func insertPairing(t testing.TB, ctx context.Context, d schema.DeviceEntry, tbl *bigtable.Table) {
+	t.Helper()
+	pool := bigtable.NewMutation()
+	pool.DeleteRow()
+	pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, bigtable.Now(), []byte("created"))
+	assert.NoError(t, tbl.Apply(ctx, d.AID+"#"+d.QID+"#"+d.DID, pool))
+	main := bigtable.NewMutation()
+	main.DeleteRow()
+	main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, bigtable.Now(), []byte(d.DID))
+	assert.NoError(t, tbl.Apply(ctx, d.QID+"#"+d.DID, main))
+}
+
+func readRow(t testing.TB, ctx context.Context, tbl *bigtable.Table, key string) bigtable.Row {
+	t.Helper()
+	row, err := tbl.ReadRow(ctx, key)
+	assert.NoError(t, err)
+	return row
+}
+
+func TestRegistrar(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	tbl := btetest.New(t).Table
+
+	t.Run("register writes both rows and clears the intent", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "kbhag-mpywq-xr68g-s9z6g-gxyx6", QID: "qid-saga-ok", DID: "did-saga-ok"}
+		insertPairing(t, ctx, d, tbl)
+		r := &access.Registrar{Table: tbl}
+		_, err := r.Register(ctx, d.AID, "appk-saga", someDeviceKey, "software")
+		assert.NoError(t, err)
+
+		pool := readRow(t, ctx, tbl, d.AID+"#"+d.QID+"#"+d.DID)
+		btetest.AssertColumns(t, pool, btetest.Cells{
+			"DeviceProperties:ApplianceKey": "appk-saga",
+			"DeviceProperties:Trusted":      "software",
+		})
+		btetest.AssertNoColumn(t, pool, schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent)
+		btetest.AssertColumns(t, readRow(t, ctx, tbl, d.QID+"#"+d.DID), btetest.Cells{
+			"DeviceProperties:AdoptionId":   d.AID,
+			"DeviceProperties:ApplianceKey": "appk-saga",
+			"DeviceProperties:DeviceId":     d.DID,
+		})
+
+		_, err = r.Register(ctx, d.AID, "appk-other", someDeviceKey, "software")
+		assert.IsError(t, err, access.ErrAlreadyClaimed)
+	})
+
+	t.Run("unknown trust levels are refused", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "au7a3-c8aik-95rbr-mpuq1-g4eet", QID: "qid-saga-trust", DID: "did-saga-trust"}
+		insertPairing(t, ctx, d, tbl)
+		r := &access.Registrar{Table: tbl}
+		for _, trusted := range []string{"", "firmware", "Hardware"} {
+			_, err := r.Register(ctx, d.AID, "appk-saga", someDeviceKey, trusted)
+			assert.IsError(t, err, access.ErrBadTrust, "%q", trusted)
+		}
+		ready, _, err := access.AidIsPairedAndUnregistered(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.True(t, ready)
+	})
+
+	t.Run("a failed step is compensated", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "w59bt-fk7of-5zym6-jdicn-u7ngo", QID: "qid-saga-fail", DID: "did-saga-fail"}
+		insertPairing(t, ctx, d, tbl)
+		r := &access.Registrar{Table: tbl}
+		boom := errors.New("boom")
+		access.SetAfterStep(r, func(step string) error {
+			if step == access.StepPoolWritten {
+				return boom
+			}
+			return nil
+		})
+		_, err := r.Register(ctx, d.AID, "appk-saga", someDeviceKey, "software")
+		assert.IsError(t, err, boom)
+
+		ready, _, err := access.AidIsPairedAndUnregistered(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.True(t, ready)
+		btetest.AssertNoColumn(t, readRow(t, ctx, tbl, d.AID+"#"+d.QID+"#"+d.DID), schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent)
+		btetest.AssertNoColumn(t, readRow(t, ctx, tbl, d.QID+"#"+d.DID), schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+	})
+
+	t.Run("a claim whose challenge fails is aborted", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "rjxte-z8hjb-4zkf1-fscip-43bpa", QID: "qid-claim-fail", DID: "did-claim-fail"}
+		insertPairing(t, ctx, d, tbl)
+		r := &access.Registrar{Table: tbl}
+		boom := errors.New("boom")
+		access.SetAfterStep(r, func(step string) error {
+			if step == access.StepClaimed {
+				return boom
+			}
+			return nil
+		})
+		_, _, err := r.Claim(ctx, d.AID, "appk-claim", someDeviceKey, "software")
+		assert.IsError(t, err, boom)
+		ready, _, err := access.AidIsPairedAndUnregistered(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.True(t, ready)
+
+		// The appliance's retry goes through.
+		access.SetAfterStep(r, nil)
+		in, challenge, err := r.Claim(ctx, d.AID, "appk-claim", someDeviceKey, "software")
+		assert.NoError(t, err)
+		assert.Equal(t, d.AID, in.AID)
+		assert.NotEqual(t, "", challenge)
+	})
+
+	t.Run("recovery finishes or rolls back crashed registrations", func(t *testing.T) {
+		resumed := schema.DeviceEntry{AID: "opd17-suqst-43y4z-qs9aj-h7m5x", QID: "qid-saga-resume", DID: "did-saga-resume"}
+		rolled := schema.DeviceEntry{AID: "mrgbe-oratn-45y9k-tiym6-hb6ds", QID: "qid-saga-rollback", DID: "did-saga-rollback"}
+		crash := func(at string, d schema.DeviceEntry) {
+			insertPairing(t, ctx, d, tbl)
+			r := &access.Registrar{Table: tbl}
+			access.SetAfterStep(r, func(step string) error {
+				if step == at {
+					panic("crash")
+				}
+				return nil
+			})
+			assert.Panics(t, func() { _, _ = r.Register(ctx, d.AID, "appk-saga", someDeviceKey, "hardware") })
+		}
+		crash(access.StepPoolWritten, resumed)
+		crash(access.StepRecorded, rolled)
+
+		r := &access.Registrar{Table: tbl}
+		rec, err := r.Recover(ctx)
+		assert.NoError(t, err)
+		assert.True(t, util.SliceContains(rec.Resumed, resumed.AID+"#"+resumed.QID+"#"+resumed.DID))
+		assert.True(t, util.SliceContains(rec.RolledBack, rolled.AID+"#"+rolled.QID+"#"+rolled.DID))
+
+		btetest.AssertColumns(t, readRow(t, ctx, tbl, resumed.QID+"#"+resumed.DID), btetest.Cells{
+			"DeviceProperties:ApplianceKey": "appk-saga",
+		})
+		ready, _, err := access.AidIsPairedAndUnregistered(ctx, tbl, rolled.AID)
+		assert.NoError(t, err)
+		assert.True(t, ready)
+	})
+
+	t.Run("challenge, complete and deregister", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "g4dmu-3uj5r-wcosc-sgh35-tjz5h", QID: "qid-saga-flow", DID: "did-saga-flow"}
+		insertPairing(t, ctx, d, tbl)
+		key, deviceKey := newDeviceKey(t)
+		appk := newAppK(t)
+		r := &access.Registrar{Table: tbl}
+		_, err := r.Register(ctx, d.AID, appk, deviceKey, "software")
+		assert.NoError(t, err)
+
+		_, err = r.IssueChallenge(ctx, d.AID, "appk-wrong")
+		assert.IsError(t, err, access.ErrWrongAppK)
+		assert.IsError(t, r.Complete(ctx, d.AID, appk, "nonce"), access.ErrNoChallenge)
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		state, _, err := access.GetState(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateInFlight, state)
+
+		assert.IsError(t, r.Complete(ctx, d.AID, appk, "wrong"), access.ErrBadResponse)
+		response := sign(t, key, challenge)
+		assert.NoError(t, r.Complete(ctx, d.AID, appk, response))
+		assert.IsError(t, r.Complete(ctx, d.AID, appk, response), access.ErrAlreadyRegistered)
+		state, _, err = access.GetState(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateRegistered, state)
+
+		assert.NoError(t, r.Deregister(ctx, d.AID, appk))
+		state, _, err = access.GetState(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateReady, state)
+	})
+
+	t.Run("abort releases an unfinished registration only", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "ze7xq-qmd6t-5qt9f-7xdr5-c99jx", QID: "qid-saga-abort", DID: "did-saga-abort"}
+		insertPairing(t, ctx, d, tbl)
+		r := &access.Registrar{Table: tbl}
+		_, err := r.Register(ctx, d.AID, "appk-abort", someDeviceKey, "software")
+		assert.NoError(t, err)
+		_, err = r.IssueChallenge(ctx, d.AID, "appk-abort")
+		assert.NoError(t, err)
+
+		assert.IsError(t, r.Abort(ctx, d.AID, "appk-wrong"), access.ErrWrongAppK)
+		assert.NoError(t, r.Abort(ctx, d.AID, "appk-abort"))
+		state, _, err := access.GetState(ctx, tbl, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateReady, state)
+		assert.IsError(t, r.Abort(ctx, d.AID, "appk-abort"), access.ErrNoAppK)
+
+		key, deviceKey := newDeviceKey(t)
+		appk := newAppK(t)
+		_, err = r.Register(ctx, d.AID, appk, deviceKey, "software")
+		assert.NoError(t, err)
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Complete(ctx, d.AID, appk, sign(t, key, challenge)))
+		assert.IsError(t, r.Abort(ctx, d.AID, appk), access.ErrAlreadyRegistered)
+	})
+}
@@ -0,0 +1,170 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// RotateAppK replaces a registered device's AppK, provided oldAppK is still
+// its current one. The old AppK stays on both rows as the previous version of
+// the cell, so a Registrar with an AppKGrace can go on accepting it for a
+// while; anything older is removed.
+//
+// The pool row is rotated first and the main row follows. If the main row
+// cannot follow, the pool row is put back; if the rotation stops in between,
+// retrying it finishes it.
+func (r *Registrar) RotateAppK(ctx context.Context, aid, oldAppK, newAppK string) error {
+	if newAppK == "" {
+		return fmt.Errorf("%w: new AppK is empty", ErrBadAppK)
+	}
+	if newAppK == oldAppK {
+		return fmt.Errorf("%w: new AppK is the current one", ErrBadAppK)
+	}
+	poolKey, err := ReadAidRow(ctx, r.Table, aid)
+	if err != nil {
+		return err
+	}
+	rp, err := SplitRPKey(poolKey)
+	if err != nil {
+		return err
+	}
+	mainKey := rp.MainKey.String()
+	main, err := r.Table.ReadRow(ctx, mainKey, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	if StateOf(main) != StateRegistered {
+		return fmt.Errorf("%w: key %s", ErrNotRegistered, mainKey)
+	}
+
+	pool, err := r.Table.ReadRow(ctx, poolKey, bigtable.RowFilter(appKFilter(2)))
+	if err != nil {
+		return fmt.Errorf("%w: key %s: %v", ErrReadError, poolKey, err)
+	}
+	items := pool[schema.ColumnFamilyDeviceProperties]
+	if len(items) == 0 {
+		return fmt.Errorf("%w: key %s", ErrNoAppK, poolKey)
+	}
+	current := items[0]
+	opened, err := r.Sealer.Open(ctx, current.Value)
+	if err != nil {
+		return fmt.Errorf("could not open AppK on %s: %w", poolKey, err)
+	}
+	if string(opened) == newAppK && len(items) > 1 {
+		if previous, err := r.Sealer.Open(ctx, items[1].Value); err == nil && string(previous) == oldAppK {
+			return r.rotateMain(ctx, mainKey, items[1], current)
+		}
+	}
+	if string(opened) != oldAppK {
+		return fmt.Errorf("%w: key %s", ErrWrongAppK, poolKey)
+	}
+	sealed, err := r.Sealer.Seal(ctx, []byte(newAppK))
+	if err != nil {
+		return err
+	}
+
+	// The new AppK must be the latest version even if the clock says
+	// otherwise.
+	ts := bigtable.Time(clock.Or(r.Clock).Now())
+	if ts <= current.Timestamp {
+		ts = current.Timestamp + millisecond
+	}
+	mut := bigtable.NewMutation()
+	mut.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, 0, current.Timestamp)
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, ts, sealed)
+
+	unchanged := bigtable.ChainFilters(appKFilter(1), bigtable.ValueFilter(regexp.QuoteMeta(string(current.Value))))
+	var matched bool
+	if err := r.Table.Apply(ctx, poolKey, bigtable.NewCondMutation(unchanged, mut, nil), bigtable.GetCondMutationResult(&matched)); err != nil {
+		return fmt.Errorf("could not rotate AppK on %s: %v", poolKey, err)
+	}
+	if !matched {
+		return fmt.Errorf("%w: key %s", ErrWrongAppK, poolKey)
+	}
+	if err := r.step(StepPoolRotated); err != nil {
+		return r.unrotate(ctx, rp, ts, err)
+	}
+	if err := r.rotateMain(ctx, mainKey, current, bigtable.ReadItem{Timestamp: ts, Value: sealed}); err != nil {
+		return r.unrotate(ctx, rp, ts, err)
+	}
+	return nil
+}
+
+// rotateMain moves the main row's AppK from one version to the next, as
+// RotateAppK has done on the pool row, provided from is still its latest.
+func (r *Registrar) rotateMain(ctx context.Context, mainKey string, from, to bigtable.ReadItem) error {
+	mut := bigtable.NewMutation()
+	mut.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, 0, from.Timestamp)
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, to.Timestamp, to.Value)
+	unchanged := bigtable.ChainFilters(appKFilter(1), bigtable.ValueFilter(regexp.QuoteMeta(string(from.Value))))
+	var matched bool
+	if err := r.Table.Apply(ctx, mainKey, bigtable.NewCondMutation(unchanged, mut, nil), bigtable.GetCondMutationResult(&matched)); err != nil {
+		return fmt.Errorf("could not rotate AppK on %s: %v", mainKey, err)
+	}
+	if !matched {
+		return fmt.Errorf("%w: key %s", ErrWrongAppK, mainKey)
+	}
+	return nil
+}
+
+// unrotate removes the AppK RotateAppK wrote to the pool row at ts and
+// returns cause, joined with any error hit doing so.
+func (r *Registrar) unrotate(ctx context.Context, rp RPKey, ts bigtable.Timestamp, cause error) error {
+	undo := bigtable.NewMutation()
+	undo.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, ts, ts+millisecond)
+	if err := r.Table.Apply(ctx, rp.String(), undo); err != nil {
+		return errors.Join(cause, fmt.Errorf("could not update %s: %v", rp, err))
+	}
+	return cause
+}
+
+func appKFilter(versions int) bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter(schema.ColumnFamilyDeviceProperties),
+		bigtable.ColumnFilter(schema.ColumnAppK),
+		bigtable.LatestNFilter(versions),
+	)
+}
+
+// GetAppKs returns the AppK stored on key followed, if it was rotated less
+// than grace before now, by the AppK it replaced.
+func GetAppKs(ctx context.Context, tbl *bigtable.Table, key string, grace time.Duration, now time.Time) ([][]byte, error) {
+	row, err := tbl.ReadRow(ctx, key, bigtable.RowFilter(appKFilter(2)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s: %v", ErrReadError, key, err)
+	}
+	items := row[schema.ColumnFamilyDeviceProperties]
+	if len(items) == 0 || len(items[0].Value) == 0 {
+		return nil, fmt.Errorf("%w: key %s", ErrNoAppK, key)
+	}
+	appks := [][]byte{items[0].Value}
+	if len(items) > 1 && len(items[1].Value) > 0 && now.Before(items[0].Timestamp.Time().Add(grace)) {
+		appks = append(appks, items[1].Value)
+	}
+	return appks, nil
+}
+
+// AppK returns the current AppK stored on key, opened with the Sealer.
+func (r *Registrar) AppK(ctx context.Context, key string) ([]byte, error) {
+	appk, err := GetAppK(ctx, r.Table, key)
+	if err != nil {
+		return nil, err
+	}
+	if appk, err = r.Sealer.Open(ctx, appk); err != nil {
+		return nil, fmt.Errorf("could not open AppK on %s: %w", key, err)
+	}
+	return appk, nil
+}
+
+// AppKs is GetAppKs with the Registrar's AppKGrace and clock, and the AppKs
+// opened with the Sealer.
+func (r *Registrar) AppKs(ctx context.Context, key string) ([][]byte, error) {
+	return r.appKs(ctx, key, r.AppKGrace)
+}
@@ -0,0 +1,236 @@
+package access_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func TestRotateAppK(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	strict := &access.Registrar{Table: env.Table, Clock: env.Clock, TokenKey: tokenKey}
+	lenient := &access.Registrar{Table: env.Table, Clock: env.Clock, TokenKey: tokenKey, AppKGrace: time.Hour}
+
+	d := schema.DeviceEntry{AID: "56nad-n1umn-94ycc-5d5p1-jzow4", QID: "qid-rotate", DID: "did-rotate"}
+	poolKey, mainKey := d.AID+"#"+d.QID+"#"+d.DID, d.QID+"#"+d.DID
+	insertPairing(t, ctx, d, env.Table)
+	key, deviceKey := newDeviceKey(t)
+	oldAppK, rotatedAppK := newAppK(t), newAppK(t)
+	_, err := strict.Register(ctx, d.AID, oldAppK, deviceKey, access.TrustSoftware)
+	assert.NoError(t, err)
+	assert.IsError(t, strict.RotateAppK(ctx, d.AID, oldAppK, rotatedAppK), access.ErrNotRegistered)
+	challenge, err := strict.IssueChallenge(ctx, d.AID, oldAppK)
+	assert.NoError(t, err)
+	assert.NoError(t, strict.Complete(ctx, d.AID, oldAppK, sign(t, key, challenge)))
+	token, _, err := strict.IssueToken(ctx, d.AID, oldAppK)
+	assert.NoError(t, err)
+
+	assert.IsError(t, strict.RotateAppK(ctx, d.AID, "appk-wrong", rotatedAppK), access.ErrWrongAppK)
+	assert.IsError(t, strict.RotateAppK(ctx, d.AID, oldAppK, ""), access.ErrBadAppK)
+	assert.IsError(t, strict.RotateAppK(ctx, d.AID, oldAppK, oldAppK), access.ErrBadAppK)
+
+	env.Clock.Advance(time.Minute)
+	assert.NoError(t, strict.RotateAppK(ctx, d.AID, oldAppK, rotatedAppK))
+	for _, rowKey := range []string{poolKey, mainKey} {
+		row := readRow(t, ctx, env.Table, rowKey)
+		btetest.AssertColumns(t, row, btetest.Cells{"DeviceProperties:ApplianceKey": rotatedAppK})
+		btetest.AssertVersions(t, row, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, 2)
+	}
+	assert.IsError(t, strict.RotateAppK(ctx, d.AID, oldAppK, rotatedAppK), access.ErrWrongAppK)
+
+	appks, err := access.GetAppKs(ctx, env.Table, poolKey, time.Hour, env.Clock.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(rotatedAppK), []byte(oldAppK)}, appks)
+	appks, err = access.GetAppKs(ctx, env.Table, poolKey, 0, env.Clock.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(rotatedAppK)}, appks)
+
+	t.Run("tokens for the old AppK are accepted only within the grace period", func(t *testing.T) {
+		_, err := strict.ValidateToken(ctx, token)
+		assert.IsError(t, err, access.ErrBadToken)
+		_, err = lenient.ValidateToken(ctx, token)
+		assert.NoError(t, err)
+
+		// The old AppK itself no longer acts for the device.
+		_, _, err = lenient.IssueToken(ctx, d.AID, oldAppK)
+		assert.IsError(t, err, access.ErrWrongAppK)
+		_, _, err = lenient.RotateToken(ctx, d.AID, oldAppK, token)
+		assert.IsError(t, err, access.ErrWrongAppK)
+		assert.IsError(t, lenient.RevokeTokens(ctx, d.AID, oldAppK), access.ErrWrongAppK)
+		assert.IsError(t, lenient.Abort(ctx, d.AID, oldAppK), access.ErrWrongAppK)
+		assert.IsError(t, lenient.Deregister(ctx, d.AID, oldAppK), access.ErrWrongAppK)
+		state, _, err := access.GetState(ctx, env.Table, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.StateRegistered, state)
+		fresh, _, err := lenient.RotateToken(ctx, d.AID, rotatedAppK, token)
+		assert.NoError(t, err)
+		_, err = strict.ValidateToken(ctx, fresh)
+		assert.NoError(t, err)
+
+		env.Clock.Advance(time.Hour)
+		_, err = lenient.ValidateToken(ctx, token)
+		assert.IsError(t, err, access.ErrBadToken)
+		_, _, err = lenient.IssueToken(ctx, d.AID, rotatedAppK)
+		assert.NoError(t, err)
+	})
+
+	t.Run("only the latest previous AppK is kept", func(t *testing.T) {
+		thirdAppK := newAppK(t)
+		assert.NoError(t, strict.RotateAppK(ctx, d.AID, rotatedAppK, thirdAppK))
+		row := readRow(t, ctx, env.Table, poolKey)
+		btetest.AssertVersions(t, row, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, 2)
+		appks, err := access.GetAppKs(ctx, env.Table, poolKey, time.Hour, env.Clock.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte(thirdAppK), []byte(rotatedAppK)}, appks)
+
+		// Of two appliances racing to rotate the same key, one wins.
+		var (
+			wg   sync.WaitGroup
+			errs [2]error
+		)
+		for i := range errs {
+			appk := newAppK(t)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = strict.RotateAppK(ctx, d.AID, thirdAppK, appk)
+			}(i)
+		}
+		wg.Wait()
+		assert.True(t, (errs[0] == nil) != (errs[1] == nil), "%v", errs)
+	})
+}
+
+func TestRotateAppKSaga(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock}
+
+	d := schema.DeviceEntry{AID: "jduz5-mp668-1ukuw-9wici-1rbje", QID: "qid-rotate-saga", DID: "did-rotate-saga"}
+	poolKey, mainKey := d.AID+"#"+d.QID+"#"+d.DID, d.QID+"#"+d.DID
+	insertPairing(t, ctx, d, env.Table)
+	key, deviceKey := newDeviceKey(t)
+	oldAppK, newAppK := newAppK(t), newAppK(t)
+	_, err := r.Register(ctx, d.AID, oldAppK, deviceKey, access.TrustSoftware)
+	assert.NoError(t, err)
+	challenge, err := r.IssueChallenge(ctx, d.AID, oldAppK)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Complete(ctx, d.AID, oldAppK, sign(t, key, challenge)))
+	assertAppK := func(want string, versions int) {
+		t.Helper()
+		for _, rowKey := range []string{poolKey, mainKey} {
+			row := readRow(t, ctx, env.Table, rowKey)
+			btetest.AssertColumns(t, row, btetest.Cells{"DeviceProperties:ApplianceKey": want})
+			btetest.AssertVersions(t, row, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, versions)
+		}
+	}
+
+	t.Run("the pool row is put back if the main row cannot follow", func(t *testing.T) {
+		crash := &access.Registrar{Table: env.Table, Clock: env.Clock}
+		boom := errors.New("boom")
+		access.SetAfterStep(crash, func(step string) error {
+			if step == access.StepPoolRotated {
+				return boom
+			}
+			return nil
+		})
+		env.Clock.Advance(time.Minute)
+		assert.IsError(t, crash.RotateAppK(ctx, d.AID, oldAppK, newAppK), boom)
+		assertAppK(oldAppK, 1)
+
+		// The main row no longer holds the AppK the pool row did.
+		mut := bigtable.NewMutation()
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, bigtable.Time(env.Clock.Now()), []byte("appk-diverged"))
+		assert.NoError(t, env.Table.Apply(ctx, mainKey, mut))
+		assert.IsError(t, r.RotateAppK(ctx, d.AID, oldAppK, newAppK), access.ErrWrongAppK)
+		btetest.AssertColumns(t, readRow(t, ctx, env.Table, poolKey), btetest.Cells{"DeviceProperties:ApplianceKey": oldAppK})
+		undo := bigtable.NewMutation()
+		undo.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, bigtable.Time(env.Clock.Now()), bigtable.Time(env.Clock.Now().Add(time.Millisecond)))
+		assert.NoError(t, env.Table.Apply(ctx, mainKey, undo))
+		assertAppK(oldAppK, 1)
+	})
+
+	t.Run("retrying a rotation that stopped part way finishes it", func(t *testing.T) {
+		// A rotation that stopped after the pool row.
+		env.Clock.Advance(time.Minute)
+		mut := bigtable.NewMutation()
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, bigtable.Time(env.Clock.Now()), []byte(newAppK))
+		assert.NoError(t, env.Table.Apply(ctx, poolKey, mut))
+
+		assert.NoError(t, r.RotateAppK(ctx, d.AID, oldAppK, newAppK))
+		assertAppK(newAppK, 2)
+		assert.IsError(t, r.RotateAppK(ctx, d.AID, oldAppK, newAppK), access.ErrWrongAppK)
+		assertAppK(newAppK, 2)
+	})
+}
+
+func TestSealedAppKs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	kms, err := envelope.OpenLocalKMS("")
+	assert.NoError(t, err)
+	_, err = kms.CreateKey("appk")
+	assert.NoError(t, err)
+	sealer := &envelope.Sealer{Provider: kms.Key("appk")}
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock, Sealer: sealer, TokenKey: tokenKey, AppKGrace: time.Hour}
+
+	d := schema.DeviceEntry{AID: "qrw5o-shdct-3q19z-ae8bo-94yjf", QID: "qid-sealed", DID: "did-sealed"}
+	poolKey, mainKey := d.AID+"#"+d.QID+"#"+d.DID, d.QID+"#"+d.DID
+	insertPairing(t, ctx, d, env.Table)
+	key, deviceKey := newDeviceKey(t)
+	appk := newAppK(t)
+	in, err := r.Register(ctx, d.AID, appk, deviceKey, access.TrustSoftware)
+	assert.NoError(t, err)
+	assert.True(t, envelope.IsSealed([]byte(in.AppK)))
+	stored, err := access.GetAppK(ctx, env.Table, poolKey)
+	assert.NoError(t, err)
+	assert.Equal(t, in.AppK, string(stored))
+	opened, err := r.AppK(ctx, poolKey)
+	assert.NoError(t, err)
+	assert.Equal(t, appk, string(opened))
+	btetest.AssertColumns(t, readRow(t, ctx, env.Table, mainKey), btetest.Cells{"DeviceProperties:ApplianceKey": in.AppK})
+
+	challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Complete(ctx, d.AID, appk, sign(t, key, challenge)))
+	token, _, err := r.IssueToken(ctx, d.AID, appk)
+	assert.NoError(t, err)
+
+	// Rotating the KMS key leaves existing AppKs readable.
+	_, err = kms.RotateKey("appk")
+	assert.NoError(t, err)
+	_, err = r.ValidateToken(ctx, token)
+	assert.NoError(t, err)
+
+	rotatedAppK := newAppK(t)
+	assert.NoError(t, r.RotateAppK(ctx, d.AID, appk, rotatedAppK))
+	stored, err = access.GetAppK(ctx, env.Table, poolKey)
+	assert.NoError(t, err)
+	keyID, _ := envelope.KeyID(stored)
+	assert.Equal(t, "appk/2", keyID)
+	_, err = r.ValidateToken(ctx, token)
+	assert.NoError(t, err)
+	_, _, err = r.IssueToken(ctx, d.AID, rotatedAppK)
+	assert.NoError(t, err)
+	appks, err := r.AppKs(ctx, poolKey)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(rotatedAppK), []byte(appk)}, appks)
+
+	// Without the keys, the stored AppK matches nothing.
+	_, _, err = (&access.Registrar{Table: env.Table, Clock: env.Clock, TokenKey: tokenKey}).IssueToken(ctx, d.AID, rotatedAppK)
+	assert.IsError(t, err, access.ErrWrongAppK)
+}
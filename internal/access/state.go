@@ -0,0 +1,64 @@
+package access
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// State is how far a device has got through registration, judged from its
+// main row.
+type State string
+
+const (
+	// StateReady devices are paired and waiting for an appliance to claim them.
+	StateReady State = "ready"
+	// StateClaimed devices have an AppK but no challenge yet.
+	StateClaimed State = "claimed"
+	// StateInFlight devices have been sent a challenge.
+	StateInFlight State = "in-flight"
+	// StateRegistered devices answered their challenge.
+	StateRegistered State = "registered"
+)
+
+var States = []State{StateReady, StateClaimed, StateInFlight, StateRegistered}
+
+func StateOf(main bigtable.Row) State {
+	has := func(family, column string) bool {
+		for _, item := range main[family] {
+			if item.Column == family+":"+column && len(item.Value) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has(schema.ColumnFamilyRegistrationProperties, schema.ColumnRegistered):
+		return StateRegistered
+	case has(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallenge):
+		return StateInFlight
+	case has(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK):
+		return StateClaimed
+	default:
+		return StateReady
+	}
+}
+
+// GetState finds the device paired with aid and reports its state.
+func GetState(ctx context.Context, tbl *bigtable.Table, aid string) (State, string, error) {
+	poolKey, err := ReadAidRow(ctx, tbl, aid)
+	if err != nil {
+		return "", "", err
+	}
+	mainKey, err := ParseRPKey(poolKey)
+	if err != nil {
+		return "", "", err
+	}
+	row, err := tbl.ReadRow(ctx, mainKey, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return "", mainKey, fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	return StateOf(row), mainKey, nil
+}
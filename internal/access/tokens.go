@@ -0,0 +1,304 @@
+package access
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var (
+	ErrNotRegistered = errors.New("device not registered")
+	ErrBadToken      = errors.New("auth token is malformed or wrongly signed")
+	ErrTokenExpired  = errors.New("auth token expired")
+	ErrTokenRevoked  = errors.New("auth token revoked")
+	ErrNoTokenKey    = errors.New("no key to sign auth tokens with")
+)
+
+// DefaultTokenTTL is how long an auth token is valid for when the Registrar
+// does not say.
+const DefaultTokenTTL = 24 * time.Hour
+
+// AuthToken is what an auth token says about itself. Each token issued is
+// also a version of the DeviceProperties:AuthTokens cell on the device's main
+// row, written at the time it was issued and holding its expiry in unix
+// milliseconds, zero padded as for a Lease, followed by its ID:
+//
+//	00000001697040000000|3f1c9a0b5e2d4c67
+//
+// Revoking a token deletes its version, and a token is only valid until the
+// expiry its version holds. Tokens are signed with HMAC-SHA256 under a key
+// derived from the Registrar's TokenKey and the AppK, so a device that
+// rotates its AppK loses its tokens too, once any AppKGrace is over.
+type AuthToken struct {
+	ID      string
+	AID     string
+	Expires time.Time
+}
+
+// tokenClaims is the signed part of a token.
+type tokenClaims struct {
+	ID  string `json:"id"`
+	AID string `json:"aid"`
+	Exp int64  `json:"exp"`
+}
+
+// IssueToken gives the registered device that the appliance holding appk
+// claimed a new auth token, and returns the token along with what it says.
+// Expired tokens are removed as it goes.
+func (r *Registrar) IssueToken(ctx context.Context, aid, appk string) (string, AuthToken, error) {
+	if len(r.TokenKey) == 0 {
+		return "", AuthToken{}, ErrNoTokenKey
+	}
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	mainKey := rp.MainKey.String()
+	row, err := r.Table.ReadRow(ctx, mainKey, bigtable.RowFilter(bigtable.ColumnFilter(
+		fmt.Sprintf("%s|%s", schema.ColumnAuthToken, schema.ColumnRegistered))))
+	if err != nil {
+		return "", AuthToken{}, fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	if StateOf(row) != StateRegistered {
+		return "", AuthToken{}, fmt.Errorf("%w: key %s", ErrNotRegistered, mainKey)
+	}
+
+	ttl := r.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	now := clock.Or(r.Clock).Now()
+	tok := AuthToken{ID: newTokenID(), AID: rp.AID, Expires: now.Add(ttl).Truncate(time.Millisecond).UTC()}
+	value := fmt.Sprintf("%s|%s", leaseBound(tok.Expires), tok.ID)
+	// Versions are told apart by timestamp, so a token issued in the same
+	// millisecond as another is written a millisecond later.
+	for ts := bigtable.Time(now); ; ts += millisecond {
+		taken := bigtable.ChainFilters(
+			bigtable.FamilyFilter(schema.ColumnFamilyDeviceProperties),
+			bigtable.ColumnFilter(schema.ColumnAuthToken),
+			bigtable.TimestampRangeFilterMicros(ts, ts+millisecond),
+		)
+		mut := bigtable.NewMutation()
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken, ts, []byte(value))
+		var matched bool
+		if err := r.Table.Apply(ctx, mainKey, bigtable.NewCondMutation(taken, nil, mut), bigtable.GetCondMutationResult(&matched)); err != nil {
+			return "", AuthToken{}, fmt.Errorf("could not issue token on %s: %v", mainKey, err)
+		}
+		if !matched {
+			break
+		}
+	}
+
+	prune := bigtable.NewMutation()
+	var expired int
+	for _, item := range tokenCells(row) {
+		if exp, _, ok := parseTokenCell(item.Value); !ok || !now.Before(exp) {
+			prune.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken, item.Timestamp, item.Timestamp+millisecond)
+			expired++
+		}
+	}
+	if expired > 0 {
+		if err := r.Table.Apply(ctx, mainKey, prune); err != nil {
+			return "", AuthToken{}, fmt.Errorf("could not prune tokens on %s: %v", mainKey, err)
+		}
+	}
+
+	token, err := r.signToken(tok, []byte(appk))
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	return token, tok, nil
+}
+
+// RotateToken swaps a valid token for a new one, revoking the old.
+func (r *Registrar) RotateToken(ctx context.Context, aid, appk, token string) (string, AuthToken, error) {
+	old, err := r.ValidateToken(ctx, token)
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	canonical, err := parseAID(aid)
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	if old.AID != canonical {
+		return "", AuthToken{}, fmt.Errorf("%w: issued to %s", ErrBadToken, old.AID)
+	}
+	token, tok, err := r.IssueToken(ctx, aid, appk)
+	if err != nil {
+		return "", AuthToken{}, err
+	}
+	return token, tok, r.RevokeToken(ctx, aid, appk, old.ID)
+}
+
+// RevokeToken revokes the token with the given ID. Revoking a token that is
+// already gone is not an error.
+func (r *Registrar) RevokeToken(ctx context.Context, aid, appk, id string) error {
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return err
+	}
+	mainKey := rp.MainKey.String()
+	row, err := r.Table.ReadRow(ctx, mainKey, bigtable.RowFilter(bigtable.ColumnFilter(schema.ColumnAuthToken)))
+	if err != nil {
+		return fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	del := bigtable.NewMutation()
+	var found int
+	for _, item := range tokenCells(row) {
+		if _, stored, _ := parseTokenCell(item.Value); stored == id {
+			del.DeleteTimestampRange(schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken, item.Timestamp, item.Timestamp+millisecond)
+			found++
+		}
+	}
+	if found == 0 {
+		return nil
+	}
+	if err := r.Table.Apply(ctx, mainKey, del); err != nil {
+		return fmt.Errorf("could not revoke token on %s: %v", mainKey, err)
+	}
+	return nil
+}
+
+// RevokeTokens revokes every token the device has been issued.
+func (r *Registrar) RevokeTokens(ctx context.Context, aid, appk string) error {
+	rp, err := r.claimed(ctx, aid, appk)
+	if err != nil {
+		return err
+	}
+	del := bigtable.NewMutation()
+	del.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken)
+	if err := r.Table.Apply(ctx, rp.MainKey.String(), del); err != nil {
+		return fmt.Errorf("could not revoke tokens on %s: %v", rp.MainKey, err)
+	}
+	return nil
+}
+
+// ValidateToken checks token was signed for the AppK its device holds, has
+// not expired and has not been revoked, and returns what it says.
+func (r *Registrar) ValidateToken(ctx context.Context, token string) (AuthToken, error) {
+	if len(r.TokenKey) == 0 {
+		return AuthToken{}, ErrNoTokenKey
+	}
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return AuthToken{}, ErrBadToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return AuthToken{}, fmt.Errorf("%w: %v", ErrBadToken, err)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return AuthToken{}, fmt.Errorf("%w: %v", ErrBadToken, err)
+	}
+	tok := AuthToken{ID: claims.ID, AID: claims.AID, Expires: time.UnixMilli(claims.Exp).UTC()}
+
+	poolKey, err := ReadAidRow(ctx, r.Table, tok.AID)
+	if err != nil {
+		return AuthToken{}, fmt.Errorf("%w: %v", ErrBadToken, err)
+	}
+	appks, err := r.AppKs(ctx, poolKey)
+	if errors.Is(err, ErrNoAppK) {
+		return AuthToken{}, fmt.Errorf("%w: key %s: device released", ErrTokenRevoked, poolKey)
+	} else if err != nil {
+		return AuthToken{}, err
+	}
+	signed := false
+	for _, appk := range appks {
+		signed = signed || hmac.Equal([]byte(sig), []byte(r.tokenMAC(payload, appk)))
+	}
+	if !signed {
+		return AuthToken{}, fmt.Errorf("%w: key %s", ErrBadToken, poolKey)
+	}
+
+	mainKey, err := ParseRPKey(poolKey)
+	if err != nil {
+		return AuthToken{}, err
+	}
+	row, err := r.Table.ReadRow(ctx, mainKey, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter(schema.ColumnFamilyDeviceProperties),
+		bigtable.ColumnFilter(schema.ColumnAuthToken),
+		bigtable.ValueFilter(`[0-9]{20}\|`+regexp.QuoteMeta(tok.ID)),
+	)))
+	if err != nil {
+		return AuthToken{}, fmt.Errorf("%w: key %s: %v", ErrReadError, mainKey, err)
+	}
+	cells := tokenCells(row)
+	if len(cells) == 0 {
+		return AuthToken{}, fmt.Errorf("%w: key %s", ErrTokenRevoked, mainKey)
+	}
+	// The stored expiry is the one that counts; a token claiming another was
+	// not issued as it stands.
+	for _, item := range cells {
+		if exp, _, ok := parseTokenCell(item.Value); !ok || !exp.Equal(tok.Expires) {
+			return AuthToken{}, fmt.Errorf("%w: key %s: expiry does not match", ErrBadToken, mainKey)
+		}
+	}
+	if !clock.Or(r.Clock).Now().Before(tok.Expires) {
+		return AuthToken{}, fmt.Errorf("%w: key %s", ErrTokenExpired, mainKey)
+	}
+	return tok, nil
+}
+
+const millisecond = bigtable.Timestamp(time.Millisecond / time.Microsecond)
+
+func tokenCells(row bigtable.Row) []bigtable.ReadItem {
+	var cells []bigtable.ReadItem
+	for _, item := range row[schema.ColumnFamilyDeviceProperties] {
+		if item.Column == schema.ColumnFamilyDeviceProperties+":"+schema.ColumnAuthToken {
+			cells = append(cells, item)
+		}
+	}
+	return cells
+}
+
+func parseTokenCell(v []byte) (time.Time, string, bool) {
+	exp, id, ok := bytes.Cut(v, []byte("|"))
+	if !ok {
+		return time.Time{}, "", false
+	}
+	ms, err := strconv.ParseInt(string(exp), 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.UnixMilli(ms), string(id), true
+}
+
+func (r *Registrar) signToken(tok AuthToken, appk []byte) (string, error) {
+	b, err := json.Marshal(tokenClaims{ID: tok.ID, AID: tok.AID, Exp: tok.Expires.UnixMilli()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + r.tokenMAC(payload, appk), nil
+}
+
+// tokenMAC signs payload under a key only the server can derive for appk.
+func (r *Registrar) tokenMAC(payload string, appk []byte) string {
+	derive := hmac.New(sha256.New, r.TokenKey)
+	derive.Write(appk)
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTokenID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
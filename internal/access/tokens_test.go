@@ -0,0 +1,140 @@
+package access_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var tokenKey = []byte("token-key")
+
+func TestAuthTokens(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock, TokenTTL: time.Hour, TokenKey: tokenKey}
+	d := schema.DeviceEntry{AID: "jhxrw-79muo-ijjnq-d3et3-bfxra", QID: "qid-tokens", DID: "did-tokens"}
+	mainKey := d.QID + "#" + d.DID
+	insertPairing(t, ctx, d, env.Table)
+	key, deviceKey := newDeviceKey(t)
+	appk := newAppK(t)
+	_, err := r.Register(ctx, d.AID, appk, deviceKey, access.TrustSoftware)
+	assert.NoError(t, err)
+
+	_, _, err = r.IssueToken(ctx, d.AID, appk)
+	assert.IsError(t, err, access.ErrNotRegistered)
+	challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Complete(ctx, d.AID, appk, sign(t, key, challenge)))
+	_, _, err = r.IssueToken(ctx, d.AID, "appk-wrong")
+	assert.IsError(t, err, access.ErrWrongAppK)
+
+	first, firstTok, err := r.IssueToken(ctx, d.AID, appk)
+	assert.NoError(t, err)
+	assert.Equal(t, d.AID, firstTok.AID)
+	assert.Equal(t, env.Clock.Now().Add(time.Hour), firstTok.Expires)
+	second, secondTok, err := r.IssueToken(ctx, d.AID, appk)
+	assert.NoError(t, err)
+	assert.NotEqual(t, firstTok.ID, secondTok.ID)
+	btetest.AssertVersions(t, readRow(t, ctx, env.Table, mainKey), schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken, 2)
+
+	got, err := r.ValidateToken(ctx, first)
+	assert.NoError(t, err)
+	assert.Equal(t, firstTok, got)
+	for _, bad := range []string{"", "not-a-token", "e30." + first[len(first)-43:], first[:len(first)-2] + "xx"} {
+		_, err = r.ValidateToken(ctx, bad)
+		assert.IsError(t, err, access.ErrBadToken, "%q", bad)
+	}
+
+	t.Run("only the server can sign tokens", func(t *testing.T) {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"id":%q,"aid":%q,"exp":%d}`,
+			firstTok.ID, d.AID, firstTok.Expires.Add(time.Hour).UnixMilli())))
+		mac := hmac.New(sha256.New, []byte(appk))
+		mac.Write([]byte(payload))
+		_, err := r.ValidateToken(ctx, payload+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+		assert.IsError(t, err, access.ErrBadToken)
+
+		other := &access.Registrar{Table: env.Table, Clock: env.Clock, TokenKey: []byte("other-key")}
+		_, err = other.ValidateToken(ctx, first)
+		assert.IsError(t, err, access.ErrBadToken)
+		keyless := &access.Registrar{Table: env.Table, Clock: env.Clock}
+		_, err = keyless.ValidateToken(ctx, first)
+		assert.IsError(t, err, access.ErrNoTokenKey)
+		_, _, err = keyless.IssueToken(ctx, d.AID, appk)
+		assert.IsError(t, err, access.ErrNoTokenKey)
+	})
+
+	t.Run("the stored expiry counts", func(t *testing.T) {
+		token, tok, err := r.IssueToken(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		for _, item := range readRow(t, ctx, env.Table, mainKey)[schema.ColumnFamilyDeviceProperties] {
+			if !strings.HasSuffix(string(item.Value), "|"+tok.ID) {
+				continue
+			}
+			mut := bigtable.NewMutation()
+			mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken, item.Timestamp,
+				[]byte(fmt.Sprintf("%020d|%s", env.Clock.Now().UnixMilli(), tok.ID)))
+			assert.NoError(t, env.Table.Apply(ctx, mainKey, mut))
+		}
+		_, err = r.ValidateToken(ctx, token)
+		assert.IsError(t, err, access.ErrBadToken)
+		assert.NoError(t, r.RevokeToken(ctx, d.AID, appk, tok.ID))
+	})
+
+	t.Run("rotate and revoke", func(t *testing.T) {
+		rotated, _, err := r.RotateToken(ctx, d.AID, appk, first)
+		assert.NoError(t, err)
+		_, err = r.ValidateToken(ctx, first)
+		assert.IsError(t, err, access.ErrTokenRevoked)
+		_, _, err = r.RotateToken(ctx, d.AID, appk, first)
+		assert.IsError(t, err, access.ErrTokenRevoked)
+		_, err = r.ValidateToken(ctx, rotated)
+		assert.NoError(t, err)
+
+		assert.NoError(t, r.RevokeToken(ctx, d.AID, appk, secondTok.ID))
+		assert.NoError(t, r.RevokeToken(ctx, d.AID, appk, secondTok.ID))
+		_, err = r.ValidateToken(ctx, second)
+		assert.IsError(t, err, access.ErrTokenRevoked)
+		_, err = r.ValidateToken(ctx, rotated)
+		assert.NoError(t, err)
+
+		assert.NoError(t, r.RevokeTokens(ctx, d.AID, appk))
+		_, err = r.ValidateToken(ctx, rotated)
+		assert.IsError(t, err, access.ErrTokenRevoked)
+	})
+
+	t.Run("expired tokens fail and are pruned", func(t *testing.T) {
+		old, _, err := r.IssueToken(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		env.Clock.Advance(time.Hour)
+		_, err = r.ValidateToken(ctx, old)
+		assert.IsError(t, err, access.ErrTokenExpired)
+
+		current, _, err := r.IssueToken(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		btetest.AssertVersions(t, readRow(t, ctx, env.Table, mainKey), schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken, 1)
+		_, err = r.ValidateToken(ctx, current)
+		assert.NoError(t, err)
+	})
+
+	t.Run("deregistering revokes every token", func(t *testing.T) {
+		token, _, err := r.IssueToken(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Deregister(ctx, d.AID, appk))
+		_, err = r.ValidateToken(ctx, token)
+		assert.IsError(t, err, access.ErrTokenRevoked)
+		btetest.AssertNoColumn(t, readRow(t, ctx, env.Table, mainKey), schema.ColumnFamilyDeviceProperties, schema.ColumnAuthToken)
+	})
+}
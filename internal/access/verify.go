@@ -0,0 +1,107 @@
+package access
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var ErrBadDeviceKey = errors.New("device key is not an ed25519 or ECDSA P-256 public key")
+
+// ParsePublicKey reads a device key. An ed25519 key may be given as its 32
+// bytes in hex; either kind may be given as a PKIX public key, PEM-encoded or
+// as base64 DER.
+func ParsePublicKey(key string) (crypto.PublicKey, error) {
+	if len(key) == 2*ed25519.PublicKeySize {
+		if b, err := hex.DecodeString(key); err == nil {
+			return ed25519.PublicKey(b), nil
+		}
+	}
+	var der []byte
+	if block, _ := pem.Decode([]byte(key)); block != nil && block.Type == "PUBLIC KEY" {
+		der = block.Bytes
+	} else if b, err := base64.StdEncoding.DecodeString(key); err == nil {
+		der = b
+	} else {
+		return nil, ErrBadDeviceKey
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadDeviceKey, err)
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: got %T", ErrBadDeviceKey, pub)
+}
+
+// EncodePublicKey gives the device key for pub: hex for ed25519 and base64 PKIX DER
+// for ECDSA P-256.
+func EncodePublicKey(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return hex.EncodeToString(k), nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			break
+		}
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(der), nil
+	}
+	return "", fmt.Errorf("%w: got %T", ErrBadDeviceKey, pub)
+}
+
+// SignChallenge answers a challenge the way Complete expects: the signature
+// of the challenge string, in base64. ECDSA signs its SHA-256 digest.
+func SignChallenge(key crypto.Signer, challenge string) (string, error) {
+	var (
+		sig []byte
+		err error
+	)
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = key.Sign(rand.Reader, []byte(challenge), crypto.Hash(0))
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256([]byte(challenge))
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		err = fmt.Errorf("%w: got %T", ErrBadDeviceKey, key.Public())
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// verifyResponse checks response is pub's signature of challenge.
+func verifyResponse(pub crypto.PublicKey, challenge, response string) bool {
+	sig, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return false
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, []byte(challenge), sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256([]byte(challenge))
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package access_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func newDeviceKey(t testing.TB) (crypto.Signer, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	pub, err := access.EncodePublicKey(key.Public())
+	assert.NoError(t, err)
+	return key, pub
+}
+
+func newAppK(t testing.TB) string {
+	t.Helper()
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	assert.NoError(t, err)
+	return hex.EncodeToString(b)
+}
+
+// someDeviceKey is for devices whose challenge is never answered.
+var someDeviceKey = hex.EncodeToString(build.DeviceKey("some-device").Public().(ed25519.PublicKey))
+
+func sign(t testing.TB, key crypto.Signer, challenge string) string {
+	t.Helper()
+	response, err := access.SignChallenge(key, challenge)
+	assert.NoError(t, err)
+	return response
+}
+
+func TestParsePublicKey(t *testing.T) {
+	t.Parallel()
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+
+	for _, pub := range []crypto.PublicKey{edPub, &ecKey.PublicKey} {
+		enc, err := access.EncodePublicKey(pub)
+		assert.NoError(t, err)
+		got, err := access.ParsePublicKey(enc)
+		assert.NoError(t, err)
+		assert.True(t, pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(got), "%T", pub)
+
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		assert.NoError(t, err)
+		got, err = access.ParsePublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+		assert.NoError(t, err)
+		assert.True(t, pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(got), "%T as PEM", pub)
+	}
+
+	_, err = access.EncodePublicKey(&p384.PublicKey)
+	assert.IsError(t, err, access.ErrBadDeviceKey)
+	der, err := x509.MarshalPKIXPublicKey(&p384.PublicKey)
+	assert.NoError(t, err)
+	_, err = access.ParsePublicKey(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	assert.IsError(t, err, access.ErrBadDeviceKey)
+	_, err = access.ParsePublicKey("appk-in-flight")
+	assert.IsError(t, err, access.ErrBadDeviceKey)
+}
+
+func TestCompleteVerifiesResponse(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock, ChallengeTTL: time.Minute}
+
+	const appk = "appk-verify"
+	edKey, edDeviceKey := newDeviceKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecDeviceKey, err := access.EncodePublicKey(ecKey.Public())
+	assert.NoError(t, err)
+
+	register := func(d schema.DeviceEntry, deviceKey string) string {
+		t.Helper()
+		insertPairing(t, ctx, d, env.Table)
+		_, err := r.Register(ctx, d.AID, appk, deviceKey, "software")
+		assert.NoError(t, err)
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		return challenge
+	}
+
+	t.Run("ed25519 and ECDSA P-256", func(t *testing.T) {
+		ed := schema.DeviceEntry{AID: "561ws-z3po9-dbyi4-3hpxq-hmit6", QID: "qid-verify", DID: "did-ed25519"}
+		ec := schema.DeviceEntry{AID: "eraca-iuk5a-c3bb6-gkphf-17urc", QID: "qid-verify", DID: "did-ecdsa"}
+		edChallenge := register(ed, edDeviceKey)
+		ecChallenge := register(ec, ecDeviceKey)
+
+		// Each device's response is only good for its own challenge and key.
+		assert.IsError(t, r.Complete(ctx, ed.AID, appk, sign(t, edKey, ecChallenge)), access.ErrBadResponse)
+		assert.IsError(t, r.Complete(ctx, ec.AID, appk, sign(t, edKey, ecChallenge)), access.ErrBadResponse)
+		assert.NoError(t, r.Complete(ctx, ed.AID, appk, sign(t, edKey, edChallenge)))
+		assert.NoError(t, r.Complete(ctx, ec.AID, appk, sign(t, ecKey, ecChallenge)))
+
+		row := readRow(t, ctx, env.Table, ec.QID+"#"+ec.DID)
+		btetest.AssertNoColumn(t, row, schema.ColumnFamilyRegistrationProperties, schema.ColumnChallengeExpiry)
+		btetest.AssertColumns(t, row, btetest.Cells{"RegistrationProperties:Challenge": ecChallenge})
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "z1g1x-f3r9q-gxixk-pehyr-5shgo", QID: "qid-verify", DID: "did-expired"}
+		challenge := register(d, edDeviceKey)
+		env.Clock.Advance(time.Minute)
+		assert.IsError(t, r.Complete(ctx, d.AID, appk, sign(t, edKey, challenge)), access.ErrChallengeExpired)
+
+		challenge, err := r.IssueChallenge(ctx, d.AID, appk)
+		assert.NoError(t, err)
+		env.Clock.Advance(time.Minute - time.Millisecond)
+		assert.NoError(t, r.Complete(ctx, d.AID, appk, sign(t, edKey, challenge)))
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "ta58m-id1xa-b3ik6-7tqzk-r86cb", QID: "qid-verify", DID: "did-replayed"}
+		challenge := register(d, edDeviceKey)
+		response := sign(t, edKey, challenge)
+		assert.NoError(t, r.Complete(ctx, d.AID, appk, response))
+
+		// Even with the registration gone, the answered challenge cannot be
+		// used again.
+		undo := bigtable.NewMutation()
+		undo.DeleteCellsInColumn(schema.ColumnFamilyRegistrationProperties, schema.ColumnRegistered)
+		assert.NoError(t, env.Table.Apply(ctx, d.QID+"#"+d.DID, undo))
+		assert.IsError(t, r.Complete(ctx, d.AID, appk, response), access.ErrChallengeReplayed)
+	})
+
+	t.Run("device key that is not a key", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "pp1xw-dwuyr-htzum-9jo45-uktxw", QID: "qid-verify", DID: "did-not-a-key"}
+		insertPairing(t, ctx, d, env.Table)
+		_, err := r.Register(ctx, d.AID, appk, "appk-not-a-key", "software")
+		assert.IsError(t, err, access.ErrBadDeviceKey)
+	})
+
+	t.Run("the device key does not stand in for the AppK", func(t *testing.T) {
+		d := schema.DeviceEntry{AID: "sgfz1-9f15f-wnebf-8u991-pu9rr", QID: "qid-verify", DID: "did-public"}
+		challenge := register(d, edDeviceKey)
+		assert.IsError(t, r.Complete(ctx, d.AID, edDeviceKey, sign(t, edKey, challenge)), access.ErrWrongAppK)
+		assert.IsError(t, r.Abort(ctx, d.AID, edDeviceKey), access.ErrWrongAppK)
+		assert.IsError(t, r.Deregister(ctx, d.AID, edDeviceKey), access.ErrWrongAppK)
+	})
+}
+
+func TestFixturesComplete(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.ScenarioFixtures)
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock}
+	// The in-flight fixture was claimed as hardware and not yet attested.
+	response := sign(t, build.DeviceKey("did-in-flight"), "challenge")
+	assert.IsError(t, r.Complete(ctx, "hky85-8y73a-uk6yg-ko8kx-hrqn3", "appk-in-flight", response), access.ErrNoAttestation)
+	state, _, err := access.GetState(ctx, env.Table, "hky85-8y73a-uk6yg-ko8kx-hrqn3")
+	assert.NoError(t, err)
+	assert.Equal(t, access.StateInFlight, state)
+	assert.NoError(t, r.Deregister(ctx, "ayrt8-abkcx-1c6w3-pucsq-fyz4a", "appk-already-registered"))
+}
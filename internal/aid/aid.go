@@ -0,0 +1,136 @@
+// Package aid generates and validates adoption IDs.
+//
+// An AID is 25 characters of z-base-32 written in five groups of five, such
+// as wyszz-ty4ey-eqgtc-ae44e-47yjg. AIDs issued here carry 120 random bits in
+// the first 24 characters and a Luhn mod 32 check character in the last, so
+// ParseChecked catches any single mistyped character and almost any swapped
+// pair. AIDs already in use were issued without one, so Parse, which lookups
+// use, only checks the format.
+package aid
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"strings"
+)
+
+// Alphabet is z-base-32, which leaves out the easily confused 0, l, v and 2.
+const Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+const (
+	groups    = 5
+	groupLen  = 5
+	Len       = groups * groupLen
+	payload   = Len - 1
+	separator = "-"
+)
+
+var (
+	ErrLength    = errors.New("AID must have 25 characters")
+	ErrCharacter = errors.New("AID has a character outside z-base-32")
+	ErrChecksum  = errors.New("AID check character does not match")
+)
+
+// confusables maps characters people type by mistake to the z-base-32
+// character they almost certainly meant.
+var confusables = map[rune]rune{'0': 'o', 'l': '1', 'v': 'u', '2': 'z'}
+
+// Encode formats 120 bits as an AID.
+func Encode(b [15]byte) string {
+	var s strings.Builder
+	var acc uint32
+	bits := 0
+	for _, c := range b {
+		acc = acc<<8 | uint32(c)
+		for bits += 8; bits >= 5; bits -= 5 {
+			s.WriteByte(Alphabet[acc>>(bits-5)&31])
+		}
+	}
+	return format(s.String() + string(Alphabet[check(s.String())]))
+}
+
+// New returns a cryptographically random AID.
+func New() (string, error) {
+	return read(rand.Reader)
+}
+
+// Generate returns an AID drawn from rng, for reproducible test data.
+func Generate(rng *mrand.Rand) string {
+	s, _ := read(rng)
+	return s
+}
+
+func read(r io.Reader) (string, error) {
+	var b [15]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", fmt.Errorf("could not generate AID: %v", err)
+	}
+	return Encode(b), nil
+}
+
+// Parse returns the canonical form of an AID typed by a person. Case and
+// separators are ignored and confusable characters are corrected. The check
+// character is not verified; see ParseChecked.
+func Parse(s string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch r {
+		case '-', ' ', '_', '.':
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		if !strings.ContainsRune(Alphabet, r) {
+			return "", fmt.Errorf("%w: %q in %q", ErrCharacter, r, s)
+		}
+		b.WriteRune(r)
+	}
+	plain := b.String()
+	if len(plain) != Len {
+		return "", fmt.Errorf("%w: %q has %d", ErrLength, s, len(plain))
+	}
+	return format(plain), nil
+}
+
+// ParseChecked is Parse for AIDs being issued or taken in, which must also
+// have a matching check character.
+func ParseChecked(s string) (string, error) {
+	id, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	plain := strings.ReplaceAll(id, separator, "")
+	if Alphabet[check(plain[:payload])] != plain[payload] {
+		return "", fmt.Errorf("%w: %q", ErrChecksum, s)
+	}
+	return id, nil
+}
+
+// Valid reports whether s is a checked AID in canonical form.
+func Valid(s string) bool {
+	p, err := ParseChecked(s)
+	return err == nil && p == s
+}
+
+// check is the Luhn mod 32 check character index for s.
+func check(s string) int {
+	sum, factor := 0, 2
+	for i := len(s) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(Alphabet, s[i])
+		sum += addend/len(Alphabet) + addend%len(Alphabet)
+		factor = 3 - factor
+	}
+	return (len(Alphabet) - sum%len(Alphabet)) % len(Alphabet)
+}
+
+func format(plain string) string {
+	parts := make([]string, 0, groups)
+	for i := 0; i < Len; i += groupLen {
+		parts = append(parts, plain[i:i+groupLen])
+	}
+	return strings.Join(parts, separator)
+}
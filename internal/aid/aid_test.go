@@ -0,0 +1,87 @@
+package aid_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+)
+
+const (
+	// mcCoy was issued before AIDs had check characters.
+	mcCoy   = "wyszz-ty4ey-eqgtc-ae44e-47yjg"
+	checked = "km69a-b3boj-1w6ft-9mh83-wao7m"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	for _, in := range []string{
+		mcCoy,
+		"WYSZZ-TY4EY-EQGTC-AE44E-47YJG",
+		"wyszzty4eyeqgtcae44e47yjg",
+		" wyszz ty4ey eqgtc ae44e 47yjg ",
+		"wyszz_ty4ey.eqgtc-ae44e-47yjg",
+	} {
+		got, err := aid.Parse(in)
+		assert.NoError(t, err, "%q", in)
+		assert.Equal(t, mcCoy, got)
+	}
+
+	// 0, l, v and 2 are read as o, 1, u and z.
+	got, err := aid.Parse("km69a-b3b0j-lw6ft-9mh83-wa07m")
+	assert.NoError(t, err)
+	assert.Equal(t, checked, got)
+
+	_, err = aid.Parse("wyszz-ty4ey-eqgtc-ae44e-47yj")
+	assert.IsError(t, err, aid.ErrLength)
+	_, err = aid.Parse("aid-1")
+	assert.IsError(t, err, aid.ErrLength)
+	_, err = aid.Parse("wyszz-ty4ey-eqgtc-ae44e-47yj!")
+	assert.IsError(t, err, aid.ErrCharacter)
+}
+
+func TestParseChecked(t *testing.T) {
+	t.Parallel()
+	got, err := aid.ParseChecked("KM69A B3B0J LW6FT 9MH83 WA07M")
+	assert.NoError(t, err)
+	assert.Equal(t, checked, got)
+	_, err = aid.ParseChecked(mcCoy)
+	assert.IsError(t, err, aid.ErrChecksum)
+	_, err = aid.ParseChecked("aid-1")
+	assert.IsError(t, err, aid.ErrLength)
+}
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		s := aid.Generate(rng)
+		assert.True(t, aid.Valid(s), "%q", s)
+	}
+	assert.Equal(t, aid.Generate(rand.New(rand.NewSource(1))), aid.Generate(rand.New(rand.NewSource(1))))
+
+	s, err := aid.New()
+	assert.NoError(t, err)
+	assert.True(t, aid.Valid(s), "%q", s)
+	assert.False(t, aid.Valid("KM69A-B3BOJ-1W6FT-9MH83-WAO7M"))
+	assert.False(t, aid.Valid(mcCoy))
+}
+
+func TestSingleSubstitutionsAreCaught(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < len(checked); i++ {
+		if checked[i] == '-' {
+			continue
+		}
+		for _, c := range []byte(aid.Alphabet) {
+			if c == checked[i] {
+				continue
+			}
+			typo := checked[:i] + string(c) + checked[i+1:]
+			_, err := aid.ParseChecked(typo)
+			assert.IsError(t, err, aid.ErrChecksum, "%q", typo)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package bench seeds a synthetic registration pool and measures the access
+// layer against it.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+type Op string
+
+const (
+	OpReadAidRow         Op = "read-aid-row"
+	OpGetAppK            Op = "get-appk"
+	OpPairedUnregistered Op = "paired-unregistered"
+)
+
+// Key layouts and access distributions for Config.
+const (
+	KeysSequential = "sequential"
+	KeysRandom     = "random"
+	AccessUniform  = "uniform"
+	AccessZipf     = "zipf"
+)
+
+const bulkChunk = 1000
+
+var Ops = []Op{OpReadAidRow, OpGetAppK, OpPairedUnregistered}
+
+type Config struct {
+	PoolSize int
+	// Keys is how pool AIDs are laid out: "sequential" AIDs sort together,
+	// "random" ones are spread across the key space.
+	Keys string
+	// ClaimedRate is the fraction of pool rows seeded with an AppK.
+	ClaimedRate float64
+	// Access is how the AIDs to look up are picked: "uniform" or "zipf" for
+	// a few hot AIDs.
+	Access      string
+	Mix         map[Op]int
+	Concurrency int
+	Duration    time.Duration
+	Seed        int64
+}
+
+// Validate checks cfg describes a run that can go ahead.
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.PoolSize <= 0:
+		return fmt.Errorf("pool size must be positive, got %d", cfg.PoolSize)
+	case cfg.Keys != KeysSequential && cfg.Keys != KeysRandom:
+		return fmt.Errorf("unknown key layout %q", cfg.Keys)
+	case cfg.Access != AccessUniform && cfg.Access != AccessZipf:
+		return fmt.Errorf("unknown access distribution %q", cfg.Access)
+	case cfg.ClaimedRate < 0 || cfg.ClaimedRate > 1:
+		return fmt.Errorf("claimed rate must be between 0 and 1, got %g", cfg.ClaimedRate)
+	case cfg.Concurrency <= 0:
+		return fmt.Errorf("concurrency must be positive, got %d", cfg.Concurrency)
+	case cfg.Duration <= 0:
+		return fmt.Errorf("duration must be positive, got %s", cfg.Duration)
+	}
+	total := 0
+	for _, w := range cfg.Mix {
+		total += w
+	}
+	if total == 0 {
+		return errors.New("mix has no operations with a positive weight")
+	}
+	return nil
+}
+
+// ParseMix reads an operation mix such as "read-aid-row=2,get-appk=1".
+func ParseMix(s string) (map[Op]int, error) {
+	mix := make(map[Op]int)
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(part, "=")
+		if !ok {
+			weight = "1"
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("bad weight in %q", part)
+		}
+		op := Op(strings.TrimSpace(name))
+		known := false
+		for _, o := range Ops {
+			known = known || o == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		mix[op] = w
+	}
+	return mix, nil
+}
+
+// Pool is a synthetic registration pool.
+type Pool struct {
+	AIDs     []string
+	PoolKeys []string
+	// Claimed marks the pool rows that hold an AppK.
+	Claimed []bool
+}
+
+// Layout decides the AIDs, keys and claims of the pool cfg describes. The
+// same cfg always gives the same pool.
+func Layout(cfg Config) *Pool {
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	pool := &Pool{}
+	for i := 0; i < cfg.PoolSize; i++ {
+		// Sequential AIDs share a prefix, so their rows sit together.
+		var b [15]byte
+		binary.BigEndian.PutUint64(b[7:], uint64(i))
+		id := aid.Encode(b)
+		if cfg.Keys == KeysRandom {
+			id = aid.Generate(rng)
+		}
+		key := access.RPKey{AID: id, MainKey: access.MainKey{
+			QID: fmt.Sprintf("bench-qid-%06d", i/8),
+			DID: fmt.Sprintf("bench-did-%08d", i),
+		}}.String()
+		pool.AIDs = append(pool.AIDs, id)
+		pool.PoolKeys = append(pool.PoolKeys, key)
+		pool.Claimed = append(pool.Claimed, rng.Float64() < cfg.ClaimedRate)
+	}
+	return pool
+}
+
+// Seed lays out the pool cfg describes and writes it to tbl.
+func Seed(ctx context.Context, tbl *bigtable.Table, clk clock.Clock, cfg Config) (*Pool, error) {
+	pool := Layout(cfg)
+	return pool, pool.Write(ctx, tbl, clk)
+}
+
+func (p *Pool) Write(ctx context.Context, tbl *bigtable.Table, clk clock.Clock) error {
+	now := clock.Or(clk).Now()
+	ts := bigtable.Time(now)
+	muts := make([]*bigtable.Mutation, len(p.PoolKeys))
+	for i := range p.PoolKeys {
+		muts[i] = bigtable.NewMutation()
+		muts[i].DeleteRow()
+		muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, []byte(now.Format(time.UnixDate)))
+		if p.Claimed[i] {
+			muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, ts, []byte("bench-appk-"+p.AIDs[i]))
+		}
+	}
+	for start := 0; start < len(muts); start += bulkChunk {
+		end := min(start+bulkChunk, len(muts))
+		rowErrs, err := tbl.ApplyBulk(ctx, p.PoolKeys[start:end], muts[start:end])
+		if err != nil {
+			return fmt.Errorf("could not seed pool: %v", err)
+		}
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				return fmt.Errorf("could not seed %s: %v", p.PoolKeys[start+i], rowErr)
+			}
+		}
+	}
+	return nil
+}
+
+// Do runs one operation against the i'th pool row.
+func (p *Pool) Do(ctx context.Context, tbl *bigtable.Table, op Op, i int) error {
+	var err error
+	switch op {
+	case OpReadAidRow:
+		_, err = access.ReadAidRow(ctx, tbl, p.AIDs[i])
+	case OpGetAppK:
+		_, err = access.GetAppK(ctx, tbl, p.PoolKeys[i])
+		if errors.Is(err, access.ErrNoAppK) {
+			err = nil
+		}
+	case OpPairedUnregistered:
+		_, _, err = access.AidIsPairedAndUnregistered(ctx, tbl, p.AIDs[i])
+		if errors.Is(err, access.ErrUnexpectedAppK) {
+			err = nil
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", op)
+	}
+	return err
+}
+
+type Stats struct {
+	Op         Op
+	Count      int
+	Errors     int
+	Throughput float64
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+}
+
+// Run issues the configured mix of operations from cfg.Concurrency workers
+// until cfg.Duration has passed.
+func Run(ctx context.Context, tbl *bigtable.Table, pool *Pool, cfg Config) ([]Stats, error) {
+	var ops []Op
+	for _, op := range Ops {
+		for w := 0; w < cfg.Mix[op]; w++ {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("operation mix is empty")
+	}
+	if len(pool.AIDs) == 0 {
+		return nil, fmt.Errorf("pool is empty")
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		latencies = make(map[Op][]time.Duration)
+		errCounts = make(map[Op]int)
+	)
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	for w := 0; w < max(cfg.Concurrency, 1); w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(cfg.Seed + int64(w) + 1))
+			pick := picker(rng, cfg.Access, len(pool.AIDs))
+			local := make(map[Op][]time.Duration)
+			localErrs := make(map[Op]int)
+			for time.Now().Before(deadline) && ctx.Err() == nil {
+				op := ops[rng.Intn(len(ops))]
+				began := time.Now()
+				err := pool.Do(ctx, tbl, op, pick())
+				local[op] = append(local[op], time.Since(began))
+				if err != nil {
+					localErrs[op]++
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for op, ds := range local {
+				latencies[op] = append(latencies[op], ds...)
+				errCounts[op] += localErrs[op]
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var stats []Stats
+	for _, op := range Ops {
+		ds := latencies[op]
+		if len(ds) == 0 {
+			continue
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		stats = append(stats, Stats{
+			Op:         op,
+			Count:      len(ds),
+			Errors:     errCounts[op],
+			Throughput: float64(len(ds)) / elapsed.Seconds(),
+			P50:        percentile(ds, 50),
+			P95:        percentile(ds, 95),
+			P99:        percentile(ds, 99),
+		})
+	}
+	return stats, ctx.Err()
+}
+
+func picker(rng *rand.Rand, dist string, n int) func() int {
+	if dist == AccessZipf && n > 1 {
+		z := rand.NewZipf(rng, 1.1, 1, uint64(n-1))
+		return func() int { return int(z.Uint64()) }
+	}
+	return func() int { return rng.Intn(n) }
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i-1, 0)]
+}
@@ -0,0 +1,36 @@
+package bench_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/bench"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := bench.Config{
+		PoolSize:    10,
+		Keys:        bench.KeysSequential,
+		ClaimedRate: 0.5,
+		Access:      bench.AccessUniform,
+		Mix:         map[bench.Op]int{bench.OpGetAppK: 1},
+		Concurrency: 1,
+		Duration:    time.Second,
+	}
+	assert.NoError(t, valid.Validate())
+	for name, change := range map[string]func(*bench.Config){
+		"empty pool":       func(c *bench.Config) { c.PoolSize = 0 },
+		"unknown keys":     func(c *bench.Config) { c.Keys = "" },
+		"unknown access":   func(c *bench.Config) { c.Access = "hot" },
+		"negative claimed": func(c *bench.Config) { c.ClaimedRate = -1 },
+		"no callers":       func(c *bench.Config) { c.Concurrency = -2 },
+		"no duration":      func(c *bench.Config) { c.Duration = 0 },
+		"all weights zero": func(c *bench.Config) { c.Mix = map[bench.Op]int{bench.OpGetAppK: 0} },
+	} {
+		cfg := valid
+		change(&cfg)
+		assert.Error(t, cfg.Validate(), name)
+	}
+}
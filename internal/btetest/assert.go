@@ -0,0 +1,133 @@
+package btetest
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// Cells maps family:column to the value expected in its latest cell.
+type Cells map[string]string
+
+// AssertColumns checks the latest value of each column in want. On failure it
+// shows both sides decoded through the schema registry, one column per line.
+func AssertColumns(t testing.TB, row bigtable.Row, want Cells) {
+	t.Helper()
+	var wantLines, gotLines []string
+	for column, value := range want {
+		family, name := schema.SplitColumn(column)
+		wantLines = append(wantLines, fmt.Sprintf("%s = %s", column, schema.DecodeValue(family, name, []byte(value))))
+		got := "<missing>"
+		if item, ok := latest(row, family, name); ok {
+			got = schema.DecodeValue(family, name, item.Value)
+		}
+		gotLines = append(gotLines, fmt.Sprintf("%s = %s", column, got))
+	}
+	sort.Strings(wantLines)
+	sort.Strings(gotLines)
+	assert.Equal(t, strings.Join(wantLines, "\n"), strings.Join(gotLines, "\n"), "row %s", row.Key())
+}
+
+// AssertNoColumn checks that row holds no cells in family:column.
+func AssertNoColumn(t testing.TB, row bigtable.Row, family, column string) {
+	t.Helper()
+	if item, ok := latest(row, family, column); ok {
+		t.Fatalf("row %s: expected no %s:%s, found %s", row.Key(), family, column,
+			schema.DecodeValue(family, column, item.Value))
+	}
+}
+
+// AssertVersions checks how many cell versions family:column holds.
+func AssertVersions(t testing.TB, row bigtable.Row, family, column string, want int) {
+	t.Helper()
+	var got []string
+	for _, item := range row[family] {
+		if item.Column == family+":"+column {
+			got = append(got, formatCell(item))
+		}
+	}
+	if len(got) != want {
+		t.Fatalf("row %s: expected %d versions of %s:%s, found %d:\n%s", row.Key(), want, family, column,
+			len(got), strings.Join(got, "\n"))
+	}
+}
+
+var update = flag.Bool("update", false, "Rewrite golden files with the current table contents instead of comparing.")
+
+// AssertGolden checks the whole table against a golden dump written by Dump.
+// Run the tests with -update to rewrite the golden file instead.
+func AssertGolden(t testing.TB, tbl *bigtable.Table, path string) {
+	t.Helper()
+	got, err := Dump(context.Background(), tbl)
+	assert.NoError(t, err)
+	if *update {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(got), 0o644))
+		return
+	}
+	want, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), got, "golden file %s", path)
+}
+
+// Dump renders every cell in tbl in a canonical, decoded form: rows in key
+// order, then columns in name order, then versions newest first.
+//
+//	aid-1#qid-1#did-1
+//	  DeviceProperties:CreatedDate @2023-10-01T12:00:00.000Z = 2023-10-01T12:00:00Z
+func Dump(ctx context.Context, tbl *bigtable.Table) (string, error) {
+	var b strings.Builder
+	err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		b.WriteString(row.Key())
+		b.WriteString("\n")
+		var items []bigtable.ReadItem
+		for _, family := range row {
+			items = append(items, family...)
+		}
+		sort.SliceStable(items, func(i, j int) bool {
+			if items[i].Column != items[j].Column {
+				return items[i].Column < items[j].Column
+			}
+			return items[i].Timestamp > items[j].Timestamp
+		})
+		for _, item := range items {
+			b.WriteString("  ")
+			b.WriteString(formatCell(item))
+			b.WriteString("\n")
+		}
+		return true
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not dump table: %v", err)
+	}
+	return b.String(), nil
+}
+
+func formatCell(item bigtable.ReadItem) string {
+	family, name := schema.SplitColumn(item.Column)
+	ts := item.Timestamp.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	return fmt.Sprintf("%s @%s = %s", item.Column, ts, schema.DecodeValue(family, name, item.Value))
+}
+
+func latest(row bigtable.Row, family, column string) (bigtable.ReadItem, bool) {
+	var (
+		found bigtable.ReadItem
+		ok    bool
+	)
+	for _, item := range row[family] {
+		if item.Column == family+":"+column && (!ok || item.Timestamp > found.Timestamp) {
+			found, ok = item, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,126 @@
+// Package btetest gives each test its own freshly created and seeded table.
+//
+// Tests run against the emulator named by BIGTABLE_EMULATOR_HOST when it is
+// set, and otherwise against an in-process emulator shared by the test
+// binary. Either way every table is uniquely named and deleted when the test
+// finishes, so tests can call t.Parallel.
+package btetest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// Epoch is the time the fake clock of every Env starts at.
+var Epoch = time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+
+type Env struct {
+	*build.BTClient
+	Admin     *bigtable.AdminClient
+	TableName string
+	Clock     *clock.Fake
+	// Addr is the emulator address of an Env from NewIsolated.
+	Addr string
+}
+
+var (
+	tableSeq   atomic.Int64
+	serverOnce sync.Once
+	serverAddr string
+	serverErr  error
+)
+
+// New creates a table with the schema's column families, seeds it with the
+// given build scenarios using a fake clock set to Epoch, and deletes it when
+// the test ends.
+func New(t testing.TB, scenarios ...string) *Env {
+	t.Helper()
+	opts, err := clientOptions()
+	if err != nil {
+		t.Fatalf("Could not start emulator: %v", err)
+	}
+	return newEnv(t, opts, scenarios)
+}
+
+// NewIsolated is New on an in-process emulator of the test's own, for tests
+// that need two separate emulators, such as a source and a destination.
+func NewIsolated(t testing.TB, scenarios ...string) *Env {
+	t.Helper()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("Could not start emulator: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	env := newEnv(t, build.EmulatorOptions(srv.Addr), scenarios)
+	env.Addr = srv.Addr
+	return env
+}
+
+func newEnv(t testing.TB, opts []option.ClientOption, scenarios []string) *Env {
+	t.Helper()
+	ctx := context.Background()
+	admin, err := bigtable.NewAdminClient(ctx, schema.Project, schema.Instance, opts...)
+	if err != nil {
+		t.Fatalf("Could not create admin client: %v", err)
+	}
+	client, err := bigtable.NewClient(ctx, schema.Project, schema.Instance, opts...)
+	if err != nil {
+		t.Fatalf("Could not create data operations client: %v", err)
+	}
+
+	name := fmt.Sprintf("%s-%d-%d", schema.TableName, os.Getpid(), tableSeq.Add(1))
+	if err := build.CreateTable(ctx, admin, name); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Env{
+		BTClient:  &build.BTClient{Client: client, Table: client.Open(name)},
+		Admin:     admin,
+		TableName: name,
+		Clock:     clock.NewFake(Epoch),
+	}
+	t.Cleanup(func() {
+		if err := admin.DeleteTable(ctx, name); err != nil {
+			t.Errorf("Could not delete table %s: %v", name, err)
+		}
+		client.Close()
+		admin.Close()
+	})
+
+	if err := build.Seed(ctx, env.Table, env.Clock, scenarios...); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// clientOptions connects to BIGTABLE_EMULATOR_HOST if it is set, which the
+// bigtable package does by itself, or else to the in-process emulator.
+func clientOptions() ([]option.ClientOption, error) {
+	if os.Getenv("BIGTABLE_EMULATOR_HOST") != "" {
+		return nil, nil
+	}
+	serverOnce.Do(func() {
+		var srv *bttest.Server
+		srv, serverErr = bttest.NewServer("localhost:0")
+		if serverErr == nil {
+			serverAddr = srv.Addr
+		}
+	})
+	if serverErr != nil {
+		return nil, serverErr
+	}
+	return build.EmulatorOptions(serverAddr), nil
+}
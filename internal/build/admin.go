@@ -2,6 +2,7 @@ package build
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"cloud.google.com/go/bigtable"
@@ -15,30 +16,39 @@ func DoAdmin(ctx context.Context, project, instance string) *bigtable.AdminClien
 		log.Fatalf("Could not create admin client: %v", err)
 	}
 
+	if err := CreateTable(ctx, adminClient, schema.TableName); err != nil {
+		log.Fatalf("Could not set up table: %v", err)
+	}
+
+	return adminClient
+}
+
+// CreateTable creates the named table with the schema's column families,
+// adding whatever is missing if the table already exists.
+func CreateTable(ctx context.Context, adminClient *bigtable.AdminClient, name string) error {
 	tables, err := adminClient.Tables(ctx)
 	if err != nil {
-		log.Fatalf("Could not fetch table list: %v", err)
+		return fmt.Errorf("could not fetch table list: %v", err)
 	}
-	if !util.SliceContains(tables, schema.TableName) {
-		log.Printf("Creating table %s", schema.TableName)
-		if err := adminClient.CreateTable(ctx, schema.TableName); err != nil {
-			log.Fatalf("Could not create table %s: %v", schema.TableName, err)
+	if !util.SliceContains(tables, name) {
+		log.Printf("Creating table %s", name)
+		if err := adminClient.CreateTable(ctx, name); err != nil {
+			return fmt.Errorf("could not create table %s: %v", name, err)
 		}
 	}
 
 	// Make column families
-	tblInfo, err := adminClient.TableInfo(ctx, schema.TableName)
+	tblInfo, err := adminClient.TableInfo(ctx, name)
 	if err != nil {
-		log.Fatalf("Could not read info for table %s: %v", schema.TableName, err)
+		return fmt.Errorf("could not read info for table %s: %v", name, err)
 	}
 
 	for _, family := range schema.ColumnFamilies {
 		if !util.SliceContains(tblInfo.Families, family) {
-			if err := adminClient.CreateColumnFamily(ctx, schema.TableName, family); err != nil {
-				log.Fatalf("Could not create column family %s: %v", family, err)
+			if err := adminClient.CreateColumnFamily(ctx, name, family); err != nil {
+				return fmt.Errorf("could not create column family %s: %v", family, err)
 			}
 		}
 	}
-
-	return adminClient
+	return nil
 }
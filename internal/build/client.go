@@ -2,72 +2,71 @@ package build
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"strconv"
 	"time"
 
 	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
 	"github.com/theotheradamsmith/btemulator/internal/schema"
 )
 
-func makeMain(ctx context.Context, tbl *bigtable.Table) []string {
+func makeMain(ctx context.Context, tbl *bigtable.Table, clk clock.Clock) error {
 	muts := make([]*bigtable.Mutation, len(schema.Devices))
 	rowKeys := make([]string, len(schema.Devices))
 
-	timestamp := bigtable.Now()
+	now := clk.Now()
+	timestamp := bigtable.Time(now)
 
 	for i, d := range schema.Devices {
 		muts[i] = bigtable.NewMutation()
 		muts[i].DeleteCellsInFamily(schema.ColumnFamilyFirebaseProperties)
 		muts[i].DeleteCellsInFamily(schema.ColumnFamilyDeviceProperties)
 		muts[i].Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, timestamp, []byte(d.FCM))
-		muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, timestamp, []byte(bigtable.Now().Time().Format(time.UnixDate)))
+		muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, timestamp, []byte(now.Format(time.UnixDate)))
 		muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, timestamp, []byte(d.DID))
 		rowKeys[i] = fmt.Sprintf("%s#%s", d.QID, d.DID)
 	}
 
-	log.Println("Applying bulk changes...")
-
-	rowErrs, err := tbl.ApplyBulk(ctx, rowKeys, muts)
-	if err != nil {
-		log.Fatalf("Could not apply bulk row mutation: %v", err)
-	}
-	if rowErrs != nil {
-		for _, rowErr := range rowErrs {
-			log.Printf("Error writing row: %v", rowErr)
-		}
-		log.Fatalf("Could not write some rows")
-	}
-	return rowKeys
+	return applyBulk(ctx, tbl, rowKeys, muts)
 }
 
-func makeAID(ctx context.Context, tbl *bigtable.Table) []string {
+func makeAID(ctx context.Context, tbl *bigtable.Table, clk clock.Clock) error {
 	muts := make([]*bigtable.Mutation, len(schema.Devices))
 	rowKeys := make([]string, len(schema.Devices))
 
+	now := clk.Now()
+
 	for i, d := range schema.Devices {
 		muts[i] = bigtable.NewMutation()
 		muts[i].DeleteCellsInFamily(schema.ColumnFamilyDeviceProperties)
-		muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, bigtable.Now(), []byte(bigtable.Now().Time().Format(time.UnixDate)))
+		muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, bigtable.Time(now), []byte(now.Format(time.UnixDate)))
 		mainkey := fmt.Sprintf("%s#%s#%s", d.AID, d.QID, d.DID)
 		//muts[i].Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, bigtable.Now(), []byte(mainkey))
 		rowKeys[i] = mainkey
 	}
 
+	return applyBulk(ctx, tbl, rowKeys, muts)
+}
+
+func applyBulk(ctx context.Context, tbl *bigtable.Table, rowKeys []string, muts []*bigtable.Mutation) error {
 	log.Println("Applying bulk changes...")
 
 	rowErrs, err := tbl.ApplyBulk(ctx, rowKeys, muts)
 	if err != nil {
-		log.Fatalf("Could not apply bulk row mutation: %v", err)
+		return fmt.Errorf("could not apply bulk row mutation: %v", err)
 	}
-	if rowErrs != nil {
-		for _, rowErr := range rowErrs {
-			log.Printf("Error writing row: %v", rowErr)
+	for i, rowErr := range rowErrs {
+		if rowErr != nil {
+			return fmt.Errorf("could not write row %s: %v", rowKeys[i], rowErr)
 		}
-		log.Fatalf("Could not write some rows")
 	}
-	return rowKeys
+	return nil
 }
 
 type BTClient struct {
@@ -96,7 +95,7 @@ func (b *BTClient) Close() {
 
 }
 
-func DoClient(ctx context.Context, project, instance string) (*bigtable.Client, *bigtable.Table) {
+func DoClient(ctx context.Context, project, instance string, clk clock.Clock) (*bigtable.Client, *bigtable.Table) {
 	client, err := bigtable.NewClient(ctx, project, instance)
 	if err != nil {
 		log.Fatalf("Could not create data operations client: %v", err)
@@ -104,11 +103,9 @@ func DoClient(ctx context.Context, project, instance string) (*bigtable.Client,
 
 	tbl := client.Open(schema.TableName)
 
-	//rowKeys := makeMain(ctx, tbl)
-	_ = makeMain(ctx, tbl)
-	_ = makeAID(ctx, tbl)
-
-	addTestData(ctx)
+	if err := Seed(ctx, tbl, clk, Scenarios...); err != nil {
+		log.Fatalf("Could not seed table: %v", err)
+	}
 
 	/*
 		log.Printf("Getting a single greeting by row key:")
@@ -146,21 +143,23 @@ const (
 	trusted    = "trusted"
 	registered = "registered"
 	challenge  = "challenge"
+	expiry     = "expiry"
+	devkey     = "devkey"
 
 	aidMcCoy = "wyszz-ty4ey-eqgtc-ae44e-47yjg"
 	qidMcCoy = "qid-mccoy"
 	didMcCoy = "did-mccoy"
 
-	aidReady = "aid-ready"
+	aidReady = "oz76q-k5yco-wjybf-fg8hs-xncpo"
 	qidReady = "qid-ready"
 	didReady = "did-ready"
 
-	aidInFlight  = "aid-in-flight"
+	aidInFlight  = "hky85-8y73a-uk6yg-ko8kx-hrqn3"
 	qidInFlight  = "qid-in-flight"
 	didInFlight  = "did-in-flight"
 	appkInFlight = "appk-in-flight"
 
-	aidRegistered  = "aid-already-registered"
+	aidRegistered  = "ayrt8-abkcx-1c6w3-pucsq-fyz4a"
 	qidRegistered  = "qid-already-registered"
 	didRegistered  = "did-already-registered"
 	appkRegistered = "appk-already-registered"
@@ -251,7 +250,8 @@ var (
 	}
 
 	// inFlightX is in the process of being registered; an AppK has been written
-	// to the RP entry and new attempts to register should fail
+	// to the RP entry and new attempts to register should fail. It was claimed
+	// as hardware, so Trusted waits for its attestation
 	inFlightEntry = testEntry{
 		key: fmt.Sprintf("%s#%s", qidInFlight, didInFlight),
 		qid: qidInFlight,
@@ -267,10 +267,10 @@ var (
 				columnName:       schema.ColumnAppK,
 				data:             []byte(appkInFlight),
 			},
-			trusted: {
+			devkey: {
 				columnFamilyName: schema.ColumnFamilyDeviceProperties,
-				columnName:       schema.ColumnTrusted,
-				data:             []byte(hardware),
+				columnName:       schema.ColumnDeviceKey,
+				data:             []byte(publicKey(didInFlight)),
 			},
 			challenge: {
 				columnFamilyName: schema.ColumnFamilyRegistrationProperties,
@@ -302,46 +302,103 @@ var (
 				columnName:       schema.ColumnTrusted,
 				data:             []byte(hardware),
 			},
+			devkey: {
+				columnFamilyName: schema.ColumnFamilyDeviceProperties,
+				columnName:       schema.ColumnDeviceKey,
+				data:             []byte(publicKey(didRegistered)),
+			},
 			challenge: {
 				columnFamilyName: schema.ColumnFamilyRegistrationProperties,
 				columnName:       schema.ColumnChallenge,
 				data:             []byte(challenge),
 			},
-			registered: {
-				columnFamilyName: schema.ColumnFamilyRegistrationProperties,
-				columnName:       schema.ColumnRegistered,
-				data:             []byte(strconv.FormatInt(time.Now().UTC().UnixMilli(), 10)),
-			},
 		},
 	}
 )
 
-func addTestData(ctx context.Context) {
-	client, err := bigtable.NewClient(ctx, schema.Project, schema.Instance)
-	if err != nil {
-		log.Fatalf("Could not create data operations client: %v", err)
+// DeviceKey is the key a synthetic device signs its challenges with. It is
+// derived from the DID, so whoever seeded a device can answer for it.
+func DeviceKey(did string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte(did))
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+func publicKey(did string) string {
+	return hex.EncodeToString(DeviceKey(did).Public().(ed25519.PublicKey))
+}
+
+// markRegistered marks entry as having completed registration at the clock's
+// current time.
+func markRegistered(entry testEntry, clk clock.Clock) testEntry {
+	properties := make(map[string]bigtableDataEntry, len(entry.properties)+1)
+	for k, v := range entry.properties {
+		properties[k] = v
 	}
-	defer client.Close()
+	properties[registered] = bigtableDataEntry{
+		columnFamilyName: schema.ColumnFamilyRegistrationProperties,
+		columnName:       schema.ColumnRegistered,
+		data:             []byte(strconv.FormatInt(clk.Now().UTC().UnixMilli(), 10)),
+	}
+	entry.properties = properties
+	return entry
+}
 
-	tbl := client.Open(schema.TableName)
+// markChallenged gives entry's challenge the expiry IssueChallenge would
+// have given it at the clock's current time.
+func markChallenged(entry testEntry, clk clock.Clock) testEntry {
+	properties := make(map[string]bigtableDataEntry, len(entry.properties)+1)
+	for k, v := range entry.properties {
+		properties[k] = v
+	}
+	properties[expiry] = bigtableDataEntry{
+		columnFamilyName: schema.ColumnFamilyRegistrationProperties,
+		columnName:       schema.ColumnChallengeExpiry,
+		data:             []byte(strconv.FormatInt(clk.Now().Add(access.DefaultChallengeTTL).UTC().UnixMilli(), 10)),
+	}
+	entry.properties = properties
+	return entry
+}
 
+func addTestData(ctx context.Context, tbl *bigtable.Table, clk clock.Clock) error {
 	testEntires := []testEntry{
 		foo1,
 		foo2,
 		foo3,
 		theRealMcCoy,
 		readyEntry,
-		inFlightEntry,
-		registeredEntry,
+		markChallenged(inFlightEntry, clk),
+		markRegistered(registeredEntry, clk),
 	}
 
 	for _, entry := range testEntires {
 		mut := bigtable.NewMutation()
 		mut.DeleteRow()
-		timestamp := bigtable.Now()
+		timestamp := bigtable.Time(clk.Now())
 		for _, v := range entry.properties {
 			mut.Set(v.columnFamilyName, v.columnName, timestamp, v.data)
 		}
-		tbl.Apply(ctx, entry.key, mut)
+		if err := tbl.Apply(ctx, entry.key, mut); err != nil {
+			return fmt.Errorf("could not write row %s: %v", entry.key, err)
+		}
+		// A claimed device's pairing row holds the claim too, so the
+		// appliance can go on to complete or release it.
+		if _, ok := entry.properties[appk]; !ok {
+			continue
+		}
+		pool := bigtable.NewMutation()
+		pool.DeleteRow()
+		pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, timestamp, []byte(clk.Now().Format(time.UnixDate)))
+		for _, name := range []string{appk, trusted} {
+			v, ok := entry.properties[name]
+			if !ok {
+				continue
+			}
+			pool.Set(v.columnFamilyName, v.columnName, timestamp, v.data)
+		}
+		poolKey := string(entry.properties[aid].data) + "#" + entry.key
+		if err := tbl.Apply(ctx, poolKey, pool); err != nil {
+			return fmt.Errorf("could not write row %s: %v", poolKey, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,30 @@
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// EmulatorOptions connects a client to the emulator at addr, overriding
+// BIGTABLE_EMULATOR_HOST, so one process can talk to two emulators.
+func EmulatorOptions(addr string) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// Connect opens the named table with a data client built from opts.
+func Connect(ctx context.Context, project, instance, table string, opts ...option.ClientOption) (*BTClient, error) {
+	client, err := bigtable.NewClient(ctx, project, instance, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create data operations client for %s/%s: %v", project, instance, err)
+	}
+	return &BTClient{Client: client, Table: client.Open(table)}, nil
+}
@@ -0,0 +1,40 @@
+package build
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+)
+
+// Seed scenarios, each a set of rows Seed knows how to write.
+const (
+	// ScenarioDevices is the main and registration pool rows for schema.Devices.
+	ScenarioDevices = "devices"
+	// ScenarioFixtures is the foo, McCoy, ready, in-flight and registered
+	// main rows.
+	ScenarioFixtures = "fixtures"
+)
+
+var Scenarios = []string{ScenarioDevices, ScenarioFixtures}
+
+func Seed(ctx context.Context, tbl *bigtable.Table, clk clock.Clock, scenarios ...string) error {
+	for _, s := range scenarios {
+		var err error
+		switch s {
+		case ScenarioDevices:
+			if err = makeMain(ctx, tbl, clk); err == nil {
+				err = makeAID(ctx, tbl, clk)
+			}
+		case ScenarioFixtures:
+			err = addTestData(ctx, tbl, clk)
+		default:
+			return fmt.Errorf("unknown seed scenario %q", s)
+		}
+		if err != nil {
+			return fmt.Errorf("could not seed %s: %w", s, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package build_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+)
+
+// TestSeedGolden seeds each scenario into its own table with a fixed clock and
+// compares the result with testdata/<scenario>.golden. After an intended
+// change to the seed data, regenerate the golden files with
+//
+//	go test ./internal/build -update
+func TestSeedGolden(t *testing.T) {
+	t.Parallel()
+	for _, scenario := range build.Scenarios {
+		scenario := scenario
+		t.Run(scenario, func(t *testing.T) {
+			t.Parallel()
+			env := btetest.New(t, scenario)
+			btetest.AssertGolden(t, env.Table, filepath.Join("testdata", scenario+".golden"))
+		})
+	}
+}
+
+func TestSeedReportsErrors(t *testing.T) {
+	t.Parallel()
+	env := btetest.New(t)
+	missing := env.Client.Open(env.TableName + "-missing")
+	for _, scenario := range build.Scenarios {
+		err := build.Seed(context.Background(), missing, env.Clock, scenario)
+		assert.Error(t, err, scenario)
+	}
+	assert.Error(t, build.Seed(context.Background(), env.Table, env.Clock, "no-such-scenario"))
+}
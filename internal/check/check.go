@@ -0,0 +1,251 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/rekey"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+type Kind string
+
+const (
+	// OrphanPool is an aid#qid#did row whose qid#did main row does not exist.
+	OrphanPool Kind = "orphan-pool"
+	// OrphanMain is a qid#did row that no aid#qid#did row pairs with.
+	OrphanMain Kind = "orphan-main"
+	// MismatchedDID is a main row whose DeviceId column disagrees with its key.
+	MismatchedDID Kind = "mismatched-did"
+	// DuplicateAID is a DID that more than one AID is paired with.
+	DuplicateAID Kind = "duplicate-aid"
+	// DuplicateDID is a DID paired under more than one QID. Its key is the
+	// DID, as no one row holds it.
+	DuplicateDID Kind = "duplicate-did"
+	// AppKWithoutPairing is a main row holding an AppK with no pairing row.
+	AppKWithoutPairing Kind = "appk-without-pairing"
+)
+
+type Finding struct {
+	Kind       Kind   `json:"kind"`
+	Key        string `json:"key"`
+	Detail     string `json:"detail"`
+	Repairable bool   `json:"repairable"`
+	Repaired   bool   `json:"repaired"`
+
+	repair *repair
+}
+
+type repair struct {
+	key string
+	mut *bigtable.Mutation
+}
+
+type Report struct {
+	MainRows int       `json:"mainRows"`
+	PoolRows int       `json:"poolRows"`
+	Findings []Finding `json:"findings"`
+}
+
+func (r *Report) Unrepaired() int {
+	n := 0
+	for _, f := range r.Findings {
+		if !f.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+type mainRow struct {
+	key  string
+	did  string
+	aid  string
+	appk bool
+}
+
+// Checker scans the main and registration pool key spaces and reports where
+// they disagree.
+type Checker struct {
+	Table *bigtable.Table
+	// Layout is the key layout of the main rows; nil means rekey.LegacyLayout.
+	Layout rekey.Layout
+	Clock  clock.Clock
+}
+
+func (c *Checker) Run(ctx context.Context) (*Report, error) {
+	layout := c.Layout
+	if layout == nil {
+		layout = rekey.LegacyLayout{}
+	}
+
+	now := clock.Or(c.Clock).Now()
+	mains := make(map[access.MainKey]mainRow)
+	pools := make(map[access.MainKey][]string)
+	dids := make(map[string][]access.RPKey)
+	report := &Report{}
+
+	// Every family is read, so a row without DeviceProperties is still seen.
+	filter := bigtable.LatestNFilter(1)
+	err := c.Table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		if rp, err := access.SplitRPKey(row.Key()); err == nil {
+			report.PoolRows++
+			pools[rp.MainKey] = append(pools[rp.MainKey], rp.AID)
+			dids[rp.DID] = append(dids[rp.DID], rp)
+			return true
+		}
+		k, err := layout.Parse(row.Key())
+		if err != nil {
+			return true
+		}
+		report.MainRows++
+		m := mainRow{key: row.Key()}
+		for _, item := range row[schema.ColumnFamilyDeviceProperties] {
+			switch item.Column {
+			case schema.ColumnFamilyDeviceProperties + ":" + schema.ColumnDID:
+				m.did = string(item.Value)
+			case schema.ColumnFamilyDeviceProperties + ":" + schema.ColumnAID:
+				m.aid = string(item.Value)
+			case schema.ColumnFamilyDeviceProperties + ":" + schema.ColumnAppK:
+				m.appk = len(item.Value) > 0
+			}
+		}
+		mains[k] = m
+		return true
+	}, bigtable.RowFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("could not scan table: %v", err)
+	}
+
+	for k, aids := range pools {
+		if _, ok := mains[k]; !ok {
+			for _, aid := range aids {
+				report.add(Finding{
+					Kind:   OrphanPool,
+					Key:    access.RPKey{AID: aid, MainKey: k}.String(),
+					Detail: fmt.Sprintf("no main row %s", layout.Format(k)),
+				})
+			}
+		}
+		if len(aids) > 1 {
+			report.add(Finding{
+				Kind:   DuplicateAID,
+				Key:    layout.Format(k),
+				Detail: fmt.Sprintf("DID %s is paired with %d AIDs: %v", k.DID, len(aids), aids),
+			})
+		}
+	}
+
+	for did, rps := range dids {
+		qids := make(map[string]bool)
+		keys := make([]string, 0, len(rps))
+		for _, rp := range rps {
+			qids[rp.QID] = true
+			keys = append(keys, rp.String())
+		}
+		if len(qids) > 1 {
+			sort.Strings(keys)
+			report.add(Finding{
+				Kind:   DuplicateDID,
+				Key:    did,
+				Detail: fmt.Sprintf("DID %s is paired under %d QIDs: %v", did, len(qids), keys),
+			})
+		}
+	}
+
+	for k, m := range mains {
+		if m.did != k.DID {
+			f := Finding{
+				Kind:   MismatchedDID,
+				Key:    m.key,
+				Detail: fmt.Sprintf("%s is %q, key says %q", schema.ColumnDID, m.did, k.DID),
+			}
+			if m.did == "" {
+				f.Detail = fmt.Sprintf("%s missing, key says %q", schema.ColumnDID, k.DID)
+			}
+			mut := bigtable.NewMutation()
+			mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, bigtable.Time(now), []byte(k.DID))
+			f.repair = &repair{key: m.key, mut: mut}
+			report.add(f)
+		}
+		if len(pools[k]) > 0 {
+			continue
+		}
+		f := Finding{
+			Kind:   OrphanMain,
+			Key:    m.key,
+			Detail: "no registration pool row",
+		}
+		// A main row that names its AID can be paired without guessing.
+		if m.aid != "" {
+			f.Detail = fmt.Sprintf("no registration pool row for %s %q", schema.ColumnAID, m.aid)
+			f.repair = &repair{key: access.RPKey{AID: m.aid, MainKey: k}.String(), mut: pairingMutation(now)}
+		}
+		report.add(f)
+		if m.appk {
+			report.add(Finding{
+				Kind:   AppKWithoutPairing,
+				Key:    m.key,
+				Detail: fmt.Sprintf("%s set but no registration pool row", schema.ColumnAppK),
+			})
+		}
+	}
+
+	sort.Slice(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Key < b.Key
+	})
+	return report, nil
+}
+
+// Repair applies the fix for every repairable finding in r. An orphaned main
+// row gets the pairing row it names, and a wrong DeviceId is reset to the DID
+// in the row key; everything else is left for a human.
+func (c *Checker) Repair(ctx context.Context, r *Report) error {
+	for i := range r.Findings {
+		f := &r.Findings[i]
+		if f.repair == nil || f.Repaired {
+			continue
+		}
+		if err := c.Table.Apply(ctx, f.repair.key, f.repair.mut); err != nil {
+			return fmt.Errorf("could not repair %s %s: %v", f.Kind, f.Key, err)
+		}
+		f.Repaired = true
+	}
+	// An AppK is only without a pairing until the pairing row is written.
+	for i := range r.Findings {
+		f := &r.Findings[i]
+		if f.Kind == AppKWithoutPairing && r.repairedOrphan(f.Key) {
+			f.Repaired = true
+		}
+	}
+	return nil
+}
+
+func (r *Report) repairedOrphan(key string) bool {
+	for _, f := range r.Findings {
+		if f.Kind == OrphanMain && f.Key == key && f.Repaired {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) add(f Finding) {
+	f.Repairable = f.repair != nil
+	r.Findings = append(r.Findings, f)
+}
+
+func pairingMutation(now time.Time) *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, bigtable.Time(now), []byte(now.Format(time.UnixDate)))
+	return mut
+}
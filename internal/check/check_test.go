@@ -0,0 +1,123 @@
+package check_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/check"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+const (
+	aidPaired    = "it3t1-e3b45-trots-d34wr-hqfdj"
+	aidDuplicate = "tjef7-3e5gn-tbcr8-xskdh-5fs31"
+	aidOrphan    = "y9bf8-onbu9-o8mx1-cniph-5f1m8"
+	aidNamed     = "ebbyq-7gta7-oy1zj-b7rps-dyj9k"
+	aidMismatch  = "8pon6-451xf-uz1r8-shht6-uxpyq"
+	aidFirstQID  = "enugp-cdinu-shtwo-95ujp-e6ie1"
+	aidSecondQID = "7y1su-o5w74-r5jeg-qdmy6-isstu"
+)
+
+type finding struct {
+	Kind       check.Kind
+	Key        string
+	Repairable bool
+	Repaired   bool
+}
+
+func findings(r *check.Report) []finding {
+	var got []finding
+	for _, f := range r.Findings {
+		got = append(got, finding{f.Kind, f.Key, f.Repairable, f.Repaired})
+	}
+	return got
+}
+
+func TestChecker(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	ts := bigtable.Time(env.Clock.Now())
+	rows := map[string]map[string]string{
+		// A consistent device, also paired with a second AID.
+		aidPaired + "#qid-1#did-1":    {schema.ColumnCreated: "created"},
+		aidDuplicate + "#qid-1#did-1": {schema.ColumnCreated: "created"},
+		"qid-1#did-1":                 {schema.ColumnDID: "did-1"},
+		// A pairing row with no main row.
+		aidOrphan + "#qid-1#did-2": {schema.ColumnCreated: "created"},
+		// Main rows with no pairing row, one naming its AID and holding an
+		// AppK.
+		"qid-2#did-3": {schema.ColumnDID: "did-3"},
+		"qid-2#did-4": {schema.ColumnDID: "did-4", schema.ColumnAID: aidNamed, schema.ColumnAppK: "appk-orphan"},
+		// A main row whose DeviceId disagrees with its key.
+		aidMismatch + "#qid-3#did-5": {schema.ColumnCreated: "created"},
+		"qid-3#did-5":                {schema.ColumnDID: "did-x"},
+		// One DID paired under two QIDs.
+		aidFirstQID + "#qid-4#did-7":  {schema.ColumnCreated: "created"},
+		"qid-4#did-7":                 {schema.ColumnDID: "did-7"},
+		aidSecondQID + "#qid-5#did-7": {schema.ColumnCreated: "created"},
+		"qid-5#did-7":                 {schema.ColumnDID: "did-7"},
+	}
+	for key, cols := range rows {
+		mut := bigtable.NewMutation()
+		for col, v := range cols {
+			mut.Set(schema.ColumnFamilyDeviceProperties, col, ts, []byte(v))
+		}
+		assert.NoError(t, env.Table.Apply(ctx, key, mut))
+	}
+	// A main row with nothing in DeviceProperties at all.
+	mut := bigtable.NewMutation()
+	mut.Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, ts, []byte("fcm"))
+	assert.NoError(t, env.Table.Apply(ctx, "qid-3#did-6", mut))
+
+	c := &check.Checker{Table: env.Table, Clock: env.Clock}
+	report, err := c.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, report.MainRows)
+	assert.Equal(t, 6, report.PoolRows)
+	assert.Equal(t, []finding{
+		{check.AppKWithoutPairing, "qid-2#did-4", false, false},
+		{check.DuplicateAID, "qid-1#did-1", false, false},
+		{check.DuplicateDID, "did-7", false, false},
+		{check.MismatchedDID, "qid-3#did-5", true, false},
+		{check.MismatchedDID, "qid-3#did-6", true, false},
+		{check.OrphanMain, "qid-2#did-3", false, false},
+		{check.OrphanMain, "qid-2#did-4", true, false},
+		{check.OrphanMain, "qid-3#did-6", false, false},
+		{check.OrphanPool, aidOrphan + "#qid-1#did-2", false, false},
+	}, findings(report))
+	assert.Equal(t, 9, report.Unrepaired())
+
+	assert.NoError(t, c.Repair(ctx, report))
+	assert.Equal(t, []finding{
+		{check.AppKWithoutPairing, "qid-2#did-4", false, true},
+		{check.DuplicateAID, "qid-1#did-1", false, false},
+		{check.DuplicateDID, "did-7", false, false},
+		{check.MismatchedDID, "qid-3#did-5", true, true},
+		{check.MismatchedDID, "qid-3#did-6", true, true},
+		{check.OrphanMain, "qid-2#did-3", false, false},
+		{check.OrphanMain, "qid-2#did-4", true, true},
+		{check.OrphanMain, "qid-3#did-6", false, false},
+		{check.OrphanPool, aidOrphan + "#qid-1#did-2", false, false},
+	}, findings(report))
+	assert.Equal(t, 5, report.Unrepaired())
+
+	// Repairs hold up when the table is checked again.
+	row, err := env.Table.ReadRow(ctx, aidNamed+"#qid-2#did-4")
+	assert.NoError(t, err)
+	btetest.AssertColumns(t, row, btetest.Cells{"DeviceProperties:CreatedDate": env.Clock.Now().Format(time.UnixDate)})
+	again, err := c.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []finding{
+		{check.DuplicateAID, "qid-1#did-1", false, false},
+		{check.DuplicateDID, "did-7", false, false},
+		{check.OrphanMain, "qid-2#did-3", false, false},
+		{check.OrphanMain, "qid-3#did-6", false, false},
+		{check.OrphanPool, aidOrphan + "#qid-1#did-2", false, false},
+	}, findings(again))
+}
@@ -0,0 +1,181 @@
+// Package compare reports the differences between two tables.
+package compare
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// Source is the read half of *bigtable.Table.
+type Source interface {
+	ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error
+}
+
+type Kind string
+
+const (
+	// Missing is a row on the left that is not on the right.
+	Missing Kind = "missing"
+	// Extra is a row on the right that is not on the left.
+	Extra Kind = "extra"
+	// CellDiff is a column whose cells differ between the two sides.
+	CellDiff Kind = "cell"
+)
+
+type Diff struct {
+	Kind   Kind     `json:"kind"`
+	Key    string   `json:"key"`
+	Column string   `json:"column,omitempty"`
+	Left   []string `json:"left,omitempty"`
+	Right  []string `json:"right,omitempty"`
+}
+
+func (d Diff) String() string {
+	if d.Kind != CellDiff {
+		return fmt.Sprintf("%s %s", d.Kind, d.Key)
+	}
+	return fmt.Sprintf("%s %s %s: left %v, right %v", d.Kind, d.Key, d.Column, d.Left, d.Right)
+}
+
+type Options struct {
+	// RowSet limits the rows compared. Nil compares whole tables.
+	RowSet bigtable.RowSet
+	// IgnoreTimestamps compares only the values of each column's versions.
+	IgnoreTimestamps bool
+	// IgnoreColumns lists "Family:Column" or "Family:*" columns to skip.
+	IgnoreColumns []string
+}
+
+type Report struct {
+	LeftRows  int    `json:"leftRows"`
+	RightRows int    `json:"rightRows"`
+	Matched   int    `json:"matched"`
+	Diffs     []Diff `json:"diffs"`
+}
+
+// Compare streams both tables in key order and reports every row that is
+// only on one side and every column that differs on rows on both.
+func Compare(ctx context.Context, left, right Source, opts Options) (*Report, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rs := opts.RowSet
+	if rs == nil {
+		rs = bigtable.InfiniteRange("")
+	}
+	lrows, lerr := stream(ctx, left, rs)
+	rrows, rerr := stream(ctx, right, rs)
+
+	rep := &Report{}
+	l, lok := <-lrows
+	r, rok := <-rrows
+	for lok || rok {
+		switch {
+		case !rok || (lok && l.Key() < r.Key()):
+			rep.LeftRows++
+			rep.Diffs = append(rep.Diffs, Diff{Kind: Missing, Key: l.Key()})
+			l, lok = <-lrows
+		case !lok || r.Key() < l.Key():
+			rep.RightRows++
+			rep.Diffs = append(rep.Diffs, Diff{Kind: Extra, Key: r.Key()})
+			r, rok = <-rrows
+		default:
+			rep.LeftRows++
+			rep.RightRows++
+			diffs := opts.compareRows(l, r)
+			if len(diffs) == 0 {
+				rep.Matched++
+			}
+			rep.Diffs = append(rep.Diffs, diffs...)
+			l, lok = <-lrows
+			r, rok = <-rrows
+		}
+	}
+	if err := <-lerr; err != nil {
+		return rep, fmt.Errorf("could not read left table: %v", err)
+	}
+	if err := <-rerr; err != nil {
+		return rep, fmt.Errorf("could not read right table: %v", err)
+	}
+	return rep, nil
+}
+
+// stream reads rows from src into a channel that is closed after the last
+// row, then sends the read error.
+func stream(ctx context.Context, src Source, rs bigtable.RowSet) (<-chan bigtable.Row, <-chan error) {
+	rows := make(chan bigtable.Row, 100)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(rows)
+		errc <- src.ReadRows(ctx, rs, func(row bigtable.Row) bool {
+			select {
+			case rows <- row:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return rows, errc
+}
+
+func (o Options) compareRows(l, r bigtable.Row) []Diff {
+	lcols, rcols := o.columns(l), o.columns(r)
+	names := make([]string, 0, len(lcols)+len(rcols))
+	for name := range lcols {
+		names = append(names, name)
+	}
+	for name := range rcols {
+		if _, ok := lcols[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []Diff
+	for _, name := range names {
+		if fmt.Sprint(lcols[name]) != fmt.Sprint(rcols[name]) {
+			diffs = append(diffs, Diff{Kind: CellDiff, Key: l.Key(), Column: name, Left: lcols[name], Right: rcols[name]})
+		}
+	}
+	return diffs
+}
+
+// columns describes every cell version of row by column, leaving out ignored
+// columns.
+func (o Options) columns(row bigtable.Row) map[string][]string {
+	cols := make(map[string][]string)
+	for family, items := range row {
+		for _, item := range items {
+			if o.ignored(item.Column) {
+				continue
+			}
+			_, name := schema.SplitColumn(item.Column)
+			cell := schema.DecodeValue(family, name, item.Value)
+			if !o.IgnoreTimestamps {
+				cell = fmt.Sprintf("%s@%s", cell, item.Timestamp.Time().UTC().Format("2006-01-02T15:04:05.000000Z"))
+			}
+			cols[item.Column] = append(cols[item.Column], cell)
+		}
+	}
+	if o.IgnoreTimestamps {
+		for _, cells := range cols {
+			sort.Strings(cells)
+		}
+	}
+	return cols
+}
+
+func (o Options) ignored(column string) bool {
+	family, _ := schema.SplitColumn(column)
+	for _, ig := range o.IgnoreColumns {
+		if ig == column || ig == family+":*" || strings.TrimSuffix(ig, ":") == family {
+			return true
+		}
+	}
+	return false
+}
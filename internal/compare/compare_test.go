@@ -0,0 +1,67 @@
+package compare_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/compare"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	left := btetest.New(t, build.Scenarios...)
+	right := btetest.NewIsolated(t, build.Scenarios...)
+
+	rep, err := compare.Compare(ctx, left.Table, right.Table, compare.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, []compare.Diff(nil), rep.Diffs)
+	assert.Equal(t, rep.LeftRows, rep.Matched)
+
+	later := bigtable.Time(btetest.Epoch.Add(time.Minute))
+	del := bigtable.NewMutation()
+	del.DeleteRow()
+	assert.NoError(t, right.Table.Apply(ctx, "qid-ready#did-ready", del))
+	add := bigtable.NewMutation()
+	add.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, later, []byte("did-new"))
+	assert.NoError(t, right.Table.Apply(ctx, "qid-new#did-new", add))
+	// The same value written again later differs only in its timestamp.
+	retime := bigtable.NewMutation()
+	retime.DeleteCellsInColumn(schema.ColumnFamilyDeviceProperties, schema.ColumnDID)
+	retime.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, later, []byte("device-one"))
+	assert.NoError(t, right.Table.Apply(ctx, "foo-usd-123#device-one", retime))
+	change := bigtable.NewMutation()
+	change.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted, bigtable.Time(btetest.Epoch), []byte("software"))
+	assert.NoError(t, right.Table.Apply(ctx, "qid-already-registered#did-already-registered", change))
+
+	rep, err = compare.Compare(ctx, left.Table, right.Table, compare.Options{})
+	assert.NoError(t, err)
+	var got []string
+	for _, d := range rep.Diffs {
+		got = append(got, string(d.Kind)+" "+d.Key+" "+d.Column)
+	}
+	assert.Equal(t, []string{
+		"cell foo-usd-123#device-one DeviceProperties:DeviceId",
+		"cell qid-already-registered#did-already-registered DeviceProperties:Trusted",
+		"extra qid-new#did-new ",
+		"missing qid-ready#did-ready ",
+	}, got)
+	assert.Equal(t, []string{`"hardware"@2023-10-01T12:00:00.000000Z`}, rep.Diffs[1].Left)
+	assert.Equal(t, []string{`"software"@2023-10-01T12:00:00.000000Z`}, rep.Diffs[1].Right)
+
+	rep, err = compare.Compare(ctx, left.Table, right.Table, compare.Options{
+		RowSet:           bigtable.RowRangeList{bigtable.PrefixRange("foo-"), bigtable.PrefixRange("qid-already-registered")},
+		IgnoreTimestamps: true,
+		IgnoreColumns:    []string{"DeviceProperties:Trusted"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []compare.Diff(nil), rep.Diffs)
+	assert.Equal(t, 4, rep.Matched)
+}
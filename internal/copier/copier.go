@@ -0,0 +1,138 @@
+// Package copier copies rows from one table into another, typically from a
+// real instance into the emulator, redacting secrets on the way.
+package copier
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/export"
+)
+
+const defaultChunk = 500
+
+// Source is the read half of *bigtable.Table. Copier is given only this for
+// its source, so a copy can never write to the table it copies from.
+type Source interface {
+	ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error
+}
+
+// Selection is what to copy: rows in any of Ranges, plus the main and
+// pairing rows of every device of each of QIDs. An empty Selection copies
+// the whole table.
+type Selection struct {
+	Ranges []bigtable.RowRange
+	QIDs   []string
+}
+
+type Stats struct {
+	Rows     int
+	Cells    int
+	Redacted int
+}
+
+type Copier struct {
+	Source   Source
+	Dest     *bigtable.Table
+	Redactor *Redactor
+	// ChunkSize is how many rows are written per ApplyBulk.
+	ChunkSize int
+}
+
+// Copy copies the selected rows, keeping every cell version and timestamp.
+func (c *Copier) Copy(ctx context.Context, sel Selection) (Stats, error) {
+	var stats Stats
+	chunk := c.ChunkSize
+	if chunk <= 0 {
+		chunk = defaultChunk
+	}
+	var (
+		keys []string
+		muts []*bigtable.Mutation
+		werr error
+	)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		rowErrs, err := c.Dest.ApplyBulk(ctx, keys, muts)
+		if err != nil {
+			return fmt.Errorf("could not write rows: %v", err)
+		}
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				return fmt.Errorf("could not write %s: %v", keys[i], rowErr)
+			}
+		}
+		keys, muts = keys[:0], muts[:0]
+		return nil
+	}
+	seen := make(map[string]bool)
+	copyRow := func(row bigtable.Row) bool {
+		if seen[row.Key()] {
+			return true
+		}
+		seen[row.Key()] = true
+		r := export.FromBigtable(row, false)
+		for i, cell := range r.Cells {
+			v, redacted := c.Redactor.Redact(cell.Family, cell.Column, cell.Value)
+			r.Cells[i].Value = v
+			if redacted {
+				stats.Redacted++
+			}
+		}
+		stats.Rows++
+		stats.Cells += len(r.Cells)
+		keys = append(keys, r.Key)
+		muts = append(muts, r.Mutation())
+		if len(keys) == chunk {
+			werr = flush()
+		}
+		return werr == nil
+	}
+
+	for _, rs := range sel.rowSets() {
+		err := c.Source.ReadRows(ctx, rs.set, copyRow, rs.opts...)
+		if werr != nil {
+			return stats, werr
+		}
+		if err != nil {
+			return stats, fmt.Errorf("could not read source rows: %v", err)
+		}
+	}
+	return stats, flush()
+}
+
+type rowSet struct {
+	set  bigtable.RowSet
+	opts []bigtable.ReadOption
+}
+
+func (s Selection) rowSets() []rowSet {
+	if len(s.Ranges) == 0 && len(s.QIDs) == 0 {
+		return []rowSet{{set: bigtable.InfiniteRange("")}}
+	}
+	var sets []rowSet
+	if len(s.Ranges) > 0 {
+		sets = append(sets, rowSet{set: bigtable.RowRangeList(s.Ranges)})
+	}
+	if len(s.QIDs) > 0 {
+		// Pairing rows are keyed by AID, so finding a QID's devices means
+		// scanning the table with a key filter. The optional hex prefix
+		// matches main rows in the hashed layout.
+		qids := make([]string, len(s.QIDs))
+		for i, q := range s.QIDs {
+			qids[i] = regexp.QuoteMeta(q)
+		}
+		q := strings.Join(qids, "|")
+		re := fmt.Sprintf(`(?:[0-9a-f]{4}\.)?(?:%s)#[^#]*|[^#]+#(?:%s)#[^#]*`, q, q)
+		sets = append(sets, rowSet{
+			set:  bigtable.InfiniteRange(""),
+			opts: []bigtable.ReadOption{bigtable.RowFilter(bigtable.RowKeyFilter(re))},
+		})
+	}
+	return sets
+}
@@ -0,0 +1,90 @@
+package copier_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/copier"
+	"github.com/theotheradamsmith/btemulator/internal/gen"
+)
+
+func TestCopy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := btetest.NewIsolated(t, build.Scenarios...)
+	devices, err := gen.Generate(gen.Config{Seed: 5, Devices: 30, DevicesPerQID: map[int]int{3: 1}, Now: btetest.Epoch})
+	assert.NoError(t, err)
+	assert.NoError(t, gen.Write(ctx, src.Table, devices, nil))
+	before, err := btetest.Dump(ctx, src.Table)
+	assert.NoError(t, err)
+
+	r := &copier.Redactor{Key: []byte("test")}
+	t.Run("whole table", func(t *testing.T) {
+		dst := btetest.New(t)
+		stats, err := (&copier.Copier{Source: src.Table, Dest: dst.Table, Redactor: r, ChunkSize: 7}).Copy(ctx, copier.Selection{})
+		assert.NoError(t, err)
+		assert.Equal(t, 2*len(devices)+13, stats.Rows)
+		assert.True(t, stats.Redacted > 0)
+
+		// The copy has every row, no secret and the same device states.
+		got, err := btetest.Dump(ctx, dst.Table)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Count(before, "\n"), strings.Count(got, "\n"))
+		for _, d := range devices {
+			assert.False(t, strings.Contains(got, d.FCM))
+			if d.AppK != "" {
+				assert.False(t, strings.Contains(got, d.AppK))
+			}
+			state, _, err := access.GetState(ctx, dst.Table, d.AID)
+			assert.NoError(t, err)
+			assert.Equal(t, d.State, state)
+		}
+		assert.False(t, strings.Contains(got, "appk-in-flight"))
+
+		// The source is untouched.
+		after, err := btetest.Dump(ctx, src.Table)
+		assert.NoError(t, err)
+		assert.Equal(t, before, after)
+	})
+
+	t.Run("pseudonyms are deterministic", func(t *testing.T) {
+		a := btetest.New(t)
+		b := btetest.New(t)
+		sel := copier.Selection{Ranges: []bigtable.RowRange{bigtable.PrefixRange("qid-")}}
+		for _, dst := range []*bigtable.Table{a.Table, b.Table} {
+			_, err := (&copier.Copier{Source: src.Table, Dest: dst, Redactor: r}).Copy(ctx, sel)
+			assert.NoError(t, err)
+		}
+		gotA, err := btetest.Dump(ctx, a.Table)
+		assert.NoError(t, err)
+		gotB, err := btetest.Dump(ctx, b.Table)
+		assert.NoError(t, err)
+		assert.Equal(t, gotA, gotB)
+		assert.True(t, strings.Contains(gotA, "qid-in-flight#did-in-flight"))
+		assert.False(t, strings.Contains(gotA, "foo-usd-123"))
+	})
+
+	t.Run("by QID", func(t *testing.T) {
+		dst := btetest.New(t)
+		qid := devices[0].QID
+		stats, err := (&copier.Copier{Source: src.Table, Dest: dst.Table, Redactor: r}).Copy(ctx, copier.Selection{QIDs: []string{qid}})
+		assert.NoError(t, err)
+		assert.Equal(t, 6, stats.Rows)
+		for _, d := range devices[:3] {
+			assert.Equal(t, qid, d.QID)
+			key, err := access.ReadAidRow(ctx, dst.Table, d.AID)
+			assert.NoError(t, err)
+			assert.Equal(t, access.RPKey{AID: d.AID, MainKey: access.MainKey{QID: d.QID, DID: d.DID}}.String(), key)
+			row, err := dst.Table.ReadRow(ctx, access.MainKey{QID: d.QID, DID: d.DID}.String())
+			assert.NoError(t, err)
+			btetest.AssertColumns(t, row, btetest.Cells{"DeviceProperties:DeviceId": d.DID})
+		}
+	})
+}
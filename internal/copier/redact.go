@@ -0,0 +1,81 @@
+package copier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// Redactor replaces secret cell values with pseudonyms. A pseudonym is an
+// HMAC of the column and value under Key, so a secret copied twice, or held
+// by both a pairing row and a main row, gets the same pseudonym every time
+// and rows that matched before the copy still match after it.
+type Redactor struct {
+	Key []byte
+}
+
+// Redacted lists the columns whose values are secrets.
+var Redacted = []schema.Column{
+	{Family: schema.ColumnFamilyDeviceProperties, Name: schema.ColumnAppK},
+	{Family: schema.ColumnFamilyDeviceProperties, Name: schema.ColumnAuthToken},
+	{Family: schema.ColumnFamilyRegistrationProperties, Name: schema.ColumnChallenge},
+	{Family: schema.ColumnFamilyFirebaseProperties, Name: schema.ColumnFCM},
+}
+
+// Redact returns the value to copy for family:column. Empty values are kept,
+// since an empty AppK means a device is free.
+func (r *Redactor) Redact(family, column string, v []byte) ([]byte, bool) {
+	if len(v) == 0 {
+		return v, false
+	}
+	if family == schema.ColumnFamilyRegistrationProperties && column == schema.ColumnIntent {
+		return r.redactIntent(v)
+	}
+	for _, c := range Redacted {
+		if c.Family == family && c.Name == column {
+			return []byte(r.pseudonym(column, v)), true
+		}
+	}
+	return v, false
+}
+
+func (r *Redactor) pseudonym(column string, v []byte) string {
+	mac := hmac.New(sha256.New, r.Key)
+	mac.Write([]byte(column))
+	mac.Write([]byte{0})
+	mac.Write(v)
+	sum := mac.Sum(nil)
+	switch column {
+	case schema.ColumnFCM:
+		return "redacted:" + base64.RawURLEncoding.EncodeToString(sum)
+	case schema.ColumnChallenge:
+		return hex.EncodeToString(sum[:16])
+	default:
+		return "redacted-" + hex.EncodeToString(sum)
+	}
+}
+
+// redactIntent replaces the AppK a registration intent carries with the
+// pseudonym its ApplianceKey cells get.
+func (r *Redactor) redactIntent(v []byte) ([]byte, bool) {
+	var (
+		in   map[string]json.RawMessage
+		appk string
+	)
+	if err := json.Unmarshal(v, &in); err != nil || json.Unmarshal(in["appk"], &appk) != nil {
+		return []byte(r.pseudonym(schema.ColumnIntent, v)), true
+	}
+	if appk == "" {
+		return v, false
+	}
+	in["appk"], _ = json.Marshal(r.pseudonym(schema.ColumnAppK, []byte(appk)))
+	b, err := json.Marshal(in)
+	if err != nil {
+		return []byte(r.pseudonym(schema.ColumnIntent, v)), true
+	}
+	return b, true
+}
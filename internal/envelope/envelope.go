@@ -0,0 +1,147 @@
+// Package envelope encrypts values at rest with AES-GCM under a fresh data
+// key, which is itself wrapped by a KeyProvider. A sealed value is text:
+//
+//	enc1:<key ID>:<wrapped data key>:<nonce and ciphertext>
+//
+// with the last two in unpadded base64url, so which key can open a value is
+// plain to see, both for operators and for re-encryption.
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown key")
+	ErrBadKeyID   = errors.New("key IDs must be non-empty and contain no colons")
+	ErrCorrupt    = errors.New("sealed value is corrupt")
+)
+
+// KeyProvider holds key encryption keys and wraps data keys with them. The
+// keys themselves need never leave it.
+type KeyProvider interface {
+	// KeyID names the key new data keys are wrapped with.
+	KeyID(ctx context.Context) (string, error)
+	// Wrap encrypts dataKey and says which key it used.
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// Unwrap decrypts a data key wrapped with the key keyID names, which
+	// need not be the current one.
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+const prefix = "enc1:"
+
+// Sealer seals and opens values with keys from Provider. A nil Sealer leaves
+// values as they are, so callers need not check whether encryption is on.
+type Sealer struct {
+	Provider KeyProvider
+}
+
+// Seal encrypts plaintext under a new data key.
+func (s *Sealer) Seal(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if s == nil {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := s.Provider.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap data key: %w", err)
+	}
+	if keyID == "" || strings.Contains(keyID, ":") {
+		return nil, fmt.Errorf("%w: %q", ErrBadKeyID, keyID)
+	}
+	ciphertext, err := seal(dataKey, plaintext, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	return []byte(prefix + keyID + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(ciphertext)), nil
+}
+
+// Open decrypts a sealed value. Values that are not sealed are returned as
+// they are, so a table can be read while it is being encrypted.
+func (s *Sealer) Open(ctx context.Context, v []byte) ([]byte, error) {
+	if s == nil || !IsSealed(v) {
+		return v, nil
+	}
+	parts := strings.Split(string(v[len(prefix):]), ":")
+	if len(parts) != 3 {
+		return nil, ErrCorrupt
+	}
+	keyID := parts[0]
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	dataKey, err := s.Provider.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %w", err)
+	}
+	return open(dataKey, ciphertext, []byte(keyID))
+}
+
+// IsSealed says whether v was produced by Seal.
+func IsSealed(v []byte) bool {
+	return bytes.HasPrefix(v, []byte(prefix))
+}
+
+// KeyID names the key a sealed value's data key is wrapped with.
+func KeyID(v []byte) (string, bool) {
+	if !IsSealed(v) {
+		return "", false
+	}
+	keyID, _, ok := strings.Cut(string(v[len(prefix):]), ":")
+	return keyID, ok
+}
+
+// seal encrypts plaintext with AES-GCM under key, prefixing the nonce.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(key, ciphertext, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,230 @@
+package envelope_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func localKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func localKeys(t *testing.T, s string) *envelope.Sealer {
+	t.Helper()
+	keys, err := envelope.ParseLocalKeys(s)
+	assert.NoError(t, err)
+	return &envelope.Sealer{Provider: keys}
+}
+
+func TestSealer(t *testing.T) {
+	ctx := context.Background()
+	s := localKeys(t, "# current first\nnew="+localKey(2)+"\nold="+localKey(1)+"\n")
+	old := localKeys(t, "old="+localKey(1))
+	plaintext := []byte("3b6a27bcceb6a42d62a3a8d02a6f0d73653215771de243a63ac048a18b59da29")
+
+	sealed, err := s.Seal(ctx, plaintext)
+	assert.NoError(t, err)
+	assert.True(t, envelope.IsSealed(sealed))
+	assert.False(t, bytes.Contains(sealed, plaintext))
+	keyID, ok := envelope.KeyID(sealed)
+	assert.True(t, ok)
+	assert.Equal(t, "new", keyID)
+	again, err := s.Seal(ctx, plaintext)
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed, again)
+
+	opened, err := s.Open(ctx, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+	_, err = old.Open(ctx, sealed)
+	assert.IsError(t, err, envelope.ErrUnknownKey)
+
+	t.Run("values sealed under an older key still open", func(t *testing.T) {
+		sealed, err := old.Seal(ctx, plaintext)
+		assert.NoError(t, err)
+		opened, err := s.Open(ctx, sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, opened)
+	})
+
+	t.Run("plaintext and nil sealers pass values through", func(t *testing.T) {
+		opened, err := s.Open(ctx, plaintext)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, opened)
+		var none *envelope.Sealer
+		v, err := none.Seal(ctx, plaintext)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, v)
+		v, err = none.Open(ctx, sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, sealed, v)
+	})
+
+	t.Run("tampering is detected", func(t *testing.T) {
+		tampered := bytes.Replace(sealed, []byte("enc1:new:"), []byte("enc1:old:"), 1)
+		_, err := s.Open(ctx, tampered)
+		assert.Error(t, err)
+		tampered = append(bytes.Clone(sealed[:len(sealed)-2]), "AA"...)
+		_, err = s.Open(ctx, tampered)
+		assert.IsError(t, err, envelope.ErrCorrupt)
+		_, err = s.Open(ctx, []byte("enc1:new:nonsense"))
+		assert.IsError(t, err, envelope.ErrCorrupt)
+	})
+
+	t.Run("bad keys are rejected", func(t *testing.T) {
+		for _, bad := range []string{"", "# nothing", "k:1=" + localKey(1), "=" + localKey(1), "k=short", "k=" + localKey(1) + ",k=" + localKey(2)} {
+			_, err := envelope.ParseLocalKeys(bad)
+			assert.Error(t, err, "%q", bad)
+		}
+		t.Setenv("BTEMULATOR_TEST_KEYS", "a="+localKey(3)+", b="+localKey(4))
+		keys, err := envelope.KeysFromEnv("BTEMULATOR_TEST_KEYS")
+		assert.NoError(t, err)
+		keyID, err := keys.KeyID(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", keyID)
+		_, err = envelope.KeysFromEnv("BTEMULATOR_TEST_KEYS_UNSET")
+		assert.IsError(t, err, envelope.ErrNoKeys)
+	})
+}
+
+func TestLocalKMS(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "kms.json")
+	kms, err := envelope.OpenLocalKMS(path)
+	assert.NoError(t, err)
+	version, err := kms.CreateKey("appk")
+	assert.NoError(t, err)
+	assert.Equal(t, "appk/1", version)
+	_, err = kms.CreateKey("appk")
+	assert.IsError(t, err, envelope.ErrKeyExists)
+	_, err = kms.RotateKey("missing")
+	assert.IsError(t, err, envelope.ErrUnknownKey)
+
+	s := &envelope.Sealer{Provider: kms.Key("appk")}
+	first, err := s.Seal(ctx, []byte("appk-one"))
+	assert.NoError(t, err)
+	version, err = kms.RotateKey("appk")
+	assert.NoError(t, err)
+	assert.Equal(t, "appk/2", version)
+	second, err := s.Seal(ctx, []byte("appk-two"))
+	assert.NoError(t, err)
+	keyID, _ := envelope.KeyID(second)
+	assert.Equal(t, "appk/2", keyID)
+
+	// Another process opening the same state sees every version.
+	reopened, err := envelope.OpenLocalKMS(path)
+	assert.NoError(t, err)
+	s = &envelope.Sealer{Provider: reopened.Key("appk")}
+	for want, sealed := range map[string][]byte{"appk-one": first, "appk-two": second} {
+		opened, err := s.Open(ctx, sealed)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(opened))
+	}
+
+	memory, err := envelope.OpenLocalKMS("")
+	assert.NoError(t, err)
+	_, err = memory.CreateKey("appk")
+	assert.NoError(t, err)
+	_, err = (&envelope.Sealer{Provider: memory.Key("appk")}).Open(ctx, first)
+	assert.Error(t, err)
+}
+
+func TestReencrypter(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	const poolKey, mainKey = "8pon6-451xf-uz1r8-shht6-uxpyq#qid-reencrypt#did-reencrypt", "qid-reencrypt#did-reencrypt"
+	created := bigtable.Time(env.Clock.Now())
+	rotated := created + 1000
+	for _, key := range []string{poolKey, mainKey} {
+		mut := bigtable.NewMutation()
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, created, []byte("appk-old"))
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, rotated, []byte("appk-new"))
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, created, []byte("did-reencrypt"))
+		assert.NoError(t, env.Table.Apply(ctx, key, mut))
+	}
+	// A registration that rotated nothing but is still under way.
+	intent := bigtable.NewMutation()
+	intent.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent, rotated,
+		[]byte(`{"id":"intent-reencrypt","appk":"appk-new","step":"recorded"}`))
+	assert.NoError(t, env.Table.Apply(ctx, poolKey, intent))
+	intentAppK := func(t *testing.T) string {
+		t.Helper()
+		row, err := env.Table.ReadRow(ctx, poolKey, bigtable.RowFilter(bigtable.ColumnFilter(schema.ColumnIntent)))
+		assert.NoError(t, err)
+		var in struct {
+			ID   string `json:"id"`
+			AppK string `json:"appk"`
+			Step string `json:"step"`
+		}
+		assert.NoError(t, json.Unmarshal(row[schema.ColumnFamilyRegistrationProperties][0].Value, &in))
+		assert.Equal(t, "intent-reencrypt", in.ID)
+		assert.Equal(t, "recorded", in.Step)
+		return in.AppK
+	}
+	appKs := func(t *testing.T, s *envelope.Sealer, key string) ([]string, []string) {
+		t.Helper()
+		row, err := env.Table.ReadRow(ctx, key, bigtable.RowFilter(bigtable.ColumnFilter(schema.ColumnAppK)))
+		assert.NoError(t, err)
+		var stored, opened []string
+		for _, item := range row[schema.ColumnFamilyDeviceProperties] {
+			keyID, _ := envelope.KeyID(item.Value)
+			stored = append(stored, keyID)
+			v, err := s.Open(ctx, item.Value)
+			assert.NoError(t, err)
+			opened = append(opened, string(v))
+		}
+		return stored, opened
+	}
+
+	first := localKeys(t, "k1="+localKey(1))
+	stats, err := (&envelope.Reencrypter{Table: env.Table, Sealer: first}).Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, envelope.ReencryptStats{Rows: 2, Encrypted: 4, Intents: 1}, stats)
+	for _, key := range []string{poolKey, mainKey} {
+		keyIDs, opened := appKs(t, first, key)
+		assert.Equal(t, []string{"k1", "k1"}, keyIDs)
+		assert.Equal(t, []string{"appk-new", "appk-old"}, opened)
+	}
+	pool, err := env.Table.ReadRow(ctx, poolKey)
+	assert.NoError(t, err)
+	main, err := env.Table.ReadRow(ctx, mainKey)
+	assert.NoError(t, err)
+	btetest.AssertVersions(t, pool, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, 2)
+	assert.Equal(t, rotated, pool[schema.ColumnFamilyDeviceProperties][0].Timestamp)
+	assert.Equal(t, pool[schema.ColumnFamilyDeviceProperties][0].Value, main[schema.ColumnFamilyDeviceProperties][0].Value)
+	assert.Equal(t, string(pool[schema.ColumnFamilyDeviceProperties][0].Value), intentAppK(t))
+
+	second := localKeys(t, "k2="+localKey(2)+"\nk1="+localKey(1))
+	stats, err = (&envelope.Reencrypter{Table: env.Table, Sealer: second}).Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, envelope.ReencryptStats{Rows: 2, Rewrapped: 4, Intents: 1}, stats)
+	keyIDs, opened := appKs(t, localKeys(t, "k2="+localKey(2)), mainKey)
+	assert.Equal(t, []string{"k2", "k2"}, keyIDs)
+	assert.Equal(t, []string{"appk-new", "appk-old"}, opened)
+	sealed := intentAppK(t)
+	keyID, _ := envelope.KeyID([]byte(sealed))
+	assert.Equal(t, "k2", keyID)
+	plaintext, err := second.Open(ctx, []byte(sealed))
+	assert.NoError(t, err)
+	assert.Equal(t, "appk-new", string(plaintext))
+
+	stats, err = (&envelope.Reencrypter{Table: env.Table, Sealer: second}).Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, envelope.ReencryptStats{Rows: 2, Current: 4}, stats)
+	dump, err := btetest.Dump(ctx, env.Table)
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(dump, "appk-"), dump)
+}
@@ -0,0 +1,179 @@
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrKeyExists = errors.New("key already exists")
+
+// LocalKMS stands in for a key management service. It holds named keys, each
+// with numbered versions of which the latest is primary, and encrypts and
+// decrypts with them without handing them out. Key versions are named
+// <key>/<version>, and that is the key ID sealed values record.
+//
+// State is kept in a JSON file so that every command pointed at it sees the
+// same keys; a LocalKMS opened with no path keeps it in memory.
+type LocalKMS struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string][][]byte
+}
+
+// OpenLocalKMS loads the state at path, which need not exist yet.
+func OpenLocalKMS(path string) (*LocalKMS, error) {
+	k := &LocalKMS{path: path, keys: map[string][][]byte{}}
+	if path == "" {
+		return k, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read KMS state: %v", err)
+	}
+	if err := json.Unmarshal(b, &k.keys); err != nil {
+		return nil, fmt.Errorf("could not parse KMS state %s: %v", path, err)
+	}
+	return k, nil
+}
+
+// CreateKey creates a key with a single version.
+func (k *LocalKMS) CreateKey(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return "", fmt.Errorf("%w: %q", ErrBadKeyID, name)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[name]; ok {
+		return "", fmt.Errorf("%w: %s", ErrKeyExists, name)
+	}
+	return k.addVersion(name)
+}
+
+// RotateKey adds a version to a key and makes it primary. Earlier versions
+// can still decrypt.
+func (k *LocalKMS) RotateKey(name string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[name]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, name)
+	}
+	return k.addVersion(name)
+}
+
+// Primary names the primary version of a key.
+func (k *LocalKMS) Primary(name string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	versions, ok := k.keys[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, name)
+	}
+	return versionName(name, len(versions)), nil
+}
+
+// Encrypt encrypts plaintext with the primary version of a key and names the
+// version it used.
+func (k *LocalKMS) Encrypt(name string, plaintext []byte) (string, []byte, error) {
+	version, err := k.Primary(name)
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := k.version(version)
+	if err != nil {
+		return "", nil, err
+	}
+	ciphertext, err := seal(key, plaintext, []byte(version))
+	return version, ciphertext, err
+}
+
+// Decrypt decrypts ciphertext with the key version that encrypted it.
+func (k *LocalKMS) Decrypt(version string, ciphertext []byte) ([]byte, error) {
+	key, err := k.version(version)
+	if err != nil {
+		return nil, err
+	}
+	return open(key, ciphertext, []byte(version))
+}
+
+// Key is a KeyProvider wrapping data keys with the primary version of the
+// named key.
+func (k *LocalKMS) Key(name string) KeyProvider {
+	return kmsKey{kms: k, name: name}
+}
+
+func (k *LocalKMS) version(version string) ([]byte, error) {
+	name, n, ok := strings.Cut(version, "/")
+	i, err := strconv.Atoi(n)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, version)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	versions := k.keys[name]
+	if i < 1 || i > len(versions) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, version)
+	}
+	return versions[i-1], nil
+}
+
+func (k *LocalKMS) addVersion(name string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	k.keys[name] = append(k.keys[name], key)
+	if err := k.save(); err != nil {
+		k.keys[name] = k.keys[name][:len(k.keys[name])-1]
+		if len(k.keys[name]) == 0 {
+			delete(k.keys, name)
+		}
+		return "", err
+	}
+	return versionName(name, len(k.keys[name])), nil
+}
+
+func (k *LocalKMS) save() error {
+	if k.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("could not write KMS state: %v", err)
+	}
+	return os.Rename(tmp, k.path)
+}
+
+func versionName(name string, n int) string {
+	return name + "/" + strconv.Itoa(n)
+}
+
+type kmsKey struct {
+	kms  *LocalKMS
+	name string
+}
+
+func (k kmsKey) KeyID(ctx context.Context) (string, error) {
+	return k.kms.Primary(k.name)
+}
+
+func (k kmsKey) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	return k.kms.Encrypt(k.name, dataKey)
+}
+
+func (k kmsKey) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	return k.kms.Decrypt(keyID, wrapped)
+}
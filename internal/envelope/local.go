@@ -0,0 +1,95 @@
+package envelope
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrNoKeys = errors.New("no keys given")
+
+// LocalKeys is a KeyProvider holding AES-256 keys itself, read from a file or
+// the environment as entries of the form
+//
+//	<key ID>=<base64 key>
+//
+// separated by newlines or commas. The first entry is the current key; the
+// rest can still unwrap what was sealed under them, so a key is rotated by
+// putting a new one first and re-encrypting.
+type LocalKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+// ParseLocalKeys reads keys in the format LocalKeys describes. Blank lines
+// and lines starting with # are ignored.
+func ParseLocalKeys(s string) (*LocalKeys, error) {
+	l := &LocalKeys{keys: map[string][]byte{}}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, b64, ok := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("%w: %q", ErrBadKeyID, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s: want 32 bytes, got %d", id, len(key))
+		}
+		if _, ok := l.keys[id]; ok {
+			return nil, fmt.Errorf("key %s given twice", id)
+		}
+		if l.current == "" {
+			l.current = id
+		}
+		l.keys[id] = key
+	}
+	if l.current == "" {
+		return nil, ErrNoKeys
+	}
+	return l, nil
+}
+
+// LoadKeyFile reads keys from the file at path.
+func LoadKeyFile(path string) (*LocalKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLocalKeys(string(b))
+}
+
+// KeysFromEnv reads keys from the environment variable name.
+func KeysFromEnv(name string) (*LocalKeys, error) {
+	s, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not set", ErrNoKeys, name)
+	}
+	return ParseLocalKeys(s)
+}
+
+func (l *LocalKeys) KeyID(ctx context.Context) (string, error) {
+	return l.current, nil
+}
+
+func (l *LocalKeys) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(l.keys[l.current], dataKey, []byte(l.current))
+	return l.current, wrapped, err
+}
+
+func (l *LocalKeys) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := l.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return open(key, wrapped, []byte(keyID))
+}
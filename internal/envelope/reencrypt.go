@@ -0,0 +1,173 @@
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// Reencrypter brings every AppK in a table under the Sealer's current key:
+// plaintext AppKs are sealed and sealed ones under any other key are opened
+// and sealed again. Each version of the cell is rewritten in place, at its
+// own timestamp, so the AppK history rotation relies on is kept. The AppK in
+// a registration intent is re-sealed the same way, so an unfinished
+// registration writes the same AppK the pool row holds.
+//
+// Run it after rotating a key, and again once the old key is no longer
+// needed to confirm nothing is left under it.
+type Reencrypter struct {
+	Table  *bigtable.Table
+	Sealer *Sealer
+}
+
+type ReencryptStats struct {
+	Rows int
+	// Encrypted counts plaintext AppKs now sealed, and Rewrapped sealed ones
+	// now under the current key.
+	Encrypted int
+	Rewrapped int
+	// Current counts AppKs already under the current key.
+	Current int
+	// Intents counts registration intents whose AppK was re-encrypted.
+	Intents int
+	// Changed counts AppKs and intents that changed while being re-encrypted,
+	// which are left for the next run.
+	Changed int
+}
+
+// intentAppK is the field of a registration intent that holds its AppK.
+const intentAppK = "appk"
+
+func (r *Reencrypter) Run(ctx context.Context) (ReencryptStats, error) {
+	var stats ReencryptStats
+	if r.Sealer == nil {
+		return stats, fmt.Errorf("%w: no key provider", ErrNoKeys)
+	}
+	current, err := r.Sealer.Provider.KeyID(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("could not get current key: %v", err)
+	}
+
+	type cell struct {
+		key  string
+		item bigtable.ReadItem
+	}
+	var cells, intents []cell
+	filter := bigtable.ColumnFilter(fmt.Sprintf("%s|%s", schema.ColumnAppK, schema.ColumnIntent))
+	err = r.Table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		stats.Rows++
+		for _, item := range row[schema.ColumnFamilyRegistrationProperties] {
+			intents = append(intents, cell{key: row.Key(), item: item})
+		}
+		for _, item := range row[schema.ColumnFamilyDeviceProperties] {
+			if len(item.Value) == 0 {
+				continue
+			}
+			if keyID, _ := KeyID(item.Value); keyID == current {
+				stats.Current++
+				continue
+			}
+			cells = append(cells, cell{key: row.Key(), item: item})
+		}
+		return true
+	}, bigtable.RowFilter(filter))
+	if err != nil {
+		return stats, fmt.Errorf("could not scan table: %v", err)
+	}
+
+	// A device's pairing and main rows, and any intent, hold the same AppK,
+	// and go on doing so.
+	resealed := map[string][]byte{}
+	reseal := func(key string, old []byte) ([]byte, error) {
+		if v, ok := resealed[string(old)]; ok {
+			return v, nil
+		}
+		plaintext, err := r.Sealer.Open(ctx, old)
+		if err != nil {
+			return nil, fmt.Errorf("could not open AppK on %s: %w", key, err)
+		}
+		v, err := r.Sealer.Seal(ctx, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("could not seal AppK on %s: %w", key, err)
+		}
+		resealed[string(old)] = v
+		return v, nil
+	}
+	// rewrite replaces a cell's value at its own timestamp, unless it has
+	// changed since it was read.
+	rewrite := func(key, family, column string, item bigtable.ReadItem, v []byte) (bool, error) {
+		ts := item.Timestamp
+		unchanged := bigtable.ChainFilters(
+			bigtable.FamilyFilter(family),
+			bigtable.ColumnFilter(column),
+			bigtable.TimestampRangeFilterMicros(ts, ts+bigtable.Timestamp(time.Millisecond/time.Microsecond)),
+			bigtable.ValueFilter(regexp.QuoteMeta(string(item.Value))),
+		)
+		mut := bigtable.NewMutation()
+		mut.Set(family, column, ts, v)
+		var matched bool
+		if err := r.Table.Apply(ctx, key, bigtable.NewCondMutation(unchanged, mut, nil), bigtable.GetCondMutationResult(&matched)); err != nil {
+			return false, fmt.Errorf("could not re-encrypt AppK on %s: %v", key, err)
+		}
+		return matched, nil
+	}
+
+	for _, c := range cells {
+		v, err := reseal(c.key, c.item.Value)
+		if err != nil {
+			return stats, err
+		}
+		matched, err := rewrite(c.key, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, c.item, v)
+		if err != nil {
+			return stats, err
+		}
+		switch {
+		case !matched:
+			stats.Changed++
+		case IsSealed(c.item.Value):
+			stats.Rewrapped++
+		default:
+			stats.Encrypted++
+		}
+	}
+
+	for _, c := range intents {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(c.item.Value, &fields); err != nil {
+			return stats, fmt.Errorf("could not decode intent on %s: %v", c.key, err)
+		}
+		var appk string
+		if err := json.Unmarshal(fields[intentAppK], &appk); err != nil || appk == "" {
+			continue
+		}
+		if keyID, _ := KeyID([]byte(appk)); keyID == current {
+			continue
+		}
+		v, err := reseal(c.key, []byte(appk))
+		if err != nil {
+			return stats, err
+		}
+		if fields[intentAppK], err = json.Marshal(string(v)); err != nil {
+			return stats, err
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return stats, err
+		}
+		matched, err := rewrite(c.key, schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent, c.item, b)
+		if err != nil {
+			return stats, err
+		}
+		if matched {
+			stats.Intents++
+		} else {
+			stats.Changed++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,220 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// Checkpoint records how much of an export reached the output file, so an
+// interrupted export can truncate any partial row and carry on after the
+// last complete one.
+type Checkpoint struct {
+	Output  string `json:"output"`
+	Format  string `json:"format"`
+	LastKey string `json:"lastKey"`
+	Offset  int64  `json:"offset"`
+	Rows    int    `json:"rows"`
+}
+
+type Exporter struct {
+	Table  *bigtable.Table
+	Format string
+	Decode bool
+	// Prefix, if set, limits the export to keys starting with it. Otherwise
+	// Start and End bound the keys exported; either may be empty.
+	Prefix string
+	Start  string
+	End    string
+	// CheckpointPath is where progress is saved every CheckpointEvery rows.
+	// Leave empty to run without checkpointing.
+	CheckpointPath  string
+	CheckpointEvery int
+}
+
+// Export streams the selected rows to w without checkpointing and returns
+// how many it wrote.
+func (e *Exporter) Export(ctx context.Context, w io.Writer) (int, error) {
+	wr, err := NewWriter(w, e.Format, e.Decode, true)
+	if err != nil {
+		return 0, err
+	}
+	cp := Checkpoint{Format: e.Format}
+	if err := e.stream(ctx, wr, &cp, nil); err != nil {
+		return cp.Rows, err
+	}
+	return cp.Rows, wr.Flush()
+}
+
+// Run streams the selected rows to the file at path, resuming from the
+// checkpoint if there is one, and returns how many rows the file holds.
+func (e *Exporter) Run(ctx context.Context, path string) (int, error) {
+	cp, err := e.loadCheckpoint(path)
+	if err != nil {
+		return 0, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if cp.Offset > 0 {
+		flags = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return cp.Rows, err
+	}
+	defer f.Close()
+	if cp.Offset > 0 {
+		// Drop anything written after the last checkpoint.
+		if err := f.Truncate(cp.Offset); err != nil {
+			return cp.Rows, err
+		}
+		if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+			return cp.Rows, err
+		}
+	}
+
+	offset := &countingWriter{w: f, n: cp.Offset}
+	w, err := NewWriter(offset, e.Format, e.Decode, cp.Offset == 0)
+	if err != nil {
+		return cp.Rows, err
+	}
+	save := func() error {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		cp.Offset = offset.n
+		return e.saveCheckpoint(cp)
+	}
+
+	if err := e.stream(ctx, w, &cp, save); err != nil {
+		if serr := save(); serr != nil {
+			return cp.Rows, errors.Join(err, serr)
+		}
+		return cp.Rows, err
+	}
+	if err := w.Flush(); err != nil {
+		return cp.Rows, err
+	}
+	if err := f.Close(); err != nil {
+		return cp.Rows, err
+	}
+	return cp.Rows, e.clearCheckpoint()
+}
+
+// stream writes the rows after cp.LastKey, calling save every
+// CheckpointEvery rows.
+func (e *Exporter) stream(ctx context.Context, w *Writer, cp *Checkpoint, save func() error) error {
+	var werr error
+	err := e.Table.ReadRows(ctx, e.rowSet(cp.LastKey), func(row bigtable.Row) bool {
+		if werr = w.Write(FromBigtable(row, e.Decode)); werr != nil {
+			return false
+		}
+		cp.Rows++
+		cp.LastKey = row.Key()
+		if save != nil && e.CheckpointEvery > 0 && cp.Rows%e.CheckpointEvery == 0 {
+			werr = save()
+		}
+		return werr == nil
+	})
+	if werr != nil {
+		return fmt.Errorf("could not write row %d: %v", cp.Rows, werr)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read rows after %q: %v", cp.LastKey, err)
+	}
+	return nil
+}
+
+func (e *Exporter) rowSet(after string) bigtable.RowSet {
+	if e.Prefix != "" {
+		if after == "" {
+			return bigtable.PrefixRange(e.Prefix)
+		}
+		if end := prefixEnd(e.Prefix); end != "" {
+			return bigtable.NewRange(after+"\x00", end)
+		}
+		return bigtable.InfiniteRange(after + "\x00")
+	}
+	start := e.Start
+	if after != "" {
+		start = after + "\x00"
+	}
+	if e.End == "" {
+		return bigtable.InfiniteRange(start)
+	}
+	return bigtable.NewRange(start, e.End)
+}
+
+// prefixEnd is the first key after every key starting with prefix, or "" if
+// there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func (e *Exporter) loadCheckpoint(path string) (Checkpoint, error) {
+	fresh := Checkpoint{Output: path, Format: e.Format}
+	if e.CheckpointPath == "" {
+		return fresh, nil
+	}
+	b, err := os.ReadFile(e.CheckpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh, nil
+	} else if err != nil {
+		return fresh, fmt.Errorf("could not read checkpoint: %v", err)
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return fresh, fmt.Errorf("could not parse checkpoint %s: %v", e.CheckpointPath, err)
+	}
+	if cp.Output != path || cp.Format != e.Format {
+		return fresh, fmt.Errorf("checkpoint %s is for a %s export to %s", e.CheckpointPath, cp.Format, cp.Output)
+	}
+	return cp, nil
+}
+
+func (e *Exporter) saveCheckpoint(cp Checkpoint) error {
+	if e.CheckpointPath == "" {
+		return nil
+	}
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := e.CheckpointPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("could not write checkpoint: %v", err)
+	}
+	return os.Rename(tmp, e.CheckpointPath)
+}
+
+func (e *Exporter) clearCheckpoint() error {
+	if e.CheckpointPath == "" {
+		return nil
+	}
+	if err := os.Remove(e.CheckpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove checkpoint: %v", err)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
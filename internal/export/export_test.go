@@ -0,0 +1,130 @@
+package export_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/export"
+	"github.com/theotheradamsmith/btemulator/internal/importer"
+)
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := btetest.New(t, build.Scenarios...)
+	want, err := btetest.Dump(ctx, src.Table)
+	assert.NoError(t, err)
+
+	for _, format := range []string{export.FormatJSONL, export.FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			e := &export.Exporter{Table: src.Table, Format: format, Decode: true}
+			n, err := e.Export(ctx, &buf)
+			assert.NoError(t, err)
+			assert.True(t, n > 0)
+
+			dst := btetest.New(t)
+			rd, err := export.NewReader(&buf, format)
+			assert.NoError(t, err)
+			rep, err := (&importer.Importer{Table: dst.Table, ChunkSize: 3}).Restore(ctx, rd)
+			assert.NoError(t, err)
+			assert.Equal(t, n, rep.Imported)
+			assert.Equal(t, 0, len(rep.Errors))
+
+			got, err := btetest.Dump(ctx, dst.Table)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.Scenarios...)
+	var buf bytes.Buffer
+	e := &export.Exporter{Table: env.Table, Format: export.FormatJSONL, Decode: true, Prefix: "qid-already-registered#"}
+	n, err := e.Export(ctx, &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var row export.Row
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &row))
+	decoded := make(map[string]string)
+	for _, c := range row.Cells {
+		decoded[c.Family+":"+c.Column] = c.Decoded
+	}
+	assert.Equal(t, `"hardware"`, decoded["DeviceProperties:Trusted"])
+	assert.Equal(t, "2023-10-01T12:00:00.000Z", decoded["RegistrationProperties:Registered"])
+}
+
+func TestResume(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.Scenarios...)
+	dir := t.TempDir()
+
+	var full bytes.Buffer
+	_, err := (&export.Exporter{Table: env.Table, Format: export.FormatJSONL}).Export(ctx, &full)
+	assert.NoError(t, err)
+	lines := strings.SplitAfter(full.String(), "\n")
+
+	// Pretend an export died after checkpointing two rows, part way through
+	// writing the third.
+	var row export.Row
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &row))
+	done := lines[0] + lines[1]
+	out := filepath.Join(dir, "out.jsonl")
+	assert.NoError(t, os.WriteFile(out, []byte(done+lines[2][:10]), 0o644))
+	cp, err := json.Marshal(export.Checkpoint{Output: out, Format: export.FormatJSONL, LastKey: row.Key, Offset: int64(len(done)), Rows: 2})
+	assert.NoError(t, err)
+	cpPath := filepath.Join(dir, "export.checkpoint")
+	assert.NoError(t, os.WriteFile(cpPath, cp, 0o644))
+
+	e := &export.Exporter{Table: env.Table, Format: export.FormatJSONL, CheckpointPath: cpPath, CheckpointEvery: 1}
+	n, err := e.Run(ctx, out)
+	assert.NoError(t, err)
+	assert.Equal(t, len(lines)-1, n)
+	got, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, full.String(), string(got))
+	_, err = os.Stat(cpPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMalformedRows(t *testing.T) {
+	t.Parallel()
+	in := "key,family,column,timestamp,value\n" +
+		"a,DeviceProperties,DeviceId,1000,ZGlk\n" +
+		"b,DeviceProperties,DeviceId,oops,ZGlk\n" +
+		"b,DeviceProperties,CreatedDate,1000,ZGlk\n" +
+		"c,DeviceProperties,DeviceId,1000,ZGlk\n"
+	rd, err := export.NewReader(strings.NewReader(in), export.FormatCSV)
+	assert.NoError(t, err)
+	var keys []string
+	malformed := 0
+	for {
+		row, err := rd.Next()
+		if errors.Is(err, export.ErrMalformed) {
+			malformed++
+			assert.Equal(t, 3, rd.Line)
+			continue
+		}
+		if err != nil {
+			break
+		}
+		keys = append(keys, row.Key)
+	}
+	assert.Equal(t, []string{"a", "c"}, keys)
+	assert.Equal(t, 1, malformed)
+}
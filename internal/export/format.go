@@ -0,0 +1,267 @@
+// Package export streams table rows to files and reads them back.
+//
+// Two formats are written, both holding every cell version of every row:
+//
+// JSONL has one row per line:
+//
+//	{"key":"qid-1#did-1","cells":[{"family":"DeviceProperties","column":"DeviceId","timestamp":1696161600000000,"value":"ZGlkLTE="}]}
+//
+// CSV has a header line, then one cell per line with a row's cells on
+// consecutive lines:
+//
+//	key,family,column,timestamp,value
+//	qid-1#did-1,DeviceProperties,DeviceId,1696161600000000,ZGlkLTE=
+//
+// Rows appear in key order and cells in family, column and newest-first
+// timestamp order. Timestamps are Bigtable microseconds since the Unix
+// epoch. Values are standard padded base64 of the cell bytes. When decoding
+// is asked for, each cell also carries a "decoded" field (a trailing CSV
+// column) with the value as the schema registry reads it; it is for people
+// and is ignored when the file is read back.
+package export
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// ErrMalformed is a row that could not be read back. The Reader can carry on
+// with the rows after it.
+var ErrMalformed = errors.New("malformed row")
+
+var csvHeader = []string{"key", "family", "column", "timestamp", "value"}
+
+type Cell struct {
+	Family    string `json:"family"`
+	Column    string `json:"column"`
+	Timestamp int64  `json:"timestamp"`
+	Value     []byte `json:"value"`
+	Decoded   string `json:"decoded,omitempty"`
+}
+
+type Row struct {
+	Key   string `json:"key"`
+	Cells []Cell `json:"cells"`
+}
+
+// FromBigtable converts a row read from the table, decoding each value
+// through the schema registry if decode is set.
+func FromBigtable(row bigtable.Row, decode bool) Row {
+	families := make([]string, 0, len(row))
+	for family := range row {
+		families = append(families, family)
+	}
+	sort.Strings(families)
+
+	r := Row{Key: row.Key()}
+	for _, family := range families {
+		for _, item := range row[family] {
+			_, column := schema.SplitColumn(item.Column)
+			c := Cell{Family: family, Column: column, Timestamp: int64(item.Timestamp), Value: item.Value}
+			if decode {
+				c.Decoded = schema.DecodeValue(family, column, item.Value)
+			}
+			r.Cells = append(r.Cells, c)
+		}
+	}
+	return r
+}
+
+// Mutation writes every cell of r with its original timestamp.
+func (r Row) Mutation() *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	for _, c := range r.Cells {
+		mut.Set(c.Family, c.Column, bigtable.Timestamp(c.Timestamp), c.Value)
+	}
+	return mut
+}
+
+// Writer writes rows in one of the formats.
+type Writer struct {
+	format string
+	decode bool
+	buf    *bufio.Writer
+	csv    *csv.Writer
+}
+
+// NewWriter returns a Writer for format. If header is set, a CSV writer
+// starts with the header line.
+func NewWriter(w io.Writer, format string, decode, header bool) (*Writer, error) {
+	wr := &Writer{format: format, decode: decode, buf: bufio.NewWriter(w)}
+	switch format {
+	case FormatJSONL:
+	case FormatCSV:
+		wr.csv = csv.NewWriter(wr.buf)
+		if header {
+			h := csvHeader
+			if decode {
+				h = append(h[:len(h):len(h)], "decoded")
+			}
+			if err := wr.csv.Write(h); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	return wr, nil
+}
+
+func (w *Writer) Write(r Row) error {
+	if w.format == FormatJSONL {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.buf.Write(append(b, '\n'))
+		return err
+	}
+	for _, c := range r.Cells {
+		rec := []string{r.Key, c.Family, c.Column, strconv.FormatInt(c.Timestamp, 10), base64.StdEncoding.EncodeToString(c.Value)}
+		if w.decode {
+			rec = append(rec, c.Decoded)
+		}
+		if err := w.csv.Write(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes out everything written so far.
+func (w *Writer) Flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// Reader reads back rows written by a Writer.
+type Reader struct {
+	format string
+	jsonl  *bufio.Scanner
+	csv    *csv.Reader
+	next   []string
+	skip   string
+	line   int
+	// Line is the line the last row returned by Next started on.
+	Line int
+}
+
+func NewReader(r io.Reader, format string) (*Reader, error) {
+	rd := &Reader{format: format}
+	switch format {
+	case FormatJSONL:
+		rd.jsonl = bufio.NewScanner(r)
+		rd.jsonl.Buffer(nil, 64<<20)
+	case FormatCSV:
+		rd.csv = csv.NewReader(r)
+		rd.csv.FieldsPerRecord = -1
+		h, err := rd.csv.Read()
+		if err != nil {
+			return nil, fmt.Errorf("could not read CSV header: %v", err)
+		}
+		if len(h) < len(csvHeader) || fmt.Sprint(h[:len(csvHeader)]) != fmt.Sprint(csvHeader) {
+			return nil, fmt.Errorf("CSV header is %v, want %v", h, csvHeader)
+		}
+		rd.line = 1
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	return rd, nil
+}
+
+// Next returns the next row, or io.EOF after the last.
+func (rd *Reader) Next() (Row, error) {
+	if rd.format == FormatJSONL {
+		for rd.jsonl.Scan() {
+			rd.line++
+			if len(rd.jsonl.Bytes()) == 0 {
+				continue
+			}
+			rd.Line = rd.line
+			var r Row
+			if err := json.Unmarshal(rd.jsonl.Bytes(), &r); err != nil {
+				return Row{}, fmt.Errorf("%w: line %d: %v", ErrMalformed, rd.line, err)
+			}
+			if r.Key == "" {
+				return Row{}, fmt.Errorf("%w: line %d: row has no key", ErrMalformed, rd.line)
+			}
+			return r, nil
+		}
+		if err := rd.jsonl.Err(); err != nil {
+			return Row{}, err
+		}
+		return Row{}, io.EOF
+	}
+
+	var r Row
+	for {
+		rec := rd.next
+		rd.next = nil
+		if rec == nil {
+			var err error
+			rec, err = rd.csv.Read()
+			if err == io.EOF && r.Key != "" {
+				return r, nil
+			} else if err != nil {
+				return Row{}, err
+			}
+			rd.line++
+		}
+		if rec[0] == rd.skip && r.Key == "" {
+			continue
+		}
+		if r.Key != "" && rec[0] != r.Key {
+			rd.next = rec
+			return r, nil
+		}
+		c, err := parseCell(rec)
+		if err != nil {
+			// Drop the rest of the row rather than return part of it.
+			rd.skip = rec[0]
+			if r.Key == "" {
+				rd.Line = rd.line
+			}
+			return Row{}, fmt.Errorf("%w: line %d: %v", ErrMalformed, rd.line, err)
+		}
+		if r.Key == "" {
+			r.Key = rec[0]
+			rd.Line = rd.line
+		}
+		r.Cells = append(r.Cells, c)
+	}
+}
+
+func parseCell(rec []string) (Cell, error) {
+	if len(rec) < len(csvHeader) || rec[0] == "" {
+		return Cell{}, fmt.Errorf("want key, family, column, timestamp and value")
+	}
+	ts, err := strconv.ParseInt(rec[3], 10, 64)
+	if err != nil {
+		return Cell{}, fmt.Errorf("bad timestamp %q", rec[3])
+	}
+	v, err := base64.StdEncoding.DecodeString(rec[4])
+	if err != nil {
+		return Cell{}, fmt.Errorf("bad value: %v", err)
+	}
+	return Cell{Family: rec[1], Column: rec[2], Timestamp: ts, Value: v}, nil
+}
@@ -0,0 +1,256 @@
+// Package gateway serves the registration backend's HTTP/JSON API on top of
+// internal/access, so appliance and mobile clients can be tested against the
+// emulator. The API is described by openapi.json.
+package gateway
+
+import (
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/util"
+)
+
+//go:embed openapi.json
+var Spec []byte
+
+var ErrBadRequest = errors.New("bad request")
+
+type Pairing struct {
+	AID string `json:"aid"`
+	QID string `json:"qid"`
+	DID string `json:"did"`
+}
+
+type Status struct {
+	AID   string       `json:"aid"`
+	State access.State `json:"state"`
+}
+
+type RegisterRequest struct {
+	AID       string `json:"aid"`
+	AppK      string `json:"appk"`
+	DeviceKey string `json:"deviceKey"`
+	Trusted   string `json:"trusted"`
+}
+
+type Registration struct {
+	Status
+	Challenge string `json:"challenge"`
+}
+
+type ResponseRequest struct {
+	AppK     string `json:"appk"`
+	Response string `json:"response"`
+	// Attestation is a PEM certificate chain for the device key, leaf first.
+	Attestation string `json:"attestation,omitempty"`
+}
+
+type DeregisterRequest struct {
+	AppK string `json:"appk"`
+}
+
+type Error struct {
+	Error string `json:"error"`
+}
+
+type Server struct {
+	Registrar *access.Registrar
+
+	mux *http.ServeMux
+}
+
+func New(r *access.Registrar) *Server {
+	s := &Server{Registrar: r, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/openapi.json", s.spec)
+	s.mux.HandleFunc("/v1/pairings/", s.pairing)
+	s.mux.HandleFunc("/v1/registrations", s.register)
+	s.mux.HandleFunc("/v1/registrations/", s.registration)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) spec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(Spec)
+}
+
+// GET /v1/pairings/{aid}
+func (s *Server) pairing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	poolKey, err := access.ReadAidRow(r.Context(), s.Registrar.Table, strings.TrimPrefix(r.URL.Path, "/v1/pairings/"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rp, err := access.SplitRPKey(poolKey)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Pairing{AID: rp.AID, QID: rp.QID, DID: rp.DID})
+}
+
+// POST /v1/registrations claims the device for an appliance and issues it a
+// challenge.
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var req RegisterRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.AppK == "" {
+		writeError(w, fmt.Errorf("%w: appk is required", ErrBadRequest))
+		return
+	}
+	if req.DeviceKey == "" {
+		writeError(w, fmt.Errorf("%w: deviceKey is required", ErrBadRequest))
+		return
+	}
+	if !util.SliceContains(access.TrustLevels, req.Trusted) {
+		writeError(w, fmt.Errorf("%w: trusted must be one of %s", ErrBadRequest, strings.Join(access.TrustLevels, ", ")))
+		return
+	}
+	in, challenge, err := s.Registrar.Claim(r.Context(), req.AID, req.AppK, req.DeviceKey, req.Trusted)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, Registration{Status: Status{AID: in.AID, State: access.StateInFlight}, Challenge: challenge})
+}
+
+// /v1/registrations/{aid} and /v1/registrations/{aid}/response
+func (s *Server) registration(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/registrations/"), "/")
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		s.status(w, r, id)
+	case sub == "" && r.Method == http.MethodDelete:
+		s.deregister(w, r, id)
+	case sub == "":
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	case sub == "response" && r.Method == http.MethodPost:
+		s.respond(w, r, id)
+	case sub == "response":
+		methodNotAllowed(w, http.MethodPost)
+	default:
+		writeJSON(w, http.StatusNotFound, Error{Error: "not found"})
+	}
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request, id string) {
+	state, _, err := access.GetState(r.Context(), s.Registrar.Table, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	canonical, _ := aid.Parse(id)
+	writeJSON(w, http.StatusOK, Status{AID: canonical, State: state})
+}
+
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, id string) {
+	var req ResponseRequest
+	err := readJSON(r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Attestation == "" {
+		err = s.Registrar.Complete(r.Context(), id, req.AppK, req.Response)
+	} else {
+		var chain []*x509.Certificate
+		if chain, err = access.ParseCertificates([]byte(req.Attestation)); err != nil {
+			writeError(w, fmt.Errorf("%w: attestation: %v", ErrBadRequest, err))
+			return
+		}
+		err = s.Registrar.CompleteAttested(r.Context(), id, req.AppK, req.Response, chain)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	canonical, _ := aid.Parse(id)
+	writeJSON(w, http.StatusOK, Status{AID: canonical, State: access.StateRegistered})
+}
+
+func (s *Server) deregister(w http.ResponseWriter, r *http.Request, id string) {
+	var req DeregisterRequest
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.Registrar.Deregister(r.Context(), id, req.AppK); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statusOf maps the errors access returns to HTTP statuses.
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrBadRequest),
+		errors.Is(err, aid.ErrLength), errors.Is(err, aid.ErrCharacter), errors.Is(err, aid.ErrChecksum),
+		errors.Is(err, access.ErrBadAppK), errors.Is(err, access.ErrBadDeviceKey), errors.Is(err, access.ErrBadTrust):
+		return http.StatusBadRequest
+	case errors.Is(err, access.ErrWrongAppK), errors.Is(err, access.ErrBadResponse),
+		errors.Is(err, access.ErrNoAttestation), errors.Is(err, access.ErrBadAttestation):
+		return http.StatusForbidden
+	case errors.Is(err, access.ErrNoPairing):
+		return http.StatusNotFound
+	case errors.Is(err, access.ErrAlreadyClaimed), errors.Is(err, access.ErrAlreadyRegistered),
+		errors.Is(err, access.ErrNoAppK), errors.Is(err, access.ErrNoDeviceKey), errors.Is(err, access.ErrNoChallenge),
+		errors.Is(err, access.ErrNotHardware),
+		errors.Is(err, access.ErrChallengeExpired), errors.Is(err, access.ErrChallengeReplayed):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := statusOf(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Request failed: %v", err)
+	}
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, Error{Error: "method not allowed"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not write response: %v", err)
+	}
+}
+
+func readJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return nil
+}
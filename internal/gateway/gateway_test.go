@@ -0,0 +1,216 @@
+package gateway_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/gateway"
+	"github.com/theotheradamsmith/btemulator/internal/testca"
+)
+
+const (
+	pairedAID  = "km69a-b3boj-1w6ft-9mh83-wao7m"
+	missingAID = "ns86o-94h6x-x9y51-o5xj6-og3n9"
+)
+
+// contract checks every response against the operation openapi.json
+// documents for it.
+type contract struct {
+	t    *testing.T
+	srv  *httptest.Server
+	ca   *testca.CA
+	spec map[string]any
+}
+
+func newContract(t *testing.T) *contract {
+	env := btetest.New(t, build.Scenarios...)
+	ca, err := testca.New("Vendor", env.Clock.Now())
+	assert.NoError(t, err)
+	srv := httptest.NewServer(gateway.New(&access.Registrar{Table: env.Table, Clock: env.Clock, AttestationRoots: ca.Pool()}))
+	t.Cleanup(srv.Close)
+	c := &contract{t: t, srv: srv, ca: ca}
+	assert.NoError(t, json.Unmarshal(gateway.Spec, &c.spec))
+	return c
+}
+
+// call makes a request to path, which is route with {aid} filled in, and
+// returns the decoded body after checking the status is want and the body
+// matches the documented schema.
+func (c *contract) call(method, route, aid string, body any, want int) map[string]any {
+	c.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		assert.NoError(c.t, err)
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.srv.URL+strings.ReplaceAll(route, "{aid}", aid), r)
+	assert.NoError(c.t, err)
+	resp, err := c.srv.Client().Do(req)
+	assert.NoError(c.t, err)
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	assert.NoError(c.t, err)
+	assert.Equal(c.t, want, resp.StatusCode, "%s %s: %s", method, route, raw)
+
+	op := c.lookup("paths", route, strings.ToLower(method))
+	assert.NotZero(c.t, op, "%s %s is not in the spec", method, route)
+	documented := c.resolve(op["responses"].(map[string]any)[strconv.Itoa(resp.StatusCode)])
+	assert.NotZero(c.t, documented, "%s %s: status %d is not documented", method, route, resp.StatusCode)
+
+	content, ok := documented["content"].(map[string]any)
+	if !ok {
+		assert.Equal(c.t, 0, len(raw), "%s %s: undocumented body %s", method, route, raw)
+		return nil
+	}
+	assert.Equal(c.t, "application/json", resp.Header.Get("Content-Type"))
+	var got any
+	assert.NoError(c.t, json.Unmarshal(raw, &got), "%s", raw)
+	schema := content["application/json"].(map[string]any)["schema"]
+	c.validate(method+" "+route, got, c.resolve(schema))
+	return got.(map[string]any)
+}
+
+func (c *contract) lookup(path ...string) map[string]any {
+	var node any = c.spec
+	for _, p := range path {
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = m[p]
+	}
+	m, _ := node.(map[string]any)
+	return m
+}
+
+func (c *contract) resolve(node any) map[string]any {
+	m, _ := node.(map[string]any)
+	if ref, ok := m["$ref"].(string); ok {
+		return c.resolve(c.lookup(strings.Split(strings.TrimPrefix(ref, "#/"), "/")...))
+	}
+	return m
+}
+
+func (c *contract) validate(where string, v any, schema map[string]any) {
+	c.t.Helper()
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		assert.True(c.t, ok, "%s: want an object, got %v", where, v)
+		for _, name := range schema["required"].([]any) {
+			_, ok := obj[name.(string)]
+			assert.True(c.t, ok, "%s: missing %s", where, name)
+		}
+		props := schema["properties"].(map[string]any)
+		for name, value := range obj {
+			prop, ok := props[name]
+			assert.True(c.t, ok, "%s: undocumented property %s", where, name)
+			c.validate(where+"."+name, value, c.resolve(prop))
+		}
+	case "string":
+		s, ok := v.(string)
+		assert.True(c.t, ok, "%s: want a string, got %v", where, v)
+		if enum, ok := schema["enum"].([]any); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			assert.True(c.t, found, "%s: %q is not one of %v", where, s, enum)
+		}
+	}
+}
+
+func TestContract(t *testing.T) {
+	t.Parallel()
+	c := newContract(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	deviceKey, err := access.EncodePublicKey(key.Public())
+	assert.NoError(t, err)
+	const appk = "appk-contract"
+
+	got := c.call("GET", "/v1/pairings/{aid}", strings.ToUpper(pairedAID), nil, http.StatusOK)
+	assert.Equal(t, map[string]any{"aid": pairedAID, "qid": "qid-1", "did": "did-1"}, got)
+	c.call("GET", "/v1/pairings/{aid}", missingAID, nil, http.StatusNotFound)
+	c.call("GET", "/v1/pairings/{aid}", "not-an-aid", nil, http.StatusBadRequest)
+
+	got = c.call("GET", "/v1/registrations/{aid}", pairedAID, nil, http.StatusOK)
+	assert.Equal(t, "ready", got["state"])
+
+	c.call("POST", "/v1/registrations", "", gateway.RegisterRequest{AID: pairedAID, AppK: appk, DeviceKey: deviceKey, Trusted: "maybe"}, http.StatusBadRequest)
+	c.call("POST", "/v1/registrations", "", map[string]string{"aid": pairedAID, "appk": appk, "extra": "x"}, http.StatusBadRequest)
+	c.call("POST", "/v1/registrations", "", gateway.RegisterRequest{AID: pairedAID, AppK: appk, Trusted: "software"}, http.StatusBadRequest)
+	c.call("POST", "/v1/registrations", "", gateway.RegisterRequest{AID: pairedAID, AppK: appk, DeviceKey: "not-a-key", Trusted: "software"}, http.StatusBadRequest)
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: "x"}, http.StatusConflict)
+
+	got = c.call("POST", "/v1/registrations", "", gateway.RegisterRequest{AID: pairedAID, AppK: appk, DeviceKey: deviceKey, Trusted: "software"}, http.StatusCreated)
+	assert.Equal(t, "in-flight", got["state"])
+	challenge := got["challenge"].(string)
+	assert.NotZero(t, challenge)
+	response, err := access.SignChallenge(key, challenge)
+	assert.NoError(t, err)
+	c.call("POST", "/v1/registrations", "", gateway.RegisterRequest{AID: pairedAID, AppK: "other", DeviceKey: deviceKey, Trusted: "software"}, http.StatusConflict)
+	got = c.call("GET", "/v1/registrations/{aid}", pairedAID, nil, http.StatusOK)
+	assert.Equal(t, "in-flight", got["state"])
+
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: "other", Response: challenge}, http.StatusForbidden)
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: challenge}, http.StatusForbidden)
+	got = c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: response}, http.StatusOK)
+	assert.Equal(t, "registered", got["state"])
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: response}, http.StatusConflict)
+
+	c.call("DELETE", "/v1/registrations/{aid}", pairedAID, gateway.DeregisterRequest{AppK: "other"}, http.StatusForbidden)
+	c.call("DELETE", "/v1/registrations/{aid}", pairedAID, gateway.DeregisterRequest{AppK: deviceKey}, http.StatusForbidden)
+	c.call("DELETE", "/v1/registrations/{aid}", pairedAID, gateway.DeregisterRequest{AppK: appk}, http.StatusNoContent)
+	got = c.call("GET", "/v1/registrations/{aid}", pairedAID, nil, http.StatusOK)
+	assert.Equal(t, "ready", got["state"])
+	c.call("DELETE", "/v1/registrations/{aid}", pairedAID, gateway.DeregisterRequest{AppK: appk}, http.StatusConflict)
+
+	got = c.call("POST", "/v1/registrations", "", gateway.RegisterRequest{AID: pairedAID, AppK: appk, DeviceKey: deviceKey, Trusted: "hardware"}, http.StatusCreated)
+	response, err = access.SignChallenge(key, got["challenge"].(string))
+	assert.NoError(t, err)
+	chain, err := c.ca.Issue(key.Public(), "device")
+	assert.NoError(t, err)
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: response}, http.StatusForbidden)
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: response, Attestation: "x"}, http.StatusBadRequest)
+	c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: response, Attestation: string(testca.EncodePEM(chain[1:]...))}, http.StatusForbidden)
+	got = c.call("POST", "/v1/registrations/{aid}/response", pairedAID, gateway.ResponseRequest{AppK: appk, Response: response, Attestation: string(testca.EncodePEM(chain...))}, http.StatusOK)
+	assert.Equal(t, "registered", got["state"])
+}
+
+func TestSpecCoversRoutes(t *testing.T) {
+	t.Parallel()
+	var spec struct {
+		Paths map[string]map[string]any `json:"paths"`
+	}
+	assert.NoError(t, json.Unmarshal(gateway.Spec, &spec))
+	var ops []string
+	for path, methods := range spec.Paths {
+		for method := range methods {
+			ops = append(ops, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	assert.Equal(t, []string{
+		"DELETE /v1/registrations/{aid}",
+		"GET /v1/pairings/{aid}",
+		"GET /v1/registrations/{aid}",
+		"POST /v1/registrations",
+		"POST /v1/registrations/{aid}/response",
+	}, ops)
+}
@@ -0,0 +1,226 @@
+// Package gen generates realistic, reproducible synthetic devices.
+package gen
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+type Config struct {
+	Seed    int64
+	Devices int
+	// States weights the registration state each device is left in.
+	States map[access.State]int
+	// DevicesPerQID weights how many devices share each QID.
+	DevicesPerQID map[int]int
+	// CreatedSpread is how far before Now CreatedDate values reach back.
+	CreatedSpread time.Duration
+	Now           time.Time
+}
+
+var (
+	DefaultStates        = map[access.State]int{access.StateReady: 60, access.StateClaimed: 5, access.StateInFlight: 5, access.StateRegistered: 30}
+	DefaultDevicesPerQID = map[int]int{1: 50, 2: 25, 3: 15, 5: 10}
+)
+
+type Device struct {
+	schema.DeviceEntry
+	State access.State
+	AppK  string
+	// DeviceKey is the public half of build.DeviceKey(DID), so generated
+	// challenges can be answered.
+	DeviceKey string
+	Trusted   string
+	Challenge string
+	// ChallengeExpiry is when an in-flight device's challenge expires,
+	// counted from Config.Now so the challenge can still be answered.
+	ChallengeExpiry time.Time
+	Created         time.Time
+	Registered      time.Time
+}
+
+// ErrExhausted is returned when Generate keeps drawing IDs it has already
+// used, which means cfg asks for more devices than the ID space has room for.
+var ErrExhausted = errors.New("ran out of unique IDs")
+
+// maxDraws is how many IDs in a row Generate draws before deciding the space
+// is exhausted.
+const maxDraws = 1000
+
+// Generate returns cfg.Devices devices. The same cfg always gives the same
+// devices.
+func Generate(cfg Config) ([]Device, error) {
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	states := weighted(rng, cfg.States, DefaultStates)
+	perQID := weighted(rng, cfg.DevicesPerQID, DefaultDevicesPerQID)
+
+	seen := make(map[string]bool)
+	var exhausted error
+	unique := func(what string, f func(*rand.Rand) string) string {
+		for i := 0; i < maxDraws; i++ {
+			if s := f(rng); !seen[s] {
+				seen[s] = true
+				return s
+			}
+		}
+		exhausted = fmt.Errorf("%w: no new %s in %d draws", ErrExhausted, what, maxDraws)
+		return ""
+	}
+
+	devices := make([]Device, 0, cfg.Devices)
+	for len(devices) < cfg.Devices {
+		qid := unique("QID", QID)
+		for n := perQID(); n > 0 && len(devices) < cfg.Devices; n-- {
+			d := Device{
+				DeviceEntry: schema.DeviceEntry{
+					AID: unique("AID", aid.Generate),
+					QID: qid,
+					DID: unique("DID", DID),
+					FCM: FCMToken(rng),
+				},
+				State:   states(),
+				Created: cfg.Now.Add(-time.Duration(rng.Int63n(int64(cfg.CreatedSpread) + 1))).Truncate(time.Second),
+			}
+			if d.State != access.StateReady {
+				d.AppK = AppK(rng)
+				d.DeviceKey = hex.EncodeToString(build.DeviceKey(d.DID).Public().(ed25519.PublicKey))
+				d.Trusted = []string{"hardware", "software"}[rng.Intn(2)]
+			}
+			if d.State == access.StateInFlight || d.State == access.StateRegistered {
+				d.Challenge = hex.EncodeToString(randBytes(rng, 16))
+			}
+			if d.State == access.StateInFlight {
+				d.ChallengeExpiry = cfg.Now.Add(access.DefaultChallengeTTL).Truncate(time.Millisecond)
+			}
+			if d.State == access.StateRegistered {
+				d.Registered = d.Created.Add(time.Duration(rng.Int63n(int64(cfg.Now.Sub(d.Created)) + 1))).Truncate(time.Millisecond)
+			}
+			devices = append(devices, d)
+		}
+		if exhausted != nil {
+			return nil, fmt.Errorf("after %d devices: %w", len(devices), exhausted)
+		}
+	}
+	return devices, nil
+}
+
+// Write seeds the pairing and main row of every device, with the columns
+// its state calls for. AppKs are sealed with sealer, which may be nil.
+func Write(ctx context.Context, tbl *bigtable.Table, devices []Device, sealer *envelope.Sealer) error {
+	keys := make([]string, 0, 2*len(devices))
+	muts := make([]*bigtable.Mutation, 0, 2*len(devices))
+	for _, d := range devices {
+		ts := bigtable.Time(d.Created)
+		created := []byte(d.Created.Format(time.UnixDate))
+
+		pool := bigtable.NewMutation()
+		pool.DeleteRow()
+		pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, created)
+
+		main := bigtable.NewMutation()
+		main.DeleteRow()
+		main.Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, ts, []byte(d.FCM))
+		main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, created)
+		main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, ts, []byte(d.DID))
+
+		if d.AppK != "" {
+			appk, err := sealer.Seal(ctx, []byte(d.AppK))
+			if err != nil {
+				return fmt.Errorf("could not seal AppK for %s: %w", d.AID, err)
+			}
+			// Hardware trust is only recorded once registration completes.
+			attesting := d.Trusted == access.TrustHardware && d.Registered.IsZero()
+			for _, m := range []*bigtable.Mutation{pool, main} {
+				m.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAppK, ts, appk)
+				if !attesting {
+					m.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnTrusted, ts, []byte(d.Trusted))
+				}
+			}
+			main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnAID, ts, []byte(d.AID))
+			main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDeviceKey, ts, []byte(d.DeviceKey))
+		}
+		if d.Challenge != "" {
+			main.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallenge, ts, []byte(d.Challenge))
+			if d.Registered.IsZero() {
+				main.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnChallengeExpiry, ts,
+					[]byte(strconv.FormatInt(d.ChallengeExpiry.UnixMilli(), 10)))
+			}
+		}
+		if !d.Registered.IsZero() {
+			main.Set(schema.ColumnFamilyRegistrationProperties, schema.ColumnRegistered, bigtable.Time(d.Registered),
+				[]byte(strconv.FormatInt(d.Registered.UnixMilli(), 10)))
+		}
+
+		mainKey := access.MainKey{QID: d.QID, DID: d.DID}
+		keys = append(keys, access.RPKey{AID: d.AID, MainKey: mainKey}.String(), mainKey.String())
+		muts = append(muts, pool, main)
+	}
+
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+		rowErrs, err := tbl.ApplyBulk(ctx, keys[start:end], muts[start:end])
+		if err != nil {
+			return fmt.Errorf("could not write generated devices: %v", err)
+		}
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				return fmt.Errorf("could not write %s: %v", keys[start+i], rowErr)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseWeights reads weights such as "ready=60,registered=40".
+func ParseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(part, "=")
+		w, err := strconv.Atoi(weight)
+		if !ok || err != nil || w < 0 {
+			return nil, fmt.Errorf("bad weight %q, want name=weight", part)
+		}
+		weights[strings.TrimSpace(name)] = w
+	}
+	return weights, nil
+}
+
+// weighted returns a function drawing keys of weights in proportion to their
+// weight, falling back to dflt when weights is empty.
+func weighted[K interface{ ~int | ~string }](rng *rand.Rand, weights, dflt map[K]int) func() K {
+	if len(weights) == 0 {
+		weights = dflt
+	}
+	keys := make([]K, 0, len(weights))
+	total := 0
+	for k, w := range weights {
+		keys = append(keys, k)
+		total += w
+	}
+	// Map order is random; sort so the same seed draws the same values.
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return func() K {
+		n := rng.Intn(max(total, 1))
+		for _, k := range keys {
+			if n -= weights[k]; n < 0 {
+				return k
+			}
+		}
+		return keys[len(keys)-1]
+	}
+}
@@ -0,0 +1,124 @@
+package gen_test
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/envelope"
+	"github.com/theotheradamsmith/btemulator/internal/gen"
+)
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+	cfg := gen.Config{
+		Seed:          42,
+		Devices:       200,
+		States:        map[access.State]int{access.StateReady: 1, access.StateRegistered: 1},
+		DevicesPerQID: map[int]int{2: 1},
+		CreatedSpread: 30 * 24 * time.Hour,
+		Now:           btetest.Epoch,
+	}
+	devices, err := gen.Generate(cfg)
+	assert.NoError(t, err)
+	again, err := gen.Generate(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, devices, again)
+	assert.Equal(t, 200, len(devices))
+
+	cfg.Seed++
+	other, err := gen.Generate(cfg)
+	assert.NoError(t, err)
+	assert.NotEqual(t, devices, other)
+
+	var (
+		qidRe = regexp.MustCompile(`^[a-z]+-[a-z]{3}-\d{3,6}$`)
+		fcmRe = regexp.MustCompile(`^[\w-]{22}:APA91b[\w-]{134}$`)
+	)
+	perQID := make(map[string]int)
+	states := make(map[access.State]int)
+	for _, d := range devices {
+		assert.True(t, aid.Valid(d.AID), "AID %q", d.AID)
+		assert.True(t, qidRe.MatchString(d.QID), "QID %q", d.QID)
+		assert.True(t, fcmRe.MatchString(d.FCM), "FCM %q", d.FCM)
+		assert.False(t, d.Created.After(btetest.Epoch))
+		assert.False(t, d.Created.Before(btetest.Epoch.Add(-cfg.CreatedSpread)))
+		assert.Equal(t, d.State == access.StateRegistered, d.AppK != "")
+		perQID[d.QID]++
+		states[d.State]++
+	}
+	assert.Equal(t, 100, len(perQID))
+	assert.True(t, states[access.StateReady] > 70 && states[access.StateRegistered] > 70, "%v", states)
+}
+
+func TestGenerateManyQIDs(t *testing.T) {
+	t.Parallel()
+	// More QIDs than foo-usd-123 style IDs with three digits can give.
+	const n = 120000
+	devices, err := gen.Generate(gen.Config{Seed: 1, Devices: n, DevicesPerQID: map[int]int{1: 1}, Now: btetest.Epoch})
+	assert.NoError(t, err)
+	assert.Equal(t, n, len(devices))
+}
+
+func TestWrite(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	devices, err := gen.Generate(gen.Config{Seed: 1, Devices: 50, CreatedSpread: time.Hour, Now: btetest.Epoch})
+	assert.NoError(t, err)
+	kms, err := envelope.OpenLocalKMS("")
+	assert.NoError(t, err)
+	_, err = kms.CreateKey("appk")
+	assert.NoError(t, err)
+	r := &access.Registrar{Table: env.Table, Sealer: &envelope.Sealer{Provider: kms.Key("appk")}}
+	assert.NoError(t, gen.Write(ctx, env.Table, devices, r.Sealer))
+
+	for _, d := range devices {
+		state, mainKey, err := access.GetState(ctx, env.Table, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, d.State, state, "%s", d.AID)
+		assert.Equal(t, access.MainKey{QID: d.QID, DID: d.DID}.String(), mainKey)
+		if d.AppK == "" {
+			continue
+		}
+		poolKey := access.RPKey{AID: d.AID, MainKey: access.MainKey{QID: d.QID, DID: d.DID}}.String()
+		stored, err := access.GetAppK(ctx, env.Table, poolKey)
+		assert.NoError(t, err)
+		assert.True(t, envelope.IsSealed(stored), "%s", d.AID)
+		appk, err := r.AppK(ctx, poolKey)
+		assert.NoError(t, err)
+		assert.Equal(t, d.AppK, string(appk))
+	}
+}
+
+func TestInFlightCompletes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	devices, err := gen.Generate(gen.Config{Seed: 3, Devices: 20, States: map[access.State]int{access.StateInFlight: 1}, CreatedSpread: 90 * 24 * time.Hour, Now: env.Clock.Now()})
+	assert.NoError(t, err)
+	assert.NoError(t, gen.Write(ctx, env.Table, devices, nil))
+
+	r := &access.Registrar{Table: env.Table, Clock: env.Clock}
+	var completed int
+	for _, d := range devices {
+		response, err := access.SignChallenge(build.DeviceKey(d.DID), d.Challenge)
+		assert.NoError(t, err)
+		err = r.Complete(ctx, d.AID, d.AppK, response)
+		// Hardware claims still need their attestation, but none has expired.
+		if d.Trusted == access.TrustHardware {
+			assert.IsError(t, err, access.ErrNoAttestation, "%s", d.AID)
+			continue
+		}
+		assert.NoError(t, err, "%s", d.AID)
+		completed++
+	}
+	assert.True(t, completed > 0)
+}
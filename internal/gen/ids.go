@@ -0,0 +1,47 @@
+package gen
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+)
+
+var (
+	qidNames      = []string{"foo", "bar", "acme", "globex", "initech", "umbrella", "hooli", "stark", "wayne", "wonka"}
+	qidCurrencies = []string{"usd", "gbp", "eur", "aud", "cad", "nzd"}
+)
+
+// QID returns a customer ID such as foo-usd-123, with three to six digits so
+// there are tens of millions to draw from.
+func QID(rng *rand.Rand) string {
+	return fmt.Sprintf("%s-%s-%d", qidNames[rng.Intn(len(qidNames))],
+		qidCurrencies[rng.Intn(len(qidCurrencies))], 100+rng.Intn(999900))
+}
+
+// DID returns a device ID in UUID form.
+func DID(rng *rand.Rand) string {
+	b := randBytes(rng, 16)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// FCMToken returns a Firebase Cloud Messaging registration token: an
+// instance ID, a colon and a long base64url payload.
+func FCMToken(rng *rand.Rand) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(randBytes(rng, 16))[:22] + ":APA91b" + enc.EncodeToString(randBytes(rng, 101))[:134]
+}
+
+// AppK returns a 256-bit appliance key in hex.
+func AppK(rng *rand.Rand) string {
+	return hex.EncodeToString(randBytes(rng, 32))
+}
+
+func randBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	return b
+}
@@ -0,0 +1,374 @@
+// Package importer loads device pairings from files into the table.
+package importer
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/export"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var (
+	ErrMissingField = errors.New("missing field")
+	ErrBadField     = errors.New("bad field")
+	ErrDuplicate    = errors.New("duplicate in file")
+	ErrExists       = errors.New("already in table")
+)
+
+const defaultChunk = 500
+
+// Mapping names the CSV header column holding each field.
+type Mapping struct {
+	AID string
+	QID string
+	DID string
+	FCM string
+}
+
+var DefaultMapping = Mapping{AID: "aid", QID: "qid", DID: "did", FCM: "fcm"}
+
+// ParseMapping reads a mapping such as "aid=Adoption ID,did=Serial",
+// keeping the default header for any field not named.
+func ParseMapping(s string) (Mapping, error) {
+	m := DefaultMapping
+	if s == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		field, header, ok := strings.Cut(part, "=")
+		if !ok || header == "" {
+			return m, fmt.Errorf("bad mapping %q, want field=header", part)
+		}
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "aid":
+			m.AID = header
+		case "qid":
+			m.QID = header
+		case "did":
+			m.DID = header
+		case "fcm":
+			m.FCM = header
+		default:
+			return m, fmt.Errorf("unknown field %q in mapping", field)
+		}
+	}
+	return m, nil
+}
+
+// RowError is a record that was not imported.
+type RowError struct {
+	Line   int
+	Device schema.DeviceEntry
+	Err    error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+type Report struct {
+	Records  int
+	Imported int
+	Errors   []RowError
+}
+
+type Importer struct {
+	Table   *bigtable.Table
+	Clock   clock.Clock
+	Mapping Mapping
+	// ChunkSize is how many records are checked and written per ApplyBulk.
+	ChunkSize int
+	// DryRun validates every record without writing any.
+	DryRun bool
+	// LegacyAIDs accepts AIDs issued before they had a check character.
+	LegacyAIDs bool
+}
+
+// Record is one device pairing read from line Line of a file.
+type Record struct {
+	Line int
+	schema.DeviceEntry
+}
+
+// ImportCSV imports every valid record of a CSV file with a header row.
+// Invalid records are skipped and listed in the report; the returned error
+// is only for failures that stop the whole import.
+func (im *Importer) ImportCSV(ctx context.Context, r io.Reader) (*Report, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %v", err)
+	}
+	cols, err := im.columns(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []Record
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read CSV: %v", err)
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(i int) string {
+			if i < 0 || i >= len(fields) {
+				return ""
+			}
+			return strings.TrimSpace(fields[i])
+		}
+		recs = append(recs, Record{Line: line, DeviceEntry: schema.DeviceEntry{
+			AID: field(cols[0]), QID: field(cols[1]), DID: field(cols[2]), FCM: field(cols[3]),
+		}})
+	}
+	return im.Import(ctx, recs)
+}
+
+// columns finds the header index of each mapped field. FCM may be absent.
+func (im *Importer) columns(header []string) ([4]int, error) {
+	m := im.Mapping
+	if m == (Mapping{}) {
+		m = DefaultMapping
+	}
+	cols := [4]int{-1, -1, -1, -1}
+	for i, name := range []string{m.AID, m.QID, m.DID, m.FCM} {
+		for j, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				cols[i] = j
+			}
+		}
+		if cols[i] < 0 && i < 3 {
+			return cols, fmt.Errorf("CSV has no %q column", name)
+		}
+	}
+	return cols, nil
+}
+
+// Import validates recs, then writes the ones that are neither duplicated in
+// recs nor already in the table.
+func (im *Importer) Import(ctx context.Context, recs []Record) (*Report, error) {
+	rep := &Report{Records: len(recs)}
+	reject := func(rec Record, err error) {
+		rep.Errors = append(rep.Errors, RowError{Line: rec.Line, Device: rec.DeviceEntry, Err: err})
+	}
+
+	var valid []Record
+	firstAID := make(map[string]int)
+	firstMain := make(map[string]int)
+	for _, rec := range recs {
+		if err := im.validate(&rec.DeviceEntry); err != nil {
+			reject(rec, err)
+			continue
+		}
+		mainKey := access.MainKey{QID: rec.QID, DID: rec.DID}.String()
+		if l, ok := firstAID[rec.AID]; ok {
+			reject(rec, fmt.Errorf("%w: AID %s is also on line %d", ErrDuplicate, rec.AID, l))
+			continue
+		}
+		if l, ok := firstMain[mainKey]; ok {
+			reject(rec, fmt.Errorf("%w: device %s is also on line %d", ErrDuplicate, mainKey, l))
+			continue
+		}
+		firstAID[rec.AID] = rec.Line
+		firstMain[mainKey] = rec.Line
+		valid = append(valid, rec)
+	}
+
+	chunk := im.ChunkSize
+	if chunk <= 0 {
+		chunk = defaultChunk
+	}
+	for start := 0; start < len(valid); start += chunk {
+		batch := valid[start:min(start+chunk, len(valid))]
+		fresh, err := im.unseen(ctx, batch, reject)
+		if err != nil {
+			return rep, err
+		}
+		if im.DryRun {
+			rep.Imported += len(fresh)
+			continue
+		}
+		n, err := im.write(ctx, fresh, reject)
+		rep.Imported += n
+		if err != nil {
+			return rep, err
+		}
+	}
+	sort.SliceStable(rep.Errors, func(i, j int) bool { return rep.Errors[i].Line < rep.Errors[j].Line })
+	return rep, nil
+}
+
+func (im *Importer) validate(d *schema.DeviceEntry) error {
+	for _, f := range []struct{ name, v string }{{"AID", d.AID}, {"QID", d.QID}, {"DID", d.DID}} {
+		if f.v == "" {
+			return fmt.Errorf("%w: %s", ErrMissingField, f.name)
+		}
+	}
+	parse := aid.ParseChecked
+	if im.LegacyAIDs {
+		parse = aid.Parse
+	}
+	id, err := parse(d.AID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadField, err)
+	}
+	d.AID = id
+	for _, f := range []struct{ name, v string }{{"QID", d.QID}, {"DID", d.DID}} {
+		if strings.Contains(f.v, "#") {
+			return fmt.Errorf("%w: %s %q contains the key separator #", ErrBadField, f.name, f.v)
+		}
+	}
+	return nil
+}
+
+// unseen drops the records of batch whose AID is already paired or whose
+// main row already exists.
+func (im *Importer) unseen(ctx context.Context, batch []Record, reject func(Record, error)) ([]Record, error) {
+	var (
+		aids     bigtable.RowRangeList
+		mainKeys bigtable.RowList
+	)
+	for _, rec := range batch {
+		aids = append(aids, bigtable.PrefixRange(rec.AID+"#"))
+		mainKeys = append(mainKeys, access.MainKey{QID: rec.QID, DID: rec.DID}.String())
+	}
+	paired := make(map[string]string)
+	err := im.Table.ReadRows(ctx, aids, func(row bigtable.Row) bool {
+		if rp, err := access.SplitRPKey(row.Key()); err == nil {
+			paired[rp.AID] = row.Key()
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		return nil, fmt.Errorf("could not read registration pool: %v", err)
+	}
+	existing := make(map[string]bool)
+	err = im.Table.ReadRows(ctx, mainKeys, func(row bigtable.Row) bool {
+		existing[row.Key()] = true
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		return nil, fmt.Errorf("could not read main rows: %v", err)
+	}
+
+	var fresh []Record
+	for _, rec := range batch {
+		mainKey := access.MainKey{QID: rec.QID, DID: rec.DID}.String()
+		if key, ok := paired[rec.AID]; ok {
+			reject(rec, fmt.Errorf("%w: AID %s is paired as %s", ErrExists, rec.AID, key))
+		} else if existing[mainKey] {
+			reject(rec, fmt.Errorf("%w: device %s", ErrExists, mainKey))
+		} else {
+			fresh = append(fresh, rec)
+		}
+	}
+	return fresh, nil
+}
+
+// write writes the pairing and main row of each record and returns how many
+// were written.
+func (im *Importer) write(ctx context.Context, recs []Record, reject func(Record, error)) (int, error) {
+	now := clock.Or(im.Clock).Now()
+	ts := bigtable.Time(now)
+	created := []byte(now.Format(time.UnixDate))
+	keys := make([]string, 0, 2*len(recs))
+	muts := make([]*bigtable.Mutation, 0, 2*len(recs))
+	for _, rec := range recs {
+		mainKey := access.MainKey{QID: rec.QID, DID: rec.DID}
+		pool := bigtable.NewMutation()
+		pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, created)
+		main := bigtable.NewMutation()
+		if rec.FCM != "" {
+			main.Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, ts, []byte(rec.FCM))
+		}
+		main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, created)
+		main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, ts, []byte(rec.DID))
+		keys = append(keys, access.RPKey{AID: rec.AID, MainKey: mainKey}.String(), mainKey.String())
+		muts = append(muts, pool, main)
+	}
+	rowErrs, err := im.Table.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return 0, fmt.Errorf("could not write records: %v", err)
+	}
+	failed := make(map[int]bool)
+	for i, rowErr := range rowErrs {
+		if rowErr != nil && !failed[i/2] {
+			failed[i/2] = true
+			reject(recs[i/2], fmt.Errorf("could not write %s: %v", keys[i], rowErr))
+		}
+	}
+	return len(recs) - len(failed), nil
+}
+
+// Restore writes back every row read from rd, such as a file written by
+// export, with its original cell timestamps. Rows that fail to write are
+// listed in the report.
+func (im *Importer) Restore(ctx context.Context, rd *export.Reader) (*Report, error) {
+	rep := &Report{}
+	chunk := im.ChunkSize
+	if chunk <= 0 {
+		chunk = defaultChunk
+	}
+	var (
+		keys  []string
+		muts  []*bigtable.Mutation
+		lines []int
+	)
+	flush := func() error {
+		if len(keys) == 0 || im.DryRun {
+			rep.Imported += len(keys)
+			keys, muts, lines = keys[:0], muts[:0], lines[:0]
+			return nil
+		}
+		rowErrs, err := im.Table.ApplyBulk(ctx, keys, muts)
+		if err != nil {
+			return fmt.Errorf("could not write rows: %v", err)
+		}
+		rep.Imported += len(keys)
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				rep.Imported--
+				rep.Errors = append(rep.Errors, RowError{Line: lines[i], Err: fmt.Errorf("could not write %s: %v", keys[i], rowErr)})
+			}
+		}
+		keys, muts, lines = keys[:0], muts[:0], lines[:0]
+		return nil
+	}
+	for {
+		row, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if errors.Is(err, export.ErrMalformed) {
+			rep.Records++
+			rep.Errors = append(rep.Errors, RowError{Line: rd.Line, Err: err})
+			continue
+		} else if err != nil {
+			return rep, err
+		}
+		rep.Records++
+		keys = append(keys, row.Key)
+		muts = append(muts, row.Mutation())
+		lines = append(lines, rd.Line)
+		if len(keys) == chunk {
+			if err := flush(); err != nil {
+				return rep, err
+			}
+		}
+	}
+	return rep, flush()
+}
@@ -0,0 +1,77 @@
+package importer_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/importer"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+const csvFile = `Serial,Adoption ID,Customer,Token
+did-a,WYSZZ TY4EY EQGTC AE44E 47YJA,qid-a,fcm-a
+did-b,f6bef-19n9f-ws6ck-ranir-35ksq,qid-b,fcm-b
+did-c,oz76q-k5yco-wjybf-fg8hs-xncpx,qid-c,fcm-c
+did-d,hky85-8y73a-uk6yg-ko8kx-hrqn3,,fcm-d
+did-e,hky85-8y73a-uk6yg-ko8kx-hrqn3,qid-e,fcm-e
+did-e,ayrt8-abkcx-1c6w3-pucsq-fyz4a,qid-e,fcm-f
+did-1,ns86o-94h6x-x9y51-o5xj6-og3n9,qid-1,fcm-g
+`
+
+func TestImportCSV(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.ScenarioDevices)
+	mapping, err := importer.ParseMapping("aid=Adoption ID,qid=Customer,did=Serial,fcm=Token")
+	assert.NoError(t, err)
+	im := &importer.Importer{Table: env.Table, Clock: env.Clock, Mapping: mapping, ChunkSize: 2}
+
+	rep, err := im.ImportCSV(ctx, strings.NewReader(csvFile))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, rep.Records)
+	assert.Equal(t, 2, rep.Imported)
+
+	lines := make(map[int]error)
+	for _, e := range rep.Errors {
+		lines[e.Line] = e.Err
+	}
+	assert.Equal(t, 5, len(lines))
+	// Line 3's AID is already paired with the second schema.Devices entry
+	// and line 8's device is the first.
+	assert.IsError(t, lines[3], importer.ErrExists)
+	assert.IsError(t, lines[4], importer.ErrBadField)
+	assert.IsError(t, lines[4], aid.ErrChecksum)
+	assert.IsError(t, lines[5], importer.ErrMissingField)
+	assert.IsError(t, lines[7], importer.ErrDuplicate)
+	assert.IsError(t, lines[8], importer.ErrExists)
+
+	for _, d := range []schema.DeviceEntry{
+		{AID: "wyszz-ty4ey-eqgtc-ae44e-47yja", QID: "qid-a", DID: "did-a"},
+		{AID: "hky85-8y73a-uk6yg-ko8kx-hrqn3", QID: "qid-e", DID: "did-e"},
+	} {
+		key, err := access.ReadAidRow(ctx, env.Table, d.AID)
+		assert.NoError(t, err)
+		assert.Equal(t, access.RPKey{AID: d.AID, MainKey: access.MainKey{QID: d.QID, DID: d.DID}}.String(), key)
+	}
+	row, err := env.Table.ReadRow(ctx, "qid-e#did-e")
+	assert.NoError(t, err)
+	btetest.AssertColumns(t, row, btetest.Cells{
+		"FirebaseProperties:FcmToken": "fcm-e",
+		"DeviceProperties:DeviceId":   "did-e",
+	})
+	t.Run("legacy AIDs are accepted when asked", func(t *testing.T) {
+		im := &importer.Importer{Table: env.Table, Clock: env.Clock, LegacyAIDs: true}
+		rep, err := im.Import(ctx, []importer.Record{{Line: 2, DeviceEntry: schema.DeviceEntry{
+			AID: "oz76q-k5yco-wjybf-fg8hs-xncpx", QID: "qid-c", DID: "did-c",
+		}}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, rep.Imported)
+	})
+}
@@ -0,0 +1,5 @@
+package rekey
+
+func SetAfterCopy(m *Migrator, f func() error) {
+	m.afterCopy = f
+}
@@ -0,0 +1,52 @@
+package rekey
+
+import (
+	"fmt"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+)
+
+// Layout maps a device's main key to the row key it is stored under.
+type Layout interface {
+	Name() string
+	Format(k access.MainKey) string
+	Parse(key string) (access.MainKey, error)
+}
+
+// LegacyLayout stores main rows as qid#did. Keys that are valid in the hashed
+// layout are rejected, so the two layouts never claim the same row.
+type LegacyLayout struct{}
+
+func (LegacyLayout) Name() string { return "legacy" }
+
+func (LegacyLayout) Format(k access.MainKey) string { return k.String() }
+
+func (LegacyLayout) Parse(key string) (access.MainKey, error) {
+	if _, err := (HashedLayout{}).Parse(key); err == nil {
+		return access.MainKey{}, fmt.Errorf("%w: %q is a hashed key", access.ErrBadKey, key)
+	}
+	return access.ParseMainKey(key)
+}
+
+// HashedLayout stores main rows as pppp.qid#did, where pppp is a hex hash of
+// qid#did that spreads sequential QIDs across tablets.
+type HashedLayout struct{}
+
+func (HashedLayout) Name() string { return "hashed" }
+
+func (HashedLayout) Format(k access.MainKey) string { return k.Hashed() }
+
+func (HashedLayout) Parse(key string) (access.MainKey, error) {
+	return access.ParseHashedMainKey(key)
+}
+
+var layouts = []Layout{LegacyLayout{}, HashedLayout{}}
+
+func LayoutByName(name string) (Layout, error) {
+	for _, l := range layouts {
+		if l.Name() == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key layout %q", name)
+}
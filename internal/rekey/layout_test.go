@@ -0,0 +1,30 @@
+package rekey_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/rekey"
+)
+
+func TestLayouts(t *testing.T) {
+	k := access.MainKey{QID: "foo-usd-123", DID: "device-one"}
+	t.Run("hashed keys round trip", func(t *testing.T) {
+		key := rekey.HashedLayout{}.Format(k)
+		parsed, err := rekey.HashedLayout{}.Parse(key)
+		assert.NoError(t, err)
+		assert.Equal(t, k, parsed)
+	})
+	t.Run("layouts do not claim each other's keys", func(t *testing.T) {
+		_, err := rekey.HashedLayout{}.Parse(rekey.LegacyLayout{}.Format(k))
+		assert.IsError(t, err, access.ErrBadKey)
+		_, err = rekey.LegacyLayout{}.Parse(rekey.HashedLayout{}.Format(k))
+		assert.IsError(t, err, access.ErrBadKey)
+	})
+	t.Run("registration pool keys are not main keys", func(t *testing.T) {
+		_, err := rekey.LegacyLayout{}.Parse("aid-1#qid-1#did-1")
+		assert.IsError(t, err, access.ErrBadKey)
+	})
+}
@@ -0,0 +1,269 @@
+package rekey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+)
+
+var ErrVerify = errors.New("copied row does not match source")
+
+// Checkpoint records how far a migration got, so an interrupted run can resume
+// after the last fully migrated batch.
+type Checkpoint struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	LastKey string `json:"lastKey"`
+	Stats   Stats  `json:"stats"`
+}
+
+type Stats struct {
+	Scanned int `json:"scanned"`
+	Copied  int `json:"copied"`
+	Deleted int `json:"deleted"`
+}
+
+// Migrator copies every main row from one key layout to another, verifies the
+// copy and then deletes the old keys, one batch at a time.
+type Migrator struct {
+	Table     *bigtable.Table
+	From      Layout
+	To        Layout
+	BatchSize int
+	// CheckpointPath is where progress is saved after each batch. Leave empty
+	// to run without checkpointing.
+	CheckpointPath string
+
+	// afterCopy is called once a batch is copied and verified but before its
+	// old rows are deleted; tests use it to crash a migration part way.
+	afterCopy func() error
+}
+
+func (m *Migrator) Run(ctx context.Context) (Stats, error) {
+	cp, err := m.loadCheckpoint()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	for {
+		rows, last, scanned, err := m.nextBatch(ctx, cp.LastKey)
+		if err != nil {
+			return cp.Stats, err
+		}
+		cp.Stats.Scanned += scanned
+		if len(rows) > 0 {
+			if err := m.migrate(ctx, rows); err != nil {
+				return cp.Stats, err
+			}
+			cp.Stats.Copied += len(rows)
+			cp.Stats.Deleted += len(rows)
+		}
+		if last == "" {
+			return cp.Stats, m.clearCheckpoint()
+		}
+		cp.LastKey = last
+		if err := m.saveCheckpoint(cp); err != nil {
+			return cp.Stats, err
+		}
+	}
+}
+
+// nextBatch reads rows after the given key until it has BatchSize rows in the
+// source layout. It returns the last key it looked at, or "" at end of table.
+func (m *Migrator) nextBatch(ctx context.Context, after string) ([]bigtable.Row, string, int, error) {
+	var (
+		rows    []bigtable.Row
+		last    string
+		scanned int
+	)
+	rr := bigtable.InfiniteRange("")
+	if after != "" {
+		rr = bigtable.InfiniteRange(after + "\x00")
+	}
+	err := m.Table.ReadRows(ctx, rr, func(row bigtable.Row) bool {
+		scanned++
+		last = row.Key()
+		if m.needsMigration(row.Key()) {
+			rows = append(rows, row)
+		}
+		return len(rows) < m.batchSize()
+	})
+	if err != nil {
+		return nil, "", scanned, fmt.Errorf("could not scan rows after %q: %v", after, err)
+	}
+	if len(rows) < m.batchSize() {
+		last = ""
+	}
+	return rows, last, scanned, nil
+}
+
+func (m *Migrator) needsMigration(key string) bool {
+	if _, err := m.From.Parse(key); err != nil {
+		return false
+	}
+	_, err := m.To.Parse(key)
+	return err != nil
+}
+
+func (m *Migrator) migrate(ctx context.Context, rows []bigtable.Row) error {
+	oldKeys := make([]string, len(rows))
+	newKeys := make([]string, len(rows))
+	muts := make([]*bigtable.Mutation, len(rows))
+	for i, row := range rows {
+		k, err := m.From.Parse(row.Key())
+		if err != nil {
+			return err
+		}
+		oldKeys[i] = row.Key()
+		newKeys[i] = m.To.Format(k)
+		muts[i] = copyMutation(row)
+	}
+
+	if err := applyBulk(ctx, m.Table, newKeys, muts); err != nil {
+		return fmt.Errorf("could not copy rows: %w", err)
+	}
+	if err := m.verify(ctx, rows, newKeys); err != nil {
+		return err
+	}
+	if m.afterCopy != nil {
+		if err := m.afterCopy(); err != nil {
+			return err
+		}
+	}
+
+	dels := make([]*bigtable.Mutation, len(oldKeys))
+	for i := range dels {
+		dels[i] = bigtable.NewMutation()
+		dels[i].DeleteRow()
+	}
+	if err := applyBulk(ctx, m.Table, oldKeys, dels); err != nil {
+		return fmt.Errorf("could not delete old rows: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) verify(ctx context.Context, rows []bigtable.Row, newKeys []string) error {
+	copied := make(map[string]bigtable.Row, len(newKeys))
+	err := m.Table.ReadRows(ctx, bigtable.RowList(newKeys), func(row bigtable.Row) bool {
+		copied[row.Key()] = row
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not read copied rows: %v", err)
+	}
+	for i, row := range rows {
+		if missing := missingCells(row, copied[newKeys[i]]); missing != "" {
+			return fmt.Errorf("%w: %s -> %s: %s", ErrVerify, row.Key(), newKeys[i], missing)
+		}
+	}
+	return nil
+}
+
+// copyMutation rewrites every cell version of row with its original timestamp.
+func copyMutation(row bigtable.Row) *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	for family, items := range row {
+		for _, item := range items {
+			mut.Set(family, qualifier(family, item.Column), item.Timestamp, item.Value)
+		}
+	}
+	return mut
+}
+
+// missingCells describes the first cell of src that is absent from dst.
+func missingCells(src, dst bigtable.Row) string {
+	have := make(map[string]bool)
+	for _, items := range dst {
+		for _, item := range items {
+			have[cellID(item)] = true
+		}
+	}
+	for _, items := range src {
+		for _, item := range items {
+			if !have[cellID(item)] {
+				return fmt.Sprintf("missing %s@%d", item.Column, item.Timestamp)
+			}
+		}
+	}
+	return ""
+}
+
+func cellID(item bigtable.ReadItem) string {
+	return fmt.Sprintf("%s@%d=%x", item.Column, item.Timestamp, item.Value)
+}
+
+func qualifier(family, column string) string {
+	return strings.TrimPrefix(column, family+":")
+}
+
+func applyBulk(ctx context.Context, tbl *bigtable.Table, keys []string, muts []*bigtable.Mutation) error {
+	rowErrs, err := tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return err
+	}
+	for i, rowErr := range rowErrs {
+		if rowErr != nil {
+			return fmt.Errorf("row %s: %v", keys[i], rowErr)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) batchSize() int {
+	if m.BatchSize <= 0 {
+		return 100
+	}
+	return m.BatchSize
+}
+
+func (m *Migrator) loadCheckpoint() (Checkpoint, error) {
+	cp := Checkpoint{From: m.From.Name(), To: m.To.Name()}
+	if m.CheckpointPath == "" {
+		return cp, nil
+	}
+	b, err := os.ReadFile(m.CheckpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	} else if err != nil {
+		return cp, fmt.Errorf("could not read checkpoint: %v", err)
+	}
+	var saved Checkpoint
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return cp, fmt.Errorf("could not parse checkpoint %s: %v", m.CheckpointPath, err)
+	}
+	if saved.From != cp.From || saved.To != cp.To {
+		return cp, fmt.Errorf("checkpoint %s is for %s -> %s, not %s -> %s",
+			m.CheckpointPath, saved.From, saved.To, cp.From, cp.To)
+	}
+	return saved, nil
+}
+
+func (m *Migrator) saveCheckpoint(cp Checkpoint) error {
+	if m.CheckpointPath == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.CheckpointPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("could not write checkpoint: %v", err)
+	}
+	return os.Rename(tmp, m.CheckpointPath)
+}
+
+func (m *Migrator) clearCheckpoint() error {
+	if m.CheckpointPath == "" {
+		return nil
+	}
+	if err := os.Remove(m.CheckpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package rekey_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/rekey"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+func TestMigratorResumes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	const rows = 25
+	ts := bigtable.Time(env.Clock.Now())
+	keys := make([]string, 0, rows+1)
+	muts := make([]*bigtable.Mutation, 0, rows+1)
+	for i := 0; i < rows; i++ {
+		mut := bigtable.NewMutation()
+		did := fmt.Sprintf("did-%02d", i)
+		mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, ts, []byte(did))
+		mut.Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, ts, []byte("fcm-old"))
+		mut.Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, ts+1000, []byte("fcm-new"))
+		keys = append(keys, fmt.Sprintf("qid-%d#%s", i%3, did))
+		muts = append(muts, mut)
+	}
+	// Pool rows are not main rows and stay where they are.
+	pool := bigtable.NewMutation()
+	pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, []byte("created"))
+	keys = append(keys, "wyszz-ty4ey-eqgtc-ae44e-47yjg#qid-0#did-00")
+	muts = append(muts, pool)
+	errs, err := env.Table.ApplyBulk(ctx, keys, muts)
+	assert.NoError(t, err)
+	assert.Zero(t, errs)
+	before, err := btetest.Dump(ctx, env.Table)
+	assert.NoError(t, err)
+
+	checkpoint := filepath.Join(t.TempDir(), "rekey.checkpoint")
+	crash := errors.New("crash")
+	m := &rekey.Migrator{Table: env.Table, From: rekey.LegacyLayout{}, To: rekey.HashedLayout{}, BatchSize: 10, CheckpointPath: checkpoint}
+	batches := 0
+	rekey.SetAfterCopy(m, func() error {
+		if batches++; batches == 2 {
+			return crash
+		}
+		return nil
+	})
+	stats, err := m.Run(ctx)
+	assert.IsError(t, err, crash)
+	assert.Equal(t, 10, stats.Copied)
+	_, err = os.Stat(checkpoint)
+	assert.NoError(t, err)
+
+	// The crashed batch is both copied and not yet deleted, so resuming
+	// copies it again over the same cells.
+	resumed := &rekey.Migrator{Table: env.Table, From: rekey.LegacyLayout{}, To: rekey.HashedLayout{}, BatchSize: 10, CheckpointPath: checkpoint}
+	stats, err = resumed.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, rows, stats.Copied)
+	assert.Equal(t, rows, stats.Deleted)
+	_, err = os.Stat(checkpoint)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	got := map[string]bigtable.Row{}
+	err = env.Table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		got[row.Key()] = row
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rows+1, len(got))
+	for i, key := range keys[:rows] {
+		mk, err := access.ParseMainKey(key)
+		assert.NoError(t, err)
+		row, ok := got[rekey.HashedLayout{}.Format(mk)]
+		assert.True(t, ok, "%s was not migrated", key)
+		btetest.AssertVersions(t, row, schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, 2)
+		btetest.AssertColumns(t, row, btetest.Cells{
+			"DeviceProperties:DeviceId":   fmt.Sprintf("did-%02d", i),
+			"FirebaseProperties:FcmToken": "fcm-new",
+		})
+	}
+	_, ok := got[keys[rows]]
+	assert.True(t, ok)
+
+	// Migrating back restores the table exactly.
+	back := &rekey.Migrator{Table: env.Table, From: rekey.HashedLayout{}, To: rekey.LegacyLayout{}, BatchSize: 7}
+	_, err = back.Run(ctx)
+	assert.NoError(t, err)
+	after, err := btetest.Dump(ctx, env.Table)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
@@ -0,0 +1,149 @@
+// Package rpc serves the DeviceRegistry gRPC service on top of
+// internal/access.
+package rpc
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/util"
+	"github.com/theotheradamsmith/btemulator/registry/registrypb"
+)
+
+var states = map[access.State]registrypb.State{
+	access.StateReady:      registrypb.State_STATE_READY,
+	access.StateClaimed:    registrypb.State_STATE_CLAIMED,
+	access.StateInFlight:   registrypb.State_STATE_IN_FLIGHT,
+	access.StateRegistered: registrypb.State_STATE_REGISTERED,
+}
+
+type Server struct {
+	registrypb.UnimplementedDeviceRegistryServer
+	Registrar *access.Registrar
+}
+
+func (s *Server) LookupPairing(ctx context.Context, req *registrypb.LookupPairingRequest) (*registrypb.Device, error) {
+	return s.device(ctx, req.Aid)
+}
+
+func (s *Server) Claim(ctx context.Context, req *registrypb.ClaimRequest) (*registrypb.ClaimResponse, error) {
+	if req.Appk == "" {
+		return nil, status.Error(codes.InvalidArgument, "appk is required")
+	}
+	if req.DeviceKey == "" {
+		return nil, status.Error(codes.InvalidArgument, "device_key is required")
+	}
+	if !util.SliceContains(access.TrustLevels, req.Trusted) {
+		return nil, status.Errorf(codes.InvalidArgument, "trusted must be one of %v", access.TrustLevels)
+	}
+	in, challenge, err := s.Registrar.Claim(ctx, req.Aid, req.Appk, req.DeviceKey, req.Trusted)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	d, err := s.device(ctx, in.AID)
+	if err != nil {
+		return nil, err
+	}
+	return &registrypb.ClaimResponse{Device: d, Challenge: challenge}, nil
+}
+
+func (s *Server) Complete(ctx context.Context, req *registrypb.CompleteRequest) (*registrypb.Device, error) {
+	if len(req.Attestation) == 0 {
+		if err := s.Registrar.Complete(ctx, req.Aid, req.Appk, req.Response); err != nil {
+			return nil, toStatus(err)
+		}
+		return s.device(ctx, req.Aid)
+	}
+	chain := make([]*x509.Certificate, len(req.Attestation))
+	for i, der := range req.Attestation {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "attestation certificate %d: %v", i, err)
+		}
+		chain[i] = c
+	}
+	if err := s.Registrar.CompleteAttested(ctx, req.Aid, req.Appk, req.Response, chain); err != nil {
+		return nil, toStatus(err)
+	}
+	return s.device(ctx, req.Aid)
+}
+
+func (s *Server) Abort(ctx context.Context, req *registrypb.AbortRequest) (*registrypb.Device, error) {
+	if err := s.Registrar.Abort(ctx, req.Aid, req.Appk); err != nil {
+		return nil, toStatus(err)
+	}
+	return s.device(ctx, req.Aid)
+}
+
+func (s *Server) Deregister(ctx context.Context, req *registrypb.DeregisterRequest) (*registrypb.Device, error) {
+	if err := s.Registrar.Deregister(ctx, req.Aid, req.Appk); err != nil {
+		return nil, toStatus(err)
+	}
+	return s.device(ctx, req.Aid)
+}
+
+func (s *Server) ListByQID(ctx context.Context, req *registrypb.ListByQIDRequest) (*registrypb.ListByQIDResponse, error) {
+	if req.Qid == "" {
+		return nil, status.Error(codes.InvalidArgument, "qid is required")
+	}
+	var state access.State
+	for st, pb := range states {
+		if pb == req.State {
+			state = st
+		}
+	}
+	devices, err := access.ListDevices(ctx, s.Registrar.Table, req.Qid, state)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &registrypb.ListByQIDResponse{}
+	for _, d := range devices {
+		resp.Devices = append(resp.Devices, &registrypb.Device{Aid: d.AID, Qid: d.QID, Did: d.DID, State: states[d.State]})
+	}
+	return resp, nil
+}
+
+// device looks up the pairing of aid and the state of its device.
+func (s *Server) device(ctx context.Context, id string) (*registrypb.Device, error) {
+	poolKey, err := access.ReadAidRow(ctx, s.Registrar.Table, id)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	rp, err := access.SplitRPKey(poolKey)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	state, _, err := access.GetState(ctx, s.Registrar.Table, rp.AID)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &registrypb.Device{Aid: rp.AID, Qid: rp.QID, Did: rp.DID, State: states[state]}, nil
+}
+
+// toStatus maps the errors access returns to gRPC status codes.
+func toStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, aid.ErrLength), errors.Is(err, aid.ErrCharacter), errors.Is(err, aid.ErrChecksum),
+		errors.Is(err, access.ErrBadAppK), errors.Is(err, access.ErrBadDeviceKey), errors.Is(err, access.ErrBadTrust):
+		code = codes.InvalidArgument
+	case errors.Is(err, access.ErrNoPairing):
+		code = codes.NotFound
+	case errors.Is(err, access.ErrAlreadyClaimed):
+		code = codes.AlreadyExists
+	case errors.Is(err, access.ErrWrongAppK), errors.Is(err, access.ErrBadResponse),
+		errors.Is(err, access.ErrNoAttestation), errors.Is(err, access.ErrBadAttestation):
+		code = codes.PermissionDenied
+	case errors.Is(err, access.ErrAlreadyRegistered), errors.Is(err, access.ErrNoAppK), errors.Is(err, access.ErrNoDeviceKey), errors.Is(err, access.ErrNoChallenge),
+		errors.Is(err, access.ErrNotHardware),
+		errors.Is(err, access.ErrChallengeExpired), errors.Is(err, access.ErrChallengeReplayed):
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
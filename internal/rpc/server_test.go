@@ -0,0 +1,135 @@
+package rpc_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/rpc"
+	"github.com/theotheradamsmith/btemulator/internal/testca"
+	"github.com/theotheradamsmith/btemulator/registry"
+	"github.com/theotheradamsmith/btemulator/registry/registrypb"
+)
+
+const pairedAID = "km69a-b3boj-1w6ft-9mh83-wao7m"
+
+func dial(t *testing.T) (*registry.Client, *testca.CA) {
+	t.Helper()
+	env := btetest.New(t, build.Scenarios...)
+	ca, err := testca.New("Vendor", env.Clock.Now())
+	assert.NoError(t, err)
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	registrypb.RegisterDeviceRegistryServer(srv, &rpc.Server{Registrar: &access.Registrar{Table: env.Table, Clock: env.Clock, AttestationRoots: ca.Pool()}})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	c, err := registry.Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	assert.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c, ca
+}
+
+func assertCode(t *testing.T, want codes.Code, err error) {
+	t.Helper()
+	assert.Equal(t, want, status.Code(err), "%v", err)
+}
+
+func TestDeviceRegistry(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	c, ca := dial(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	deviceKey, err := access.EncodePublicKey(key.Public())
+	assert.NoError(t, err)
+	const appk = "appk-rpc"
+
+	d, err := c.LookupPairing(ctx, &registrypb.LookupPairingRequest{Aid: "KM69A B3BOJ 1W6FT 9MH83 WAO7M"})
+	assert.NoError(t, err)
+	assert.Equal(t, "qid-1", d.Qid)
+	assert.Equal(t, "did-1", d.Did)
+	assert.Equal(t, registrypb.State_STATE_READY, d.State)
+	_, err = c.LookupPairing(ctx, &registrypb.LookupPairingRequest{Aid: "ns86o-94h6x-x9y51-o5xj6-og3n9"})
+	assertCode(t, codes.NotFound, err)
+	_, err = c.LookupPairing(ctx, &registrypb.LookupPairingRequest{Aid: "nope"})
+	assertCode(t, codes.InvalidArgument, err)
+
+	_, err = c.Claim(ctx, &registrypb.ClaimRequest{Aid: pairedAID, Appk: appk, DeviceKey: deviceKey, Trusted: "maybe"})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.Claim(ctx, &registrypb.ClaimRequest{Aid: pairedAID, Appk: appk, Trusted: "software"})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.Claim(ctx, &registrypb.ClaimRequest{Aid: pairedAID, Appk: appk, DeviceKey: "not-a-key", Trusted: "software"})
+	assertCode(t, codes.InvalidArgument, err)
+	claim, err := c.Claim(ctx, &registrypb.ClaimRequest{Aid: pairedAID, Appk: appk, DeviceKey: deviceKey, Trusted: "hardware"})
+	assert.NoError(t, err)
+	assert.Equal(t, registrypb.State_STATE_IN_FLIGHT, claim.Device.State)
+	_, err = c.Claim(ctx, &registrypb.ClaimRequest{Aid: pairedAID, Appk: "other", DeviceKey: deviceKey, Trusted: "hardware"})
+	assertCode(t, codes.AlreadyExists, err)
+
+	_, err = c.Complete(ctx, &registrypb.CompleteRequest{Aid: pairedAID, Appk: appk, Response: "wrong"})
+	assertCode(t, codes.PermissionDenied, err)
+	d, err = c.Abort(ctx, &registrypb.AbortRequest{Aid: pairedAID, Appk: appk})
+	assert.NoError(t, err)
+	assert.Equal(t, registrypb.State_STATE_READY, d.State)
+
+	d, err = c.Register(ctx, pairedAID, appk, deviceKey, "software", func(challenge string) (string, error) {
+		return access.SignChallenge(key, challenge)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, registrypb.State_STATE_REGISTERED, d.State)
+	_, err = c.Abort(ctx, &registrypb.AbortRequest{Aid: pairedAID, Appk: appk})
+	assertCode(t, codes.FailedPrecondition, err)
+
+	list, err := c.ListByQID(ctx, &registrypb.ListByQIDRequest{Qid: "qid-1", State: registrypb.State_STATE_REGISTERED})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(list.Devices))
+	assert.Equal(t, pairedAID, list.Devices[0].Aid)
+	list, err = c.ListByQID(ctx, &registrypb.ListByQIDRequest{Qid: "qid-1", State: registrypb.State_STATE_READY})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(list.Devices))
+
+	d, err = c.Deregister(ctx, &registrypb.DeregisterRequest{Aid: pairedAID, Appk: appk})
+	assert.NoError(t, err)
+	assert.Equal(t, registrypb.State_STATE_READY, d.State)
+
+	errAnswer := errors.New("no answer")
+	_, err = c.Register(ctx, pairedAID, appk, deviceKey, "software", func(string) (string, error) {
+		return "", errAnswer
+	})
+	assert.IsError(t, err, errAnswer)
+	d, err = c.LookupPairing(ctx, &registrypb.LookupPairingRequest{Aid: pairedAID})
+	assert.NoError(t, err)
+	assert.Equal(t, registrypb.State_STATE_READY, d.State)
+
+	sign := func(challenge string) (string, error) {
+		return access.SignChallenge(key, challenge)
+	}
+	_, err = c.RegisterAttested(ctx, pairedAID, appk, deviceKey, nil, sign)
+	assertCode(t, codes.PermissionDenied, err)
+	_, err = c.Abort(ctx, &registrypb.AbortRequest{Aid: pairedAID, Appk: appk})
+	assert.NoError(t, err)
+	_, err = c.RegisterAttested(ctx, pairedAID, appk, deviceKey, [][]byte{[]byte("not DER")}, sign)
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.Abort(ctx, &registrypb.AbortRequest{Aid: pairedAID, Appk: appk})
+	assert.NoError(t, err)
+	chain, err := ca.Issue(key.Public(), "device")
+	assert.NoError(t, err)
+	d, err = c.RegisterAttested(ctx, pairedAID, appk, deviceKey, [][]byte{chain[0].Raw, chain[1].Raw}, sign)
+	assert.NoError(t, err)
+	assert.Equal(t, registrypb.State_STATE_REGISTERED, d.State)
+}
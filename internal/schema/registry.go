@@ -0,0 +1,111 @@
+package schema
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Encoding says how the bytes stored in a column are to be read.
+type Encoding int
+
+const (
+	EncodingString Encoding = iota
+	// EncodingUnixDate is a time formatted with time.UnixDate.
+	EncodingUnixDate
+	// EncodingUnixMillis is a decimal count of unix milliseconds.
+	EncodingUnixMillis
+	EncodingJSON
+	EncodingBytes
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingString:
+		return "string"
+	case EncodingUnixDate:
+		return "unixdate"
+	case EncodingUnixMillis:
+		return "unixmillis"
+	case EncodingJSON:
+		return "json"
+	default:
+		return "bytes"
+	}
+}
+
+type Column struct {
+	Family   string
+	Name     string
+	Encoding Encoding
+}
+
+// Columns is the registry of every column the table is known to hold.
+var Columns = []Column{
+	{Family: ColumnFamilyFirebaseProperties, Name: ColumnFCM, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnDID, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnAID, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnAppK, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnDeviceKey, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnAuthToken, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnMainKey, Encoding: EncodingString},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnCreated, Encoding: EncodingUnixDate},
+	{Family: ColumnFamilyDeviceProperties, Name: ColumnTrusted, Encoding: EncodingString},
+	{Family: ColumnFamilyRegistrationProperties, Name: ColumnChallenge, Encoding: EncodingString},
+	{Family: ColumnFamilyRegistrationProperties, Name: ColumnChallengeExpiry, Encoding: EncodingUnixMillis},
+	{Family: ColumnFamilyRegistrationProperties, Name: ColumnRegistered, Encoding: EncodingUnixMillis},
+	{Family: ColumnFamilyRegistrationProperties, Name: ColumnIntent, Encoding: EncodingJSON},
+	{Family: ColumnFamilyRegistrationProperties, Name: ColumnLease, Encoding: EncodingString},
+}
+
+// LookupColumn finds a column in the registry. Columns that are not
+// registered come back as EncodingBytes.
+func LookupColumn(family, name string) (Column, bool) {
+	for _, c := range Columns {
+		if c.Family == family && c.Name == name {
+			return c, true
+		}
+	}
+	return Column{Family: family, Name: name, Encoding: EncodingBytes}, false
+}
+
+// SplitColumn splits a bigtable.ReadItem column, family:name, in two.
+func SplitColumn(column string) (family, name string) {
+	family, name, _ = strings.Cut(column, ":")
+	return family, name
+}
+
+func (c Column) String() string {
+	return c.Family + ":" + c.Name
+}
+
+// Decode renders v for people to read. Values that do not decode as the
+// column's encoding are shown quoted and marked invalid.
+func (c Column) Decode(v []byte) string {
+	switch c.Encoding {
+	case EncodingString, EncodingJSON:
+		if utf8.Valid(v) {
+			return strconv.Quote(string(v))
+		}
+	case EncodingUnixDate:
+		// Already readable; decoding only checks it parses.
+		if _, err := time.Parse(time.UnixDate, string(v)); err == nil {
+			return strconv.Quote(string(v))
+		}
+	case EncodingUnixMillis:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return time.UnixMilli(n).UTC().Format("2006-01-02T15:04:05.000Z07:00")
+		}
+	default:
+		return "0x" + hex.EncodeToString(v)
+	}
+	return "invalid " + c.Encoding.String() + " " + strconv.Quote(string(v))
+}
+
+// DecodeValue decodes a value read from family:name.
+func DecodeValue(family, name string, v []byte) string {
+	c, _ := LookupColumn(family, name)
+	return c.Decode(v)
+}
@@ -11,12 +11,16 @@ const (
 	ColumnDID                          = "DeviceId"
 	ColumnAID                          = "AdoptionId"
 	ColumnAppK                         = "ApplianceKey"
+	ColumnDeviceKey                    = "DeviceKey"
 	ColumnAuthToken                    = "AuthTokens"
 	ColumnMainKey                      = "MainKey"
 	ColumnChallenge                    = "Challenge"
+	ColumnChallengeExpiry              = "ChallengeExpiry"
 	ColumnCreated                      = "CreatedDate"
 	ColumnRegistered                   = "Registered"
 	ColumnTrusted                      = "Trusted"
+	ColumnIntent                       = "RegistrationIntent"
+	ColumnLease                        = "Lease"
 )
 
 var ColumnFamilies = []string{ColumnFamilyFirebaseProperties, ColumnFamilyDeviceProperties, ColumnFamilyRegistrationProperties}
@@ -32,13 +36,13 @@ type DeviceEntry struct {
 
 var Devices = []DeviceEntry{
 	{
-		AID: "aid-1",
+		AID: "km69a-b3boj-1w6ft-9mh83-wao7m",
 		QID: "qid-1",
 		DID: "did-1",
 		FCM: "fcm-1",
 	},
 	{
-		AID: "aid-2",
+		AID: "f6bef-19n9f-ws6ck-ranir-35ksq",
 		QID: "qid-2",
 		DID: "did-2",
 		FCM: "fcm-2",
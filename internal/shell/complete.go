@@ -0,0 +1,88 @@
+package shell
+
+import (
+	"context"
+	"strings"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+// Complete returns the lines that line could be completed to: command names
+// for the first word, then row keys, columns, AIDs or QIDs depending on what
+// the command expects in that position.
+func (s *Shell) Complete(ctx context.Context, line string) []string {
+	fields := strings.Fields(line)
+	partial := ""
+	if len(fields) > 0 && !strings.HasSuffix(line, " ") {
+		partial = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+	head := line[:len(line)-len(partial)]
+
+	var candidates []string
+	if len(fields) == 0 {
+		for _, name := range commandNames() {
+			if strings.HasPrefix(name, partial) {
+				candidates = append(candidates, name+" ")
+			}
+		}
+	} else if cmd, ok := commands[fields[0]]; ok && len(fields)-1 < len(cmd.args) {
+		candidates = s.completeArg(ctx, cmd.args[len(fields)-1], partial)
+	}
+
+	var lines []string
+	for _, c := range candidates {
+		lines = append(lines, head+c)
+	}
+	return lines
+}
+
+func (s *Shell) completeArg(ctx context.Context, kind arg, partial string) []string {
+	switch kind {
+	case argColumn:
+		var cols []string
+		for _, c := range schema.Columns {
+			if strings.HasPrefix(c.String(), partial) {
+				cols = append(cols, c.String()+" ")
+			}
+		}
+		return cols
+	case argKey:
+		keys, _ := s.keys(ctx, partial, s.limit())
+		for i := range keys {
+			keys[i] += " "
+		}
+		return keys
+	case argAID, argQID:
+		// Many rows can share a QID, so read further than the limit to find
+		// enough distinct ones.
+		keys, _ := s.keys(ctx, partial, 10*s.limit())
+		var (
+			ids  []string
+			seen = make(map[string]bool)
+		)
+		for _, key := range keys {
+			var id string
+			if kind == argAID {
+				rp, err := access.SplitRPKey(key)
+				if err != nil {
+					continue
+				}
+				id = rp.AID
+			} else {
+				mk, err := access.ParseMainKey(key)
+				if err != nil {
+					continue
+				}
+				id = mk.QID
+			}
+			if !seen[id] && len(ids) < s.limit() {
+				seen[id] = true
+				ids = append(ids, id+" ")
+			}
+		}
+		return ids
+	}
+	return nil
+}
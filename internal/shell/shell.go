@@ -0,0 +1,323 @@
+// Package shell is an interactive console onto the table that reads keys and
+// values the way the access layer does, unlike cbt.
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+var (
+	// ErrQuit is returned by the exit and quit commands.
+	ErrQuit           = errors.New("quit")
+	ErrUsage          = errors.New("usage")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrUnknownColumn  = errors.New("unknown column")
+	ErrNoRow          = errors.New("no such row")
+)
+
+// DefaultLimit is how many rows scan and qid list, and how many candidates
+// completion offers, when Shell.Limit is zero.
+const DefaultLimit = 50
+
+type Shell struct {
+	Table *bigtable.Table
+	Clock clock.Clock
+	Out   io.Writer
+	Limit int
+}
+
+type arg int
+
+const (
+	argKey arg = iota
+	argColumn
+	argAID
+	argQID
+	argValue
+)
+
+type command struct {
+	args  []arg
+	usage string
+	help  string
+	run   func(s *Shell, ctx context.Context, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":     {[]arg{argKey}, "get <key>", "Show the latest cells of a row.", (*Shell).get},
+		"scan":    {[]arg{argKey}, "scan <prefix>", "List the keys that start with prefix.", (*Shell).scan},
+		"aid":     {[]arg{argAID}, "aid <aid>", "Show the pairing row of an AID and its device's main row.", (*Shell).aid},
+		"qid":     {[]arg{argQID}, "qid <qid>", "List the devices of a QID and their states.", (*Shell).qid},
+		"set":     {[]arg{argKey, argColumn, argValue}, "set <key> <family:column> <value>", "Write a cell.", (*Shell).set},
+		"delete":  {[]arg{argKey, argColumn}, "delete <key> [family:column]", "Delete a column, or the whole row.", (*Shell).delete},
+		"history": {[]arg{argKey, argColumn}, "history <key> <family:column>", "Show every version of a column.", (*Shell).history},
+		"state":   {[]arg{argAID}, "state <aid>", "Show how far an AID's device is through registration.", (*Shell).state},
+		"help":    {nil, "help", "List the commands.", (*Shell).help},
+		"exit":    {nil, "exit", "Leave the shell.", quit},
+		"quit":    {nil, "quit", "Leave the shell.", quit},
+	}
+}
+
+func quit(*Shell, context.Context, []string) error {
+	return ErrQuit
+}
+
+// Exec runs one line of input. Blank lines do nothing.
+func (s *Shell) Exec(ctx context.Context, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, ok := commands[fields[0]]
+	if !ok {
+		return fmt.Errorf("%w %q, try help", ErrUnknownCommand, fields[0])
+	}
+	return cmd.run(s, ctx, fields[1:])
+}
+
+func (s *Shell) limit() int {
+	if s.Limit <= 0 {
+		return DefaultLimit
+	}
+	return s.Limit
+}
+
+func (s *Shell) help(_ context.Context, _ []string) error {
+	for _, name := range commandNames() {
+		fmt.Fprintf(s.Out, "  %-34s %s\n", commands[name].usage, commands[name].help)
+	}
+	return nil
+}
+
+func (s *Shell) get(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usage("get")
+	}
+	row, err := s.readRow(ctx, args[0], bigtable.LatestNFilter(1))
+	if err != nil {
+		return err
+	}
+	s.printRow(row)
+	if _, err := access.ParseMainKey(row.Key()); err == nil {
+		fmt.Fprintf(s.Out, "  state: %s\n", access.StateOf(row))
+	}
+	return nil
+}
+
+func (s *Shell) scan(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return usage("scan")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	keys, err := s.keys(ctx, prefix, s.limit()+1)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if i == s.limit() {
+			fmt.Fprintf(s.Out, "... more than %d rows\n", s.limit())
+			break
+		}
+		fmt.Fprintln(s.Out, key)
+	}
+	return nil
+}
+
+func (s *Shell) aid(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usage("aid")
+	}
+	pool, err := access.GetAidRow(ctx, s.Table, args[0])
+	if err != nil {
+		return err
+	}
+	s.printRow(pool)
+	mainKey, err := access.ParseRPKey(pool.Key())
+	if err != nil {
+		return err
+	}
+	main, err := s.readRow(ctx, mainKey, bigtable.LatestNFilter(1))
+	if err != nil {
+		return err
+	}
+	s.printRow(main)
+	fmt.Fprintf(s.Out, "  state: %s\n", access.StateOf(main))
+	return nil
+}
+
+func (s *Shell) qid(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usage("qid")
+	}
+	devices, err := access.ListDevices(ctx, s.Table, args[0], "")
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("%w: no devices for QID %q", ErrNoRow, args[0])
+	}
+	for i, d := range devices {
+		if i == s.limit() {
+			fmt.Fprintf(s.Out, "... more than %d devices\n", s.limit())
+			break
+		}
+		fmt.Fprintf(s.Out, "%-12s %s\n", d.State, d.Key)
+	}
+	return nil
+}
+
+func (s *Shell) set(ctx context.Context, args []string) error {
+	if len(args) < 3 {
+		return usage("set")
+	}
+	col, err := lookupColumn(args[1])
+	if err != nil {
+		return err
+	}
+	value := strings.Join(args[2:], " ")
+	mut := bigtable.NewMutation()
+	mut.Set(col.Family, col.Name, bigtable.Time(clock.Or(s.Clock).Now()), []byte(value))
+	if err := s.Table.Apply(ctx, args[0], mut); err != nil {
+		return fmt.Errorf("could not write %s %s: %v", args[0], col, err)
+	}
+	fmt.Fprintf(s.Out, "%s %s = %s\n", args[0], col, col.Decode([]byte(value)))
+	return nil
+}
+
+func (s *Shell) delete(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usage("delete")
+	}
+	mut := bigtable.NewMutation()
+	what := "row"
+	if len(args) == 2 {
+		col, err := lookupColumn(args[1])
+		if err != nil {
+			return err
+		}
+		mut.DeleteCellsInColumn(col.Family, col.Name)
+		what = col.String()
+	} else {
+		mut.DeleteRow()
+	}
+	if err := s.Table.Apply(ctx, args[0], mut); err != nil {
+		return fmt.Errorf("could not delete %s %s: %v", args[0], what, err)
+	}
+	fmt.Fprintf(s.Out, "deleted %s %s\n", args[0], what)
+	return nil
+}
+
+func (s *Shell) history(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return usage("history")
+	}
+	col, err := lookupColumn(args[1])
+	if err != nil {
+		return err
+	}
+	row, err := s.readRow(ctx, args[0], bigtable.ChainFilters(
+		bigtable.FamilyFilter(regexp.QuoteMeta(col.Family)),
+		bigtable.ColumnFilter(regexp.QuoteMeta(col.Name)),
+	))
+	if err != nil {
+		return err
+	}
+	for _, item := range row[col.Family] {
+		fmt.Fprintf(s.Out, "  @%s = %s\n", formatTime(item.Timestamp), col.Decode(item.Value))
+	}
+	return nil
+}
+
+func (s *Shell) state(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usage("state")
+	}
+	state, mainKey, err := access.GetState(ctx, s.Table, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.Out, "%s %s\n", state, mainKey)
+	return nil
+}
+
+// readRow reads key, reporting ErrNoRow if it has no cells.
+func (s *Shell) readRow(ctx context.Context, key string, filter bigtable.Filter) (bigtable.Row, error) {
+	row, err := s.Table.ReadRow(ctx, key, bigtable.RowFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s: %v", access.ErrReadError, key, err)
+	}
+	if len(row) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrNoRow, key)
+	}
+	return row, nil
+}
+
+func (s *Shell) printRow(row bigtable.Row) {
+	fmt.Fprintln(s.Out, row.Key())
+	var items []bigtable.ReadItem
+	for _, family := range row {
+		items = append(items, family...)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Column < items[j].Column
+	})
+	for _, item := range items {
+		family, name := schema.SplitColumn(item.Column)
+		fmt.Fprintf(s.Out, "  %s @%s = %s\n", item.Column, formatTime(item.Timestamp), schema.DecodeValue(family, name, item.Value))
+	}
+}
+
+// keys lists up to limit row keys starting with prefix.
+func (s *Shell) keys(ctx context.Context, prefix string, limit int) ([]string, error) {
+	var keys []string
+	err := s.Table.ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+		keys = append(keys, row.Key())
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(bigtable.LatestNFilter(1), bigtable.StripValueFilter())), bigtable.LimitRows(int64(limit)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", access.ErrReadError, err)
+	}
+	return keys, nil
+}
+
+func lookupColumn(s string) (schema.Column, error) {
+	col, ok := schema.LookupColumn(schema.SplitColumn(s))
+	if !ok {
+		return col, fmt.Errorf("%w %q", ErrUnknownColumn, s)
+	}
+	return col, nil
+}
+
+func usage(name string) error {
+	return fmt.Errorf("%w: %s", ErrUsage, commands[name].usage)
+}
+
+func formatTime(ts bigtable.Timestamp) string {
+	return ts.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
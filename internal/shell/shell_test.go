@@ -0,0 +1,88 @@
+package shell_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+	"github.com/theotheradamsmith/btemulator/internal/shell"
+)
+
+func TestExec(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.Scenarios...)
+	var out bytes.Buffer
+	sh := &shell.Shell{Table: env.Table, Clock: env.Clock, Out: &out}
+
+	run := func(line, want string) {
+		t.Helper()
+		out.Reset()
+		assert.NoError(t, sh.Exec(ctx, line), "%s", line)
+		assert.Equal(t, want, out.String(), "%s", line)
+	}
+
+	run("get qid-in-flight#did-in-flight", `qid-in-flight#did-in-flight
+  DeviceProperties:AdoptionId @2023-10-01T12:00:00.000Z = "hky85-8y73a-uk6yg-ko8kx-hrqn3"
+  DeviceProperties:ApplianceKey @2023-10-01T12:00:00.000Z = "appk-in-flight"
+  DeviceProperties:DeviceKey @2023-10-01T12:00:00.000Z = "4311c8eebc490a2acca3dc64ede74b44fa08b32e26641ffc6bccd2eece024192"
+  RegistrationProperties:Challenge @2023-10-01T12:00:00.000Z = "challenge"
+  RegistrationProperties:ChallengeExpiry @2023-10-01T12:00:00.000Z = 2023-10-01T12:05:00.000Z
+  state: in-flight
+`)
+	run("scan foo-", "foo-usd-123#device-one\nfoo-usd-123#device-three\nfoo-usd-123#device-two\n")
+	run("aid KM69A-B3BOJ-1W6FT-9MH83-WAO7M", `km69a-b3boj-1w6ft-9mh83-wao7m#qid-1#did-1
+  DeviceProperties:CreatedDate @2023-10-01T12:00:00.000Z = "Sun Oct  1 12:00:00 UTC 2023"
+qid-1#did-1
+  DeviceProperties:CreatedDate @2023-10-01T12:00:00.000Z = "Sun Oct  1 12:00:00 UTC 2023"
+  DeviceProperties:DeviceId @2023-10-01T12:00:00.000Z = "did-1"
+  FirebaseProperties:FcmToken @2023-10-01T12:00:00.000Z = "fcm-1"
+  state: ready
+`)
+	run("state km69a-b3boj-1w6ft-9mh83-wao7m", "ready qid-1#did-1\n")
+
+	env.Clock.Advance(time.Minute)
+	run("set qid-mccoy#did-mccoy DeviceProperties:Trusted hardware", "qid-mccoy#did-mccoy DeviceProperties:Trusted = \"hardware\"\n")
+	env.Clock.Advance(time.Minute)
+	run("set qid-mccoy#did-mccoy DeviceProperties:Trusted software", "qid-mccoy#did-mccoy DeviceProperties:Trusted = \"software\"\n")
+	run("history qid-mccoy#did-mccoy DeviceProperties:Trusted", `  @2023-10-01T12:02:00.000Z = "software"
+  @2023-10-01T12:01:00.000Z = "hardware"
+`)
+	run("qid qid-mccoy", "ready        qid-mccoy#did-mccoy\n")
+	hashed := access.MainKey{QID: "qid-hashed", DID: "did-hashed"}.Hashed()
+	mut := bigtable.NewMutation()
+	mut.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, bigtable.Time(env.Clock.Now()), []byte("did-hashed"))
+	assert.NoError(t, env.Table.Apply(ctx, hashed, mut))
+	run("qid qid-hashed", "ready        "+hashed+"\n")
+	run("delete qid-mccoy#did-mccoy DeviceProperties:Trusted", "deleted qid-mccoy#did-mccoy DeviceProperties:Trusted\n")
+	run("delete qid-mccoy#did-mccoy", "deleted qid-mccoy#did-mccoy row\n")
+
+	assert.IsError(t, sh.Exec(ctx, "get qid-mccoy#did-mccoy"), shell.ErrNoRow)
+	assert.IsError(t, sh.Exec(ctx, "frobnicate"), shell.ErrUnknownCommand)
+	assert.IsError(t, sh.Exec(ctx, "history qid-ready#did-ready"), shell.ErrUsage)
+	assert.IsError(t, sh.Exec(ctx, "set qid-ready#did-ready Nope:Nope x"), shell.ErrUnknownColumn)
+	assert.IsError(t, sh.Exec(ctx, "exit"), shell.ErrQuit)
+}
+
+func TestComplete(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.Scenarios...)
+	sh := &shell.Shell{Table: env.Table}
+
+	assert.Equal(t, []string{"help ", "history "}, sh.Complete(ctx, "h"))
+	assert.Equal(t, []string{"get foo-usd-123#device-one ", "get foo-usd-123#device-three ", "get foo-usd-123#device-two "}, sh.Complete(ctx, "get foo"))
+	assert.Equal(t, []string{"history qid-ready#did-ready RegistrationProperties:Registered ", "history qid-ready#did-ready RegistrationProperties:RegistrationIntent "},
+		sh.Complete(ctx, "history qid-ready#did-ready RegistrationProperties:Reg"))
+	assert.Equal(t, []string{"state km69a-b3boj-1w6ft-9mh83-wao7m "}, sh.Complete(ctx, "state k"))
+	assert.Equal(t, []string{"qid qid-1 ", "qid qid-2 ", "qid qid-already-registered "}, sh.Complete(ctx, "qid qid-")[:3])
+	assert.Equal(t, []string(nil), sh.Complete(ctx, "get qid-ready#did-ready "))
+}
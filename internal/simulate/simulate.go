@@ -0,0 +1,295 @@
+// Package simulate drives virtual appliances through registration against
+// a table of virtual devices and checks the table is still consistent
+// afterwards.
+package simulate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/aid"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/clock"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+type Config struct {
+	Devices    int
+	Appliances int
+	// RaceRate is the fraction of appliances that go after a device another
+	// appliance is also registering.
+	RaceRate float64
+	// AbandonRate is the fraction of flows that stop after the claim or the
+	// challenge and never complete.
+	AbandonRate float64
+	// ReregisterRate is the fraction of completed registrations that are
+	// deregistered and registered again.
+	ReregisterRate float64
+	Concurrency    int
+	Seed           int64
+}
+
+type Outcome string
+
+const (
+	OutcomeRegistered         Outcome = "registered"
+	OutcomeReregistered       Outcome = "reregistered"
+	OutcomeLostRace           Outcome = "lost-race"
+	OutcomeAbandonedClaim     Outcome = "abandoned-after-claim"
+	OutcomeAbandonedChallenge Outcome = "abandoned-after-challenge"
+	OutcomeError              Outcome = "error"
+)
+
+type Result struct {
+	Outcomes   map[Outcome]int
+	States     map[access.State]int
+	Errors     []string
+	Violations []string
+}
+
+type Simulator struct {
+	Table  *bigtable.Table
+	Clock  clock.Clock
+	Config Config
+}
+
+func DeviceFor(i int) schema.DeviceEntry {
+	return schema.DeviceEntry{
+		AID: aid.Generate(rand.New(rand.NewSource(int64(i)))),
+		QID: fmt.Sprintf("sim-qid-%04d", i/4),
+		DID: fmt.Sprintf("sim-did-%06d", i),
+		FCM: fmt.Sprintf("sim-fcm-%06d", i),
+	}
+}
+
+// Seed writes a fresh pairing row and main row for each simulated device.
+func (s *Simulator) Seed(ctx context.Context) error {
+	now := clock.Or(s.Clock).Now()
+	ts := bigtable.Time(now)
+	var (
+		keys []string
+		muts []*bigtable.Mutation
+	)
+	for i := 0; i < s.Config.Devices; i++ {
+		d := DeviceFor(i)
+		pool := bigtable.NewMutation()
+		pool.DeleteRow()
+		pool.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, []byte(now.Format(time.UnixDate)))
+		main := bigtable.NewMutation()
+		main.DeleteRow()
+		main.Set(schema.ColumnFamilyFirebaseProperties, schema.ColumnFCM, ts, []byte(d.FCM))
+		main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnCreated, ts, []byte(now.Format(time.UnixDate)))
+		main.Set(schema.ColumnFamilyDeviceProperties, schema.ColumnDID, ts, []byte(d.DID))
+		keys = append(keys, access.RPKey{AID: d.AID, MainKey: access.MainKey{QID: d.QID, DID: d.DID}}.String(), d.QID+"#"+d.DID)
+		muts = append(muts, pool, main)
+	}
+	for start := 0; start < len(keys); start += 1000 {
+		end := min(start+1000, len(keys))
+		rowErrs, err := s.Table.ApplyBulk(ctx, keys[start:end], muts[start:end])
+		if err != nil {
+			return fmt.Errorf("could not seed devices: %v", err)
+		}
+		for i, rowErr := range rowErrs {
+			if rowErr != nil {
+				return fmt.Errorf("could not seed %s: %v", keys[start+i], rowErr)
+			}
+		}
+	}
+	return nil
+}
+
+// Run sends every appliance through registration, then checks the table.
+func (s *Simulator) Run(ctx context.Context) (*Result, error) {
+	if s.Config.Devices <= 0 {
+		return nil, errors.New("simulation needs at least one device")
+	}
+	targets := s.targets()
+	res := &Result{Outcomes: make(map[Outcome]int), States: make(map[access.State]int)}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		work = make(chan int)
+	)
+	for w := 0; w < max(s.Config.Concurrency, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				outcome, err := s.appliance(ctx, i, targets[i])
+				mu.Lock()
+				res.Outcomes[outcome]++
+				if err != nil {
+					res.Errors = append(res.Errors, fmt.Sprintf("appliance %d: %v", i, err))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range targets {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	if err := s.verify(ctx, res); err != nil {
+		return res, err
+	}
+	sort.Strings(res.Errors)
+	return res, nil
+}
+
+// targets picks the device each appliance registers. Most get a device of
+// their own; RaceRate of them are sent after an earlier appliance's device.
+func (s *Simulator) targets() []int {
+	rng := rand.New(rand.NewSource(s.Config.Seed))
+	targets := make([]int, s.Config.Appliances)
+	for i := range targets {
+		targets[i] = i % s.Config.Devices
+		if i > 0 && rng.Float64() < s.Config.RaceRate {
+			targets[i] = targets[rng.Intn(i)]
+		}
+	}
+	return targets
+}
+
+func (s *Simulator) appliance(ctx context.Context, i, device int) (Outcome, error) {
+	rng := rand.New(rand.NewSource(s.Config.Seed + int64(i) + 1))
+	r := &access.Registrar{Table: s.Table, Clock: s.Clock}
+	d := DeviceFor(device)
+	aid := d.AID
+	key := build.DeviceKey(d.DID)
+	deviceKey := hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	appk := newAppK(rng)
+
+	if _, err := r.Register(ctx, aid, appk, deviceKey, "software"); errors.Is(err, access.ErrAlreadyClaimed) {
+		return OutcomeLostRace, nil
+	} else if err != nil {
+		return OutcomeError, err
+	}
+	if rng.Float64() < s.Config.AbandonRate/2 {
+		return OutcomeAbandonedClaim, nil
+	}
+	if err := s.challengeAndComplete(ctx, r, rng, aid, key, appk, true); err != nil {
+		if errors.Is(err, errAbandoned) {
+			return OutcomeAbandonedChallenge, nil
+		}
+		return OutcomeError, err
+	}
+	if rng.Float64() >= s.Config.ReregisterRate {
+		return OutcomeRegistered, nil
+	}
+
+	if err := r.Deregister(ctx, aid, appk); err != nil {
+		return OutcomeError, err
+	}
+	appk = newAppK(rng)
+	if _, err := r.Register(ctx, aid, appk, deviceKey, "software"); errors.Is(err, access.ErrAlreadyClaimed) {
+		// Another appliance got in while the device was free.
+		return OutcomeLostRace, nil
+	} else if err != nil {
+		return OutcomeError, err
+	}
+	if err := s.challengeAndComplete(ctx, r, rng, aid, key, appk, false); err != nil {
+		return OutcomeError, err
+	}
+	return OutcomeReregistered, nil
+}
+
+var errAbandoned = errors.New("abandoned")
+
+// newAppK draws an appliance key from rng, so runs with the same seed write
+// the same AppKs.
+func newAppK(rng *rand.Rand) string {
+	b := make([]byte, 32)
+	rng.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Simulator) challengeAndComplete(ctx context.Context, r *access.Registrar, rng *rand.Rand, aid string, key ed25519.PrivateKey, appk string, mayAbandon bool) error {
+	challenge := fmt.Sprintf("%016x", rng.Uint64())
+	if err := r.Challenge(ctx, aid, appk, challenge); err != nil {
+		return err
+	}
+	if mayAbandon && rng.Float64() < s.Config.AbandonRate/2 {
+		return errAbandoned
+	}
+	response, err := access.SignChallenge(key, challenge)
+	if err != nil {
+		return err
+	}
+	return r.Complete(ctx, aid, appk, response)
+}
+
+// verify counts final states and flags invariant violations across every
+// simulated device.
+func (s *Simulator) verify(ctx context.Context, res *Result) error {
+	for i := 0; i < s.Config.Devices; i++ {
+		d := DeviceFor(i)
+		poolKey := access.RPKey{AID: d.AID, MainKey: access.MainKey{QID: d.QID, DID: d.DID}}.String()
+		mainKey := d.QID + "#" + d.DID
+		pool, err := s.Table.ReadRow(ctx, poolKey)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", poolKey, err)
+		}
+		main, err := s.Table.ReadRow(ctx, mainKey)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", mainKey, err)
+		}
+
+		state := access.StateOf(main)
+		res.States[state]++
+
+		violation := func(format string, args ...any) {
+			res.Violations = append(res.Violations, fmt.Sprintf("%s: %s", d.AID, fmt.Sprintf(format, args...)))
+		}
+		poolAppKs := values(pool, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+		mainAppKs := values(main, schema.ColumnFamilyDeviceProperties, schema.ColumnAppK)
+		if len(poolAppKs) > 1 {
+			violation("%d AppKs on the pairing row: %v", len(poolAppKs), poolAppKs)
+		}
+		if len(mainAppKs) > 1 {
+			violation("%d AppKs on the main row: %v", len(mainAppKs), mainAppKs)
+		}
+		if fmt.Sprint(poolAppKs) != fmt.Sprint(mainAppKs) {
+			violation("pairing row AppK %v but main row AppK %v", poolAppKs, mainAppKs)
+		}
+		if state == access.StateRegistered && len(mainAppKs) == 0 {
+			violation("registered without AppK")
+		}
+		if state != access.StateReady {
+			if aids := values(main, schema.ColumnFamilyDeviceProperties, schema.ColumnAID); len(aids) != 1 || aids[0] != d.AID {
+				violation("claimed but main row AdoptionId is %v", aids)
+			}
+		}
+		if intents := values(pool, schema.ColumnFamilyRegistrationProperties, schema.ColumnIntent); len(intents) > 0 {
+			violation("registration intent left behind")
+		}
+	}
+	sort.Strings(res.Violations)
+	return nil
+}
+
+// values lists the distinct values held in every version of family:column.
+func values(row bigtable.Row, family, column string) []string {
+	seen := make(map[string]bool)
+	var vs []string
+	for _, item := range row[family] {
+		v := string(item.Value)
+		if item.Column == family+":"+column && !seen[v] {
+			seen[v] = true
+			vs = append(vs, v)
+		}
+	}
+	sort.Strings(vs)
+	return vs
+}
@@ -0,0 +1,43 @@
+package simulate_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/simulate"
+)
+
+func TestSimulation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t)
+	sim := simulate.Simulator{
+		Table: env.Table,
+		Clock: env.Clock,
+		Config: simulate.Config{
+			Devices:        40,
+			Appliances:     60,
+			RaceRate:       0.3,
+			AbandonRate:    0.2,
+			ReregisterRate: 0.2,
+			Concurrency:    8,
+			Seed:           7,
+		},
+	}
+	assert.NoError(t, sim.Seed(ctx))
+	res, err := sim.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string(nil), res.Errors)
+	assert.Equal(t, []string(nil), res.Violations)
+
+	total := 0
+	for _, n := range res.Outcomes {
+		total += n
+	}
+	assert.Equal(t, 60, total)
+	assert.NotZero(t, res.Outcomes[simulate.OutcomeLostRace])
+	assert.NotZero(t, res.States["registered"])
+}
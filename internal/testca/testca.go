@@ -0,0 +1,102 @@
+// Package testca is a throwaway certificate authority that issues device
+// attestation chains, so hardware registration can be exercised offline.
+package testca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"time"
+)
+
+// Validity is how long every certificate the CA issues is valid for.
+const Validity = 10 * 365 * 24 * time.Hour
+
+// CA has a root and an intermediate that signs device certificates, the way
+// hardware vendors usually arrange theirs.
+type CA struct {
+	Root         *x509.Certificate
+	Intermediate *x509.Certificate
+
+	intermediateKey crypto.Signer
+	notBefore       time.Time
+	serial          int64
+}
+
+// New creates a CA named name whose certificates are valid from now.
+func New(name string, now time.Time) (*CA, error) {
+	ca := &CA{notBefore: now.Add(-time.Hour)}
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	root := ca.template(name+" Root", true)
+	if ca.Root, err = sign(root, root, rootKey.Public(), rootKey); err != nil {
+		return nil, err
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Intermediate, err = sign(ca.template(name+" Intermediate", true), ca.Root, intermediateKey.Public(), rootKey); err != nil {
+		return nil, err
+	}
+	ca.intermediateKey = intermediateKey
+	return ca, nil
+}
+
+// Pool holds the CA's root, for a Registrar's AttestationRoots.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Root)
+	return pool
+}
+
+// Issue certifies pub as a device key and returns its chain, leaf first,
+// without the root.
+func (ca *CA) Issue(pub crypto.PublicKey, device string) ([]*x509.Certificate, error) {
+	leaf, err := sign(ca.template(device, false), ca.Intermediate, pub, ca.intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{leaf, ca.Intermediate}, nil
+}
+
+// EncodePEM encodes certificates as consecutive PEM blocks.
+func EncodePEM(certs ...*x509.Certificate) []byte {
+	var out []byte
+	for _, c := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return out
+}
+
+func (ca *CA) template(name string, isCA bool) *x509.Certificate {
+	ca.serial++
+	t := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             ca.notBefore,
+		NotAfter:              ca.notBefore.Add(Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		t.KeyUsage |= x509.KeyUsageCertSign
+	}
+	return t
+}
+
+func sign(template, parent *x509.Certificate, pub crypto.PublicKey, key crypto.Signer) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,175 @@
+// Package ui serves a local web page for looking through devices and moving
+// them between registration states. Every read and write goes through
+// internal/access.
+package ui
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/schema"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+type Server struct {
+	Table     *bigtable.Table
+	Registrar *access.Registrar
+
+	mux *http.ServeMux
+}
+
+func New(tbl *bigtable.Table, r *access.Registrar) *Server {
+	s := &Server{Table: tbl, Registrar: r, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/", s.index)
+	s.mux.HandleFunc("/devices", s.devices)
+	s.mux.HandleFunc("/device", s.device)
+	s.mux.HandleFunc("/device/reset", s.reset)
+	s.mux.HandleFunc("/device/in-flight", s.inFlight)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	qids, err := access.ListQIDs(r.Context(), s.Table)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.render(w, "index.html", map[string]any{"QID": "", "QIDs": qids, "States": access.States})
+}
+
+func (s *Server) devices(w http.ResponseWriter, r *http.Request) {
+	qid := r.FormValue("qid")
+	state := access.State(r.FormValue("state"))
+	devices, err := access.ListDevices(r.Context(), s.Table, qid, state)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	s.render(w, "devices.html", map[string]any{"QID": qid, "State": state, "States": access.States, "Devices": devices})
+}
+
+type cell struct {
+	Timestamp string
+	Value     string
+}
+
+type column struct {
+	Name  string
+	Cells []cell
+}
+
+func (s *Server) device(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	row, err := access.ReadDevice(r.Context(), s.Table, key)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	byName := make(map[string]*column)
+	var columns []*column
+	for family, items := range row {
+		for _, item := range items {
+			c, ok := byName[item.Column]
+			if !ok {
+				c = &column{Name: item.Column}
+				byName[item.Column] = c
+				columns = append(columns, c)
+			}
+			_, name := schema.SplitColumn(item.Column)
+			c.Cells = append(c.Cells, cell{
+				Timestamp: item.Timestamp.Time().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+				Value:     schema.DecodeValue(family, name, item.Value),
+			})
+		}
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].Name < columns[j].Name })
+	s.render(w, "device.html", map[string]any{"Key": key, "State": access.StateOf(row), "Columns": columns})
+}
+
+func (s *Server) reset(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, func(key string) error {
+		return s.Registrar.Reset(r.Context(), key)
+	})
+}
+
+func (s *Server) inFlight(w http.ResponseWriter, r *http.Request) {
+	s.act(w, r, func(key string) error {
+		challenge := r.FormValue("challenge")
+		if challenge == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			challenge = hex.EncodeToString(b)
+		}
+		return s.Registrar.MarkInFlight(r.Context(), key, challenge)
+	})
+}
+
+// act runs a state change posted from the device page and goes back to it.
+func (s *Server) act(w http.ResponseWriter, r *http.Request, f func(key string) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("key")
+	if err := f(key); err != nil {
+		s.fail(w, err)
+		return
+	}
+	http.Redirect(w, r, "/device?key="+url.QueryEscape(key), http.StatusSeeOther)
+}
+
+// sameOrigin reports whether r was sent by a page this server served.
+// Browsers send Origin on every POST, or at least Referer, so a form on
+// another site cannot post here; callers like curl that send neither are let
+// through.
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Referer()
+	}
+	if from == "" {
+		return true
+	}
+	u, err := url.Parse(from)
+	return err == nil && u.Host == r.Host
+}
+
+func (s *Server) render(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Could not render %s: %v", name, err)
+	}
+}
+
+func (s *Server) fail(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, access.ErrNoDevice) || errors.Is(err, access.ErrBadKey) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,86 @@
+package ui_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/theotheradamsmith/btemulator/internal/access"
+	"github.com/theotheradamsmith/btemulator/internal/btetest"
+	"github.com/theotheradamsmith/btemulator/internal/build"
+	"github.com/theotheradamsmith/btemulator/internal/ui"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	env := btetest.New(t, build.Scenarios...)
+	srv := httptest.NewServer(ui.New(env.Table, &access.Registrar{Table: env.Table, Clock: env.Clock}))
+	defer srv.Close()
+	client := srv.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	get := func(path string, want int) string {
+		t.Helper()
+		resp, err := client.Get(srv.URL + path)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, want, resp.StatusCode, "%s", body)
+		return string(body)
+	}
+
+	body := get("/", http.StatusOK)
+	assert.Contains(t, body, `<a href="/devices?qid=foo-usd-123">foo-usd-123</a></td><td>3</td>`)
+
+	body = get("/devices?state=in-flight", http.StatusOK)
+	assert.Contains(t, body, `href="/device?key=qid-in-flight%23did-in-flight"`)
+	assert.NotContains(t, body, "qid-ready")
+
+	body = get("/device?key="+url.QueryEscape("qid-in-flight#did-in-flight"), http.StatusOK)
+	assert.Contains(t, body, `<td>RegistrationProperties:Challenge</td><td>2023-10-01T12:00:00.000Z</td><td><code>&#34;challenge&#34;</code></td>`)
+	get("/device?key="+url.QueryEscape("qid-nope#did-nope"), http.StatusNotFound)
+
+	post := func(path string, form url.Values, origin string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(form.Encode()))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", origin)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// A form on another site cannot change a device.
+	for _, path := range []string{"/device/reset", "/device/in-flight"} {
+		resp := post(path, url.Values{"key": {"qid-in-flight#did-in-flight"}}, "http://elsewhere.example")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	devices, err := access.ListDevices(ctx, env.Table, "qid-in-flight", "")
+	assert.NoError(t, err)
+	assert.Equal(t, access.StateInFlight, devices[0].State)
+
+	resp := post("/device/reset", url.Values{"key": {"qid-in-flight#did-in-flight"}}, srv.URL)
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/device?key=qid-in-flight%23did-in-flight", resp.Header.Get("Location"))
+	devices, err = access.ListDevices(ctx, env.Table, "qid-in-flight", "")
+	assert.NoError(t, err)
+	assert.Equal(t, access.StateReady, devices[0].State)
+
+	resp, err = client.PostForm(srv.URL+"/device/in-flight", url.Values{"key": {"qid-ready#did-ready"}, "challenge": {"qa"}})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	body = get("/device?key="+url.QueryEscape("qid-ready#did-ready"), http.StatusOK)
+	assert.True(t, strings.Contains(body, `<span class="state-in-flight">in-flight</span>`), "%s", body)
+
+	get("/device/reset?key=qid-ready%23did-ready", http.StatusMethodNotAllowed)
+}
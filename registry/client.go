@@ -0,0 +1,61 @@
+// Package registry is a client for the DeviceRegistry gRPC service that
+// btemulator serves, for integration tests in other repos.
+package registry
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/theotheradamsmith/btemulator/registry/registrypb"
+)
+
+type Client struct {
+	registrypb.DeviceRegistryClient
+	conn *grpc.ClientConn
+}
+
+// Dial connects to the DeviceRegistry at target, such as the address given to
+// `btemulator registry --addr`. The connection is plaintext unless opts say
+// otherwise.
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{DeviceRegistryClient: registrypb.NewDeviceRegistryClient(conn), conn: conn}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Register claims the device paired with aid for the appliance holding appk
+// and completes the registration with answer's response to the challenge it
+// is issued, signed by deviceKey's private key. The claim is aborted if
+// answer fails.
+func (c *Client) Register(ctx context.Context, aid, appk, deviceKey, trusted string, answer func(challenge string) (string, error)) (*registrypb.Device, error) {
+	return c.register(ctx, &registrypb.ClaimRequest{Aid: aid, Appk: appk, DeviceKey: deviceKey, Trusted: trusted}, nil, answer)
+}
+
+// RegisterAttested registers a device as Register does, claiming it as
+// hardware and proving it with attestation, the DER certificate chain for
+// deviceKey, leaf first.
+func (c *Client) RegisterAttested(ctx context.Context, aid, appk, deviceKey string, attestation [][]byte, answer func(challenge string) (string, error)) (*registrypb.Device, error) {
+	return c.register(ctx, &registrypb.ClaimRequest{Aid: aid, Appk: appk, DeviceKey: deviceKey, Trusted: "hardware"}, attestation, answer)
+}
+
+func (c *Client) register(ctx context.Context, req *registrypb.ClaimRequest, attestation [][]byte, answer func(challenge string) (string, error)) (*registrypb.Device, error) {
+	claim, err := c.Claim(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	response, err := answer(claim.Challenge)
+	if err != nil {
+		c.Abort(ctx, &registrypb.AbortRequest{Aid: req.Aid, Appk: req.Appk})
+		return nil, err
+	}
+	return c.Complete(ctx, &registrypb.CompleteRequest{Aid: req.Aid, Appk: req.Appk, Response: response, Attestation: attestation})
+}
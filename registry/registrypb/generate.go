@@ -0,0 +1,5 @@
+// Package registrypb holds the DeviceRegistry gRPC service generated from
+// registry.proto with protoc-gen-go v1.30.0 and protoc-gen-go-grpc v1.3.0.
+package registrypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative registry.proto
@@ -0,0 +1,294 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: registry.proto
+
+package registrypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	DeviceRegistry_LookupPairing_FullMethodName = "/btemulator.registry.v1.DeviceRegistry/LookupPairing"
+	DeviceRegistry_Claim_FullMethodName         = "/btemulator.registry.v1.DeviceRegistry/Claim"
+	DeviceRegistry_Complete_FullMethodName      = "/btemulator.registry.v1.DeviceRegistry/Complete"
+	DeviceRegistry_Abort_FullMethodName         = "/btemulator.registry.v1.DeviceRegistry/Abort"
+	DeviceRegistry_Deregister_FullMethodName    = "/btemulator.registry.v1.DeviceRegistry/Deregister"
+	DeviceRegistry_ListByQID_FullMethodName     = "/btemulator.registry.v1.DeviceRegistry/ListByQID"
+)
+
+// DeviceRegistryClient is the client API for DeviceRegistry service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DeviceRegistryClient interface {
+	LookupPairing(ctx context.Context, in *LookupPairingRequest, opts ...grpc.CallOption) (*Device, error)
+	Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (*ClaimResponse, error)
+	Complete(ctx context.Context, in *CompleteRequest, opts ...grpc.CallOption) (*Device, error)
+	Abort(ctx context.Context, in *AbortRequest, opts ...grpc.CallOption) (*Device, error)
+	Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*Device, error)
+	ListByQID(ctx context.Context, in *ListByQIDRequest, opts ...grpc.CallOption) (*ListByQIDResponse, error)
+}
+
+type deviceRegistryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDeviceRegistryClient(cc grpc.ClientConnInterface) DeviceRegistryClient {
+	return &deviceRegistryClient{cc}
+}
+
+func (c *deviceRegistryClient) LookupPairing(ctx context.Context, in *LookupPairingRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, DeviceRegistry_LookupPairing_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceRegistryClient) Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (*ClaimResponse, error) {
+	out := new(ClaimResponse)
+	err := c.cc.Invoke(ctx, DeviceRegistry_Claim_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceRegistryClient) Complete(ctx context.Context, in *CompleteRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, DeviceRegistry_Complete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceRegistryClient) Abort(ctx context.Context, in *AbortRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, DeviceRegistry_Abort_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceRegistryClient) Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, DeviceRegistry_Deregister_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceRegistryClient) ListByQID(ctx context.Context, in *ListByQIDRequest, opts ...grpc.CallOption) (*ListByQIDResponse, error) {
+	out := new(ListByQIDResponse)
+	err := c.cc.Invoke(ctx, DeviceRegistry_ListByQID_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeviceRegistryServer is the server API for DeviceRegistry service.
+// All implementations must embed UnimplementedDeviceRegistryServer
+// for forward compatibility
+type DeviceRegistryServer interface {
+	LookupPairing(context.Context, *LookupPairingRequest) (*Device, error)
+	Claim(context.Context, *ClaimRequest) (*ClaimResponse, error)
+	Complete(context.Context, *CompleteRequest) (*Device, error)
+	Abort(context.Context, *AbortRequest) (*Device, error)
+	Deregister(context.Context, *DeregisterRequest) (*Device, error)
+	ListByQID(context.Context, *ListByQIDRequest) (*ListByQIDResponse, error)
+	mustEmbedUnimplementedDeviceRegistryServer()
+}
+
+// UnimplementedDeviceRegistryServer must be embedded to have forward compatible implementations.
+type UnimplementedDeviceRegistryServer struct {
+}
+
+func (UnimplementedDeviceRegistryServer) LookupPairing(context.Context, *LookupPairingRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LookupPairing not implemented")
+}
+func (UnimplementedDeviceRegistryServer) Claim(context.Context, *ClaimRequest) (*ClaimResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Claim not implemented")
+}
+func (UnimplementedDeviceRegistryServer) Complete(context.Context, *CompleteRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Complete not implemented")
+}
+func (UnimplementedDeviceRegistryServer) Abort(context.Context, *AbortRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Abort not implemented")
+}
+func (UnimplementedDeviceRegistryServer) Deregister(context.Context, *DeregisterRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Deregister not implemented")
+}
+func (UnimplementedDeviceRegistryServer) ListByQID(context.Context, *ListByQIDRequest) (*ListByQIDResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListByQID not implemented")
+}
+func (UnimplementedDeviceRegistryServer) mustEmbedUnimplementedDeviceRegistryServer() {}
+
+// UnsafeDeviceRegistryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DeviceRegistryServer will
+// result in compilation errors.
+type UnsafeDeviceRegistryServer interface {
+	mustEmbedUnimplementedDeviceRegistryServer()
+}
+
+func RegisterDeviceRegistryServer(s grpc.ServiceRegistrar, srv DeviceRegistryServer) {
+	s.RegisterService(&DeviceRegistry_ServiceDesc, srv)
+}
+
+func _DeviceRegistry_LookupPairing_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupPairingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceRegistryServer).LookupPairing(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeviceRegistry_LookupPairing_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceRegistryServer).LookupPairing(ctx, req.(*LookupPairingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeviceRegistry_Claim_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClaimRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceRegistryServer).Claim(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeviceRegistry_Claim_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceRegistryServer).Claim(ctx, req.(*ClaimRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeviceRegistry_Complete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceRegistryServer).Complete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeviceRegistry_Complete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceRegistryServer).Complete(ctx, req.(*CompleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeviceRegistry_Abort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AbortRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceRegistryServer).Abort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeviceRegistry_Abort_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceRegistryServer).Abort(ctx, req.(*AbortRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeviceRegistry_Deregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceRegistryServer).Deregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeviceRegistry_Deregister_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceRegistryServer).Deregister(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DeviceRegistry_ListByQID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListByQIDRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceRegistryServer).ListByQID(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DeviceRegistry_ListByQID_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceRegistryServer).ListByQID(ctx, req.(*ListByQIDRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DeviceRegistry_ServiceDesc is the grpc.ServiceDesc for DeviceRegistry service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DeviceRegistry_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "btemulator.registry.v1.DeviceRegistry",
+	HandlerType: (*DeviceRegistryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "LookupPairing",
+			Handler:    _DeviceRegistry_LookupPairing_Handler,
+		},
+		{
+			MethodName: "Claim",
+			Handler:    _DeviceRegistry_Claim_Handler,
+		},
+		{
+			MethodName: "Complete",
+			Handler:    _DeviceRegistry_Complete_Handler,
+		},
+		{
+			MethodName: "Abort",
+			Handler:    _DeviceRegistry_Abort_Handler,
+		},
+		{
+			MethodName: "Deregister",
+			Handler:    _DeviceRegistry_Deregister_Handler,
+		},
+		{
+			MethodName: "ListByQID",
+			Handler:    _DeviceRegistry_ListByQID_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "registry.proto",
+}